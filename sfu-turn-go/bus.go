@@ -0,0 +1,531 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cloudflare/calls-examples/sfu-turn-go/calls"
+	"github.com/pion/webrtc/v3"
+)
+
+// maxQueuedMessages limits how many messages a Publisher queues while its
+// data channel is not open yet.
+const maxQueuedMessages = 256
+
+// subscriptionBuffer is the number of messages a Subscription buffers,
+// further messages are dropped until the subscriber catches up.
+const subscriptionBuffer = 64
+
+var (
+	// ErrBusClosed is returned when using a closed Bus, Publisher or
+	// Subscription.
+	ErrBusClosed = errors.New("bus closed")
+	// ErrUnpublished is returned by Subscription.Err when the publisher
+	// closed the topic.
+	ErrUnpublished = errors.New("topic closed by the publisher")
+	// ErrQueueFull is returned by Publisher.Write when too many messages
+	// are waiting for the data channel to open.
+	ErrQueueFull = errors.New("too many messages queued for unopened data channel")
+)
+
+// Bus is a publish/subscribe message bus on top of the data channels of a
+// session on the SFU. Every topic is a data channel with the topic as name.
+// The Bus publishes and subscribes the data channels on the SFU and creates
+// the matching negotiated data channels on the PeerConnection.
+type Bus struct {
+	// CloseOnSFU closes published topics on the SFU, which then ends their
+	// subscriptions. The Calls API has no documented endpoint for it, so it
+	// is nil by default and the data channels of closed topics are only
+	// closed locally. The fake SFU in callstest provides one for tests.
+	CloseOnSFU func(ctx context.Context, sessionId string, topics ...string) error
+
+	client    *calls.Client
+	pc        *webrtc.PeerConnection
+	sessionId string
+
+	mu            sync.Mutex
+	closed        bool
+	publishers    map[string]*Publisher
+	subscriptions map[calls.RemoteDataChannel]*Subscription
+}
+
+// NewBus returns a Bus for the session the PeerConnection is connected to.
+func NewBus(client *calls.Client, pc *webrtc.PeerConnection, sessionId string) *Bus {
+	return &Bus{
+		client:        client,
+		pc:            pc,
+		sessionId:     sessionId,
+		publishers:    make(map[string]*Publisher),
+		subscriptions: make(map[calls.RemoteDataChannel]*Subscription),
+	}
+}
+
+// Publish publishes the topic from the session. Publishing a topic again
+// returns the existing Publisher.
+func (b *Bus) Publish(ctx context.Context, topic string) (*Publisher, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrBusClosed
+	}
+	if p := b.publishers[topic]; p != nil {
+		return p, nil
+	}
+
+	channels, err := publishDataChannels(ctx, b.client, b.pc, b.sessionId, topic)
+	if err != nil {
+		return nil, fmt.Errorf("error publishing topic %q: %w", topic, err)
+	}
+	p := newPublisher(b.pc, channels[topic],
+		func(p *Publisher) { b.removePublisher(topic, p) },
+		func(ctx context.Context) error { return b.unpublish(ctx, b.session(), topic) })
+	b.publishers[topic] = p
+	return p, nil
+}
+
+// Subscribe subscribes to the topic published by the remote session.
+// Subscribing to a topic again returns the existing Subscription.
+func (b *Bus) Subscribe(ctx context.Context, remoteSessionId, topic string) (*Subscription, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrBusClosed
+	}
+	remote := calls.RemoteDataChannel{SessionId: remoteSessionId, Name: topic}
+	if s := b.subscriptions[remote]; s != nil {
+		return s, nil
+	}
+
+	channels, err := subscribeDataChannels(ctx, b.client, b.pc, b.sessionId, remote)
+	if err != nil {
+		return nil, fmt.Errorf("error subscribing to topic %q of session %s: %w", topic, remoteSessionId, err)
+	}
+	s := newSubscription(b.pc, channels[remote], b.stale, b.removeSubscription)
+	b.subscriptions[remote] = s
+	return s, nil
+}
+
+// Reopen publishes and subscribes the topics again whose data channels were
+// closed while the connection to the SFU was lost, or which still belong to
+// the PeerConnection the Bus was moved away from. The Publishers and
+// Subscriptions continue on the new data channels, messages written in the
+// meantime are queued like before the first open.
+func (b *Bus) Reopen(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrBusClosed
+	}
+
+	var errs []error
+	for topic, p := range b.publishers {
+		if pc, channel := p.dataChannel(); pc == b.pc && channel.ReadyState() != webrtc.DataChannelStateClosed {
+			continue
+		}
+		channels, err := publishDataChannels(ctx, b.client, b.pc, b.sessionId, topic)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error publishing topic %q again: %w", topic, err))
+			continue
+		}
+		p.replace(b.pc, channels[topic])
+	}
+	for remote, s := range b.subscriptions {
+		if pc, channel := s.dataChannel(); pc == b.pc && channel.ReadyState() != webrtc.DataChannelStateClosed {
+			continue
+		}
+		if err := b.resubscribeLocked(ctx, remote, remote, s); err != nil {
+			errs = append(errs, fmt.Errorf("error subscribing to topic %q of session %s again: %w", remote.Name, remote.SessionId, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// rebind moves the Bus to a new PeerConnection connected to a new session,
+// e.g. after the session was rebuilt with new TURN credentials. Reopen then
+// publishes and subscribes all topics again on it.
+func (b *Bus) rebind(pc *webrtc.PeerConnection, sessionId string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pc = pc
+	b.sessionId = sessionId
+}
+
+// resubscribe moves the subscriptions of topics published by a remote
+// session to the session which replaced it.
+func (b *Bus) resubscribe(ctx context.Context, oldSessionId, newSessionId string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrBusClosed
+	}
+
+	var errs []error
+	for remote, s := range b.subscriptions {
+		if remote.SessionId != oldSessionId {
+			continue
+		}
+		moved := calls.RemoteDataChannel{SessionId: newSessionId, Name: remote.Name}
+		if err := b.resubscribeLocked(ctx, remote, moved, s); err != nil {
+			errs = append(errs, fmt.Errorf("error subscribing to topic %q of session %s: %w", moved.Name, moved.SessionId, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// resubscribeLocked subscribes s to the remote topic on the current
+// PeerConnection and files it under the new remote, b.mu has to be held.
+func (b *Bus) resubscribeLocked(ctx context.Context, old, remote calls.RemoteDataChannel, s *Subscription) error {
+	channels, err := subscribeDataChannels(ctx, b.client, b.pc, b.sessionId, remote)
+	if err != nil {
+		return err
+	}
+	s.replace(b.pc, channels[remote])
+	delete(b.subscriptions, old)
+	b.subscriptions[remote] = s
+	return nil
+}
+
+// Close closes all publishers and subscriptions of the Bus. With CloseOnSFU
+// the published topics are closed on the SFU first, which the context
+// limits, the data channels get closed in any case.
+func (b *Bus) Close(ctx context.Context) error {
+	b.mu.Lock()
+	b.closed = true
+	publishers := b.publishers
+	subscriptions := b.subscriptions
+	b.publishers = nil
+	b.subscriptions = nil
+	sessionId := b.sessionId
+	b.mu.Unlock()
+
+	var errs []error
+	if len(publishers) > 0 {
+		topics := make([]string, 0, len(publishers))
+		for topic := range publishers {
+			topics = append(topics, topic)
+		}
+		errs = append(errs, b.unpublish(ctx, sessionId, topics...))
+	}
+	for _, p := range publishers {
+		errs = append(errs, p.close())
+	}
+	for _, s := range subscriptions {
+		errs = append(errs, s.close(ErrBusClosed))
+	}
+	return errors.Join(errs...)
+}
+
+// unpublish closes the data channels of the topics on the SFU with
+// CloseOnSFU, if set, which then closes the data channels of the
+// subscribers and sends them a dataChannelRemoved event.
+func (b *Bus) unpublish(ctx context.Context, sessionId string, topics ...string) error {
+	if b.CloseOnSFU == nil {
+		return nil
+	}
+	if err := b.CloseOnSFU(ctx, sessionId, topics...); err != nil {
+		return fmt.Errorf("error closing topics %q on the SFU: %w", topics, err)
+	}
+	return nil
+}
+
+// session returns the ID of the session the Bus currently belongs to.
+func (b *Bus) session() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.sessionId
+}
+
+// unpublished ends the subscription of a topic the publisher closed. It is
+// called for the dataChannelRemoved events of the session.
+func (b *Bus) unpublished(remote calls.RemoteDataChannel) {
+	b.mu.Lock()
+	s := b.subscriptions[remote]
+	delete(b.subscriptions, remote)
+	b.mu.Unlock()
+	if s == nil {
+		return
+	}
+	if err := s.close(ErrUnpublished); err != nil {
+		log.Printf("error closing data channel %q: %v", remote.Name, err)
+	}
+}
+
+// dataChannels returns the data channels of the publishers, which may still
+// have buffered messages to send.
+func (b *Bus) dataChannels() []*webrtc.DataChannel {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	channels := make([]*webrtc.DataChannel, 0, len(b.publishers))
+	for _, p := range b.publishers {
+		_, channel := p.dataChannel()
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+// stale reports whether closed data channels of the PeerConnection are
+// expected to be reopened, because its connection is disconnected or failed,
+// or because the Bus moved to a new PeerConnection.
+func (b *Bus) stale(pc *webrtc.PeerConnection) bool {
+	b.mu.Lock()
+	current := b.pc
+	b.mu.Unlock()
+	if pc != current {
+		return true
+	}
+	state := pc.ConnectionState()
+	return state == webrtc.PeerConnectionStateDisconnected || state == webrtc.PeerConnectionStateFailed
+}
+
+func (b *Bus) removePublisher(topic string, p *Publisher) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.publishers[topic] == p {
+		delete(b.publishers, topic)
+	}
+}
+
+func (b *Bus) removeSubscription(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for remote, subscription := range b.subscriptions {
+		if subscription == s {
+			delete(b.subscriptions, remote)
+		}
+	}
+}
+
+// Publisher writes messages to a published topic. Messages written while
+// the data channel is not open are queued and sent once it opens.
+type Publisher struct {
+	remove    func(*Publisher)
+	unpublish func(context.Context) error
+
+	mu      sync.Mutex
+	pc      *webrtc.PeerConnection
+	channel *webrtc.DataChannel
+	open    bool
+	closed  bool
+	queue   [][]byte
+}
+
+func newPublisher(pc *webrtc.PeerConnection, channel *webrtc.DataChannel, remove func(*Publisher), unpublish func(context.Context) error) *Publisher {
+	p := &Publisher{remove: remove, unpublish: unpublish}
+	p.replace(pc, channel)
+	return p
+}
+
+// replace makes the Publisher write to a new data channel of the topic,
+// created on pc.
+func (p *Publisher) replace(pc *webrtc.PeerConnection, channel *webrtc.DataChannel) {
+	p.mu.Lock()
+	p.pc = pc
+	p.channel = channel
+	p.open = false
+	p.mu.Unlock()
+
+	channel.OnOpen(func() { p.flush(channel) })
+	// Messages are queued again until the channel is reopened.
+	channel.OnClose(func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.channel == channel {
+			p.open = false
+		}
+	})
+	if channel.ReadyState() == webrtc.DataChannelStateOpen {
+		p.flush(channel)
+	}
+}
+
+// dataChannel returns the current data channel and the PeerConnection it
+// belongs to.
+func (p *Publisher) dataChannel() (*webrtc.PeerConnection, *webrtc.DataChannel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pc, p.channel
+}
+
+// Write sends data as a single binary message.
+func (p *Publisher) Write(data []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return 0, ErrBusClosed
+	}
+	if !p.open {
+		if len(p.queue) >= maxQueuedMessages {
+			return 0, ErrQueueFull
+		}
+		p.queue = append(p.queue, append([]byte(nil), data...))
+		return len(data), nil
+	}
+	if err := p.channel.Send(data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// flush sends the queued messages once the data channel is open. If
+// sending fails, e.g. because the channel got closed in the meantime, the
+// unsent messages stay queued until the channel is replaced by Bus.Reopen.
+func (p *Publisher) flush(channel *webrtc.DataChannel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.open || p.closed || p.channel != channel {
+		return
+	}
+	for i, data := range p.queue {
+		if err := p.channel.Send(data); err != nil {
+			log.Printf("error sending queued messages on data channel %q, keeping %d queued: %v", channel.Label(), len(p.queue)-i, err)
+			p.queue = p.queue[i:]
+			return
+		}
+	}
+	p.open = true
+	p.queue = nil
+}
+
+// Close stops publishing the topic. With Bus.CloseOnSFU it closes the data
+// channel on the SFU first, which ends the subscriptions of the topic. The
+// context limits closing it there, the data channel gets closed locally in
+// any case.
+func (p *Publisher) Close(ctx context.Context) error {
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		return nil
+	}
+
+	p.remove(p)
+	err := p.unpublish(ctx)
+	return errors.Join(err, p.close())
+}
+
+func (p *Publisher) close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.queue = nil
+	channel := p.channel
+	p.mu.Unlock()
+	return channel.Close()
+}
+
+// Subscription receives the messages of a subscribed topic.
+type Subscription struct {
+	remove   func(*Subscription)
+	stale    func(*webrtc.PeerConnection) bool
+	messages chan []byte
+	dropped  atomic.Uint64
+
+	mu      sync.Mutex
+	pc      *webrtc.PeerConnection
+	channel *webrtc.DataChannel
+	err     error
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newSubscription(pc *webrtc.PeerConnection, channel *webrtc.DataChannel, stale func(*webrtc.PeerConnection) bool, remove func(*Subscription)) *Subscription {
+	s := &Subscription{
+		remove:   remove,
+		stale:    stale,
+		messages: make(chan []byte, subscriptionBuffer),
+		done:     make(chan struct{}),
+	}
+	s.replace(pc, channel)
+	return s
+}
+
+// replace makes the Subscription receive from a new data channel of the
+// topic, created on pc.
+func (s *Subscription) replace(pc *webrtc.PeerConnection, channel *webrtc.DataChannel) {
+	s.mu.Lock()
+	s.pc = pc
+	s.channel = channel
+	s.mu.Unlock()
+
+	// The handler runs on the read loop of the SCTP association, which
+	// must not block on a slow subscriber.
+	channel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		select {
+		case s.messages <- msg.Data:
+		case <-s.done:
+		default:
+			s.dropped.Add(1)
+		}
+	})
+	// The Subscription ends as well when the SFU closes the data channel
+	// because the publisher closed it, unless the connection was lost or
+	// the Bus moved to a new PeerConnection, and Bus.Reopen subscribes
+	// again.
+	channel.OnClose(func() {
+		if pc, current := s.dataChannel(); current == channel && !s.stale(pc) {
+			s.remove(s)
+			s.close(ErrUnpublished)
+		}
+	})
+}
+
+// dataChannel returns the current data channel and the PeerConnection it
+// belongs to.
+func (s *Subscription) dataChannel() (*webrtc.PeerConnection, *webrtc.DataChannel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pc, s.channel
+}
+
+// Messages returns the channel the messages of the topic are delivered on.
+// It is never closed, use Done to learn about the end of the Subscription.
+func (s *Subscription) Messages() <-chan []byte {
+	return s.messages
+}
+
+// Dropped returns the number of messages which were dropped because the
+// buffer of Messages was full.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Done is closed when the Subscription is closed.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the Subscription ended once Done is closed:
+// ErrUnpublished if the publisher closed the topic and ErrBusClosed if it
+// was closed locally. It returns nil while the Subscription is active.
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close ends the Subscription and closes the data channel.
+func (s *Subscription) Close() error {
+	s.remove(s)
+	return s.close(ErrBusClosed)
+}
+
+func (s *Subscription) close(reason error) error {
+	var err error
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.err = reason
+		s.mu.Unlock()
+		close(s.done)
+		_, channel := s.dataChannel()
+		err = channel.Close()
+	})
+	return err
+}
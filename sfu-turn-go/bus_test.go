@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/calls-examples/sfu-turn-go/calls/callstest"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestBus(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	sfu := callstest.NewServer()
+	defer sfu.Close()
+	client := sfu.Client()
+	api := callstest.NewAPI()
+
+	publisherPC, publisherSession := connectSession(t, ctx, api, client)
+	subscriberPC, subscriberSession := connectSession(t, ctx, api, client)
+	publisherBus := NewBus(client, publisherPC, publisherSession)
+	subscriberBus := NewBus(client, subscriberPC, subscriberSession)
+
+	publisher, err := publisherBus.Publish(ctx, "topic")
+	if err != nil {
+		t.Fatalf("error publishing topic: %v", err)
+	}
+	if again, err := publisherBus.Publish(ctx, "topic"); err != nil || again != publisher {
+		t.Fatalf("publishing a topic again must return the same publisher: %v", err)
+	}
+	// Writing right away must not fail, the message is queued until the
+	// data channel is open.
+	if _, err := publisher.Write([]byte("early")); err != nil {
+		t.Fatalf("error writing before the channel is open: %v", err)
+	}
+
+	subscription, err := subscriberBus.Subscribe(ctx, publisherSession, "topic")
+	if err != nil {
+		t.Fatalf("error subscribing to topic: %v", err)
+	}
+	if _, err := subscriberBus.Subscribe(ctx, publisherSession, "missing"); err == nil {
+		t.Fatal("expected an error subscribing to a missing topic")
+	}
+
+	// The SFU drops messages while the subscriber channel isn't open yet,
+	// so keep writing until one makes it through.
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for received := false; !received; {
+		select {
+		case msg := <-subscription.Messages():
+			if string(msg) != "early" && string(msg) != "hello" {
+				t.Fatalf("received unexpected message %q", msg)
+			}
+			received = true
+		case <-ticker.C:
+			if _, err := publisher.Write([]byte("hello")); err != nil {
+				t.Fatalf("error writing message: %v", err)
+			}
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for a message")
+		}
+	}
+
+	if err := subscriberBus.Close(ctx); err != nil {
+		t.Fatalf("error closing the subscriber bus: %v", err)
+	}
+	select {
+	case <-subscription.Done():
+	default:
+		t.Error("subscription not done after closing the bus")
+	}
+	if err := subscription.Err(); !errors.Is(err, ErrBusClosed) {
+		t.Errorf("subscription ended with %v, want ErrBusClosed", err)
+	}
+	if _, err := subscriberBus.Subscribe(ctx, publisherSession, "topic"); !errors.Is(err, ErrBusClosed) {
+		t.Errorf("expected ErrBusClosed subscribing on a closed bus, got %v", err)
+	}
+
+	if err := publisher.Close(ctx); err != nil {
+		t.Fatalf("error closing the publisher: %v", err)
+	}
+	if _, err := publisher.Write([]byte("late")); !errors.Is(err, ErrBusClosed) {
+		t.Errorf("expected ErrBusClosed writing to a closed publisher, got %v", err)
+	}
+	if err := publisherBus.Close(ctx); err != nil {
+		t.Errorf("error closing the publisher bus: %v", err)
+	}
+}
+
+func TestBusReopen(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	sfu := callstest.NewServer()
+	defer sfu.Close()
+	client := sfu.Client()
+	api := callstest.NewAPI()
+
+	publisherPC, publisherSession := connectSession(t, ctx, api, client)
+	subscriberPC, subscriberSession := connectSession(t, ctx, api, client)
+	publisherBus := NewBus(client, publisherPC, publisherSession)
+	subscriberBus := NewBus(client, subscriberPC, subscriberSession)
+
+	publisher, err := publisherBus.Publish(ctx, "topic")
+	if err != nil {
+		t.Fatalf("error publishing topic: %v", err)
+	}
+	_, first := publisher.dataChannel()
+	waitDataChannelState(t, ctx, first, webrtc.DataChannelStateOpen)
+
+	// Reopen leaves open data channels alone.
+	if err := publisherBus.Reopen(ctx); err != nil {
+		t.Fatalf("error reopening: %v", err)
+	}
+	if _, channel := publisher.dataChannel(); channel != first {
+		t.Fatal("Reopen replaced an open data channel")
+	}
+
+	if err := first.Close(); err != nil {
+		t.Fatalf("error closing the data channel: %v", err)
+	}
+	waitDataChannelState(t, ctx, first, webrtc.DataChannelStateClosed)
+	if err := publisherBus.Reopen(ctx); err != nil {
+		t.Fatalf("error reopening: %v", err)
+	}
+	if _, channel := publisher.dataChannel(); channel == first {
+		t.Fatal("Reopen did not replace the closed data channel")
+	}
+
+	// The Publisher keeps working on the new data channel.
+	subscription, err := subscriberBus.Subscribe(ctx, publisherSession, "topic")
+	if err != nil {
+		t.Fatalf("error subscribing to topic: %v", err)
+	}
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for received := false; !received; {
+		select {
+		case msg := <-subscription.Messages():
+			if string(msg) != "hello" {
+				t.Fatalf("received unexpected message %q", msg)
+			}
+			received = true
+		case <-ticker.C:
+			if _, err := publisher.Write([]byte("hello")); err != nil {
+				t.Fatalf("error writing message: %v", err)
+			}
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for a message")
+		}
+	}
+
+	if err := publisherBus.Close(ctx); err != nil {
+		t.Errorf("error closing the publisher bus: %v", err)
+	}
+	if err := publisherBus.Reopen(ctx); !errors.Is(err, ErrBusClosed) {
+		t.Errorf("expected ErrBusClosed reopening a closed bus, got %v", err)
+	}
+}
+
+func TestSubscriptionDropsMessages(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	sfu := callstest.NewServer()
+	defer sfu.Close()
+	client := sfu.Client()
+	api := callstest.NewAPI()
+
+	publisherPC, publisherSession := connectSession(t, ctx, api, client)
+	subscriberPC, subscriberSession := connectSession(t, ctx, api, client)
+	publisherBus := NewBus(client, publisherPC, publisherSession)
+	defer publisherBus.Close(ctx)
+	subscriberBus := NewBus(client, subscriberPC, subscriberSession)
+	defer subscriberBus.Close(ctx)
+
+	publisher, err := publisherBus.Publish(ctx, "topic")
+	if err != nil {
+		t.Fatalf("error publishing topic: %v", err)
+	}
+	subscription, err := subscriberBus.Subscribe(ctx, publisherSession, "topic")
+	if err != nil {
+		t.Fatalf("error subscribing to topic: %v", err)
+	}
+	_, channel := subscription.dataChannel()
+	waitDataChannelState(t, ctx, channel, webrtc.DataChannelStateOpen)
+
+	// Without a reader the buffer fills up and the rest is dropped
+	// instead of blocking the data channel.
+	const extra = 10
+	for i := 0; i < subscriptionBuffer+extra; i++ {
+		if _, err := publisher.Write([]byte("hello")); err != nil {
+			t.Fatalf("error writing message: %v", err)
+		}
+	}
+	for subscription.Dropped() < extra {
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for dropped messages, %d buffered and %d dropped", len(subscription.Messages()), subscription.Dropped())
+		}
+	}
+	if n := len(subscription.Messages()); n != subscriptionBuffer {
+		t.Errorf("expected %d buffered messages, got %d", subscriptionBuffer, n)
+	}
+
+	// Once drained, the subscription receives again.
+	for len(subscription.Messages()) > 0 {
+		<-subscription.Messages()
+	}
+	if _, err := publisher.Write([]byte("again")); err != nil {
+		t.Fatalf("error writing message: %v", err)
+	}
+	select {
+	case msg := <-subscription.Messages():
+		if string(msg) != "again" {
+			t.Errorf("received unexpected message %q", msg)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for a message after draining")
+	}
+}
+
+func TestPublisherFlushFailure(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	sfu := callstest.NewServer()
+	defer sfu.Close()
+	client := sfu.Client()
+	api := callstest.NewAPI()
+
+	pc, sessionId := connectSession(t, ctx, api, client)
+	bus := NewBus(client, pc, sessionId)
+	defer bus.Close(ctx)
+	publisher, err := bus.Publish(ctx, "topic")
+	if err != nil {
+		t.Fatalf("error publishing topic: %v", err)
+	}
+	_, first := publisher.dataChannel()
+	waitDataChannelState(t, ctx, first, webrtc.DataChannelStateOpen)
+
+	// Messages written after the channel closed are queued.
+	if err := first.Close(); err != nil {
+		t.Fatalf("error closing the data channel: %v", err)
+	}
+	waitDataChannelState(t, ctx, first, webrtc.DataChannelStateClosed)
+	for _, msg := range []string{"one", "two"} {
+		if _, err := publisher.Write([]byte(msg)); err != nil {
+			t.Fatalf("error queueing message: %v", err)
+		}
+	}
+
+	// Flushing to the closed channel fails and keeps the messages queued,
+	// further messages are queued behind them.
+	publisher.flush(first)
+	if _, err := publisher.Write([]byte("three")); err != nil {
+		t.Fatalf("error queueing message after the failed flush: %v", err)
+	}
+	publisher.mu.Lock()
+	queued, open := len(publisher.queue), publisher.open
+	publisher.mu.Unlock()
+	if queued != 3 || open {
+		t.Fatalf("%d messages queued and open %v after the failed flush, want 3 and false", queued, open)
+	}
+
+	// They are sent once the topic is published again.
+	if err := bus.Reopen(ctx); err != nil {
+		t.Fatalf("error reopening: %v", err)
+	}
+	_, second := publisher.dataChannel()
+	waitDataChannelState(t, ctx, second, webrtc.DataChannelStateOpen)
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		var sent uint32
+		for _, s := range pc.GetStats() {
+			if stats, ok := s.(webrtc.DataChannelStats); ok && stats.DataChannelIdentifier == int32(*second.ID()) && stats.State == webrtc.DataChannelStateOpen {
+				sent = stats.MessagesSent
+			}
+		}
+		if sent == 3 {
+			break
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for the queued messages to be sent, %d sent", sent)
+		}
+	}
+	publisher.mu.Lock()
+	defer publisher.mu.Unlock()
+	if len(publisher.queue) != 0 || !publisher.open {
+		t.Errorf("%d messages still queued, open %v", len(publisher.queue), publisher.open)
+	}
+}
+
+// waitDataChannelState waits until the data channel is in the given state.
+func waitDataChannelState(t *testing.T, ctx context.Context, channel *webrtc.DataChannel, state webrtc.DataChannelState) {
+	t.Helper()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for channel.ReadyState() != state {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for data channel %q to be %s", channel.Label(), state)
+		}
+	}
+}
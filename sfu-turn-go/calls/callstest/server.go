@@ -0,0 +1,870 @@
+// Package callstest provides an in-process fake of the Calls SFU HTTP API
+// for tests which can't reach rtc.live.cloudflare.com.
+//
+// The fake terminates real PeerConnections with Pion, so data channel
+// messages and RTP packets published by one session are forwarded to all
+// sessions which subscribed to them, just like the real SFU would do. Added
+// and removed tracks and removed data channels are announced on the
+// server-events data channel.
+package callstest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/cloudflare/calls-examples/sfu-turn-go/calls"
+	"github.com/cloudflare/calls-examples/sfu-turn-go/internal/events"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// AppID is the only Calls app ID served by the fake SFU.
+	AppID = "test-app"
+	// Token is the API token the fake SFU expects as bearer token.
+	Token = "test-token"
+)
+
+// Server is a fake Calls SFU serving the HTTP API on a local
+// httptest.Server.
+type Server struct {
+	*httptest.Server
+
+	api *webrtc.API
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// session is the SFU side of a single session.
+type session struct {
+	id string
+	pc *webrtc.PeerConnection
+
+	// negotiationMu serializes all offer/answer exchanges on pc.
+	negotiationMu sync.Mutex
+
+	mu            sync.Mutex
+	nextChannelID uint16
+	dataChannels  map[string]*publishedChannel
+	tracks        map[string]*webrtc.TrackLocalStaticRTP
+	// trackNames maps the mids of published tracks to their names.
+	trackNames map[string]string
+	// trackSubscribers holds the senders forwarding a published track to
+	// other sessions, keyed by track name.
+	trackSubscribers map[string][]trackSubscriber
+	// serverEvents is the server-events data channel opened by the client.
+	// Events are queued in pendingEvents until it is open.
+	serverEvents  *webrtc.DataChannel
+	pendingEvents []events.Event
+}
+
+// trackSubscriber is a sender forwarding a published track to the session
+// which subscribed to it.
+type trackSubscriber struct {
+	sess   *session
+	mid    string
+	sender *webrtc.RTPSender
+}
+
+// publishedChannel forwards the messages of a published data channel to all
+// of its subscribers.
+type publishedChannel struct {
+	mu          sync.Mutex
+	subscribers []channelSubscriber
+}
+
+// channelSubscriber is a data channel forwarding a published data channel to
+// the session which subscribed to it.
+type channelSubscriber struct {
+	sess    *session
+	channel *webrtc.DataChannel
+}
+
+// NewServer starts a fake SFU listening on the loopback interface. The
+// caller has to Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		api:      NewAPI(),
+		sessions: make(map[string]*session),
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("POST /v1/apps/{appId}/sessions/new", s.authenticate(s.handleNewSession))
+	mux.Handle("POST /v1/apps/{appId}/sessions/{sessionId}/datachannels/new", s.authenticate(s.handleNewDataChannels))
+	mux.Handle("POST /v1/apps/{appId}/sessions/{sessionId}/tracks/new", s.authenticate(s.handleNewTracks))
+	mux.Handle("PUT /v1/apps/{appId}/sessions/{sessionId}/renegotiate", s.authenticate(s.handleRenegotiate))
+	mux.Handle("PUT /v1/apps/{appId}/sessions/{sessionId}/tracks/close", s.authenticate(s.handleCloseTracks))
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// NewAPI returns a Pion API with the default codecs and interceptors, which
+// only gathers host candidates on the loopback interface. PeerConnections
+// connecting to the fake SFU need to be created with it. The options may
+// change the settings further, e.g. shorten the ICE timeouts.
+func NewAPI(options ...func(*webrtc.SettingEngine)) *webrtc.API {
+	var se webrtc.SettingEngine
+	se.SetIncludeLoopbackCandidate(true)
+	se.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	se.SetIPFilter(func(ip net.IP) bool { return ip.IsLoopback() })
+	for _, option := range options {
+		option(&se)
+	}
+
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		panic(err)
+	}
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		panic(err)
+	}
+
+	return webrtc.NewAPI(webrtc.WithSettingEngine(se), webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i))
+}
+
+// Client returns a Calls API client which talks to the fake SFU.
+func (s *Server) Client() *calls.Client {
+	client := calls.NewClient(AppID, Token)
+	client.BaseURL = s.URL + "/v1"
+	client.HTTPClient = s.Server.Client()
+	return client
+}
+
+// Close closes all session PeerConnections and shuts down the server.
+func (s *Server) Close() {
+	s.Server.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, sess := range s.sessions {
+		if err := sess.pc.Close(); err != nil {
+			log.Printf("error closing session %s: %v", id, err)
+		}
+		delete(s.sessions, id)
+	}
+}
+
+// RemoteDescription returns the SDP the client last sent for the session,
+// or an empty string if the session does not exist.
+func (s *Server) RemoteDescription(sessionId string) string {
+	s.mu.Lock()
+	sess := s.sessions[sessionId]
+	s.mu.Unlock()
+	if sess == nil {
+		return ""
+	}
+	if description := sess.pc.CurrentRemoteDescription(); description != nil {
+		return description.SDP
+	}
+	return ""
+}
+
+// CloseDataChannels closes published data channels of a session, like the
+// publisher leaving would. They can't be subscribed anymore, and their
+// subscribers get a dataChannelRemoved event before their data channels are
+// closed. The Calls API has no documented endpoint for it, so tests pass
+// the method to Bus.CloseOnSFU instead of calling the HTTP API.
+func (s *Server) CloseDataChannels(ctx context.Context, sessionId string, names ...string) error {
+	s.mu.Lock()
+	sess := s.sessions[sessionId]
+	s.mu.Unlock()
+	if sess == nil {
+		return fmt.Errorf("session %s does not exist", sessionId)
+	}
+
+	var errs []error
+	for _, name := range names {
+		sess.mu.Lock()
+		published := sess.dataChannels[name]
+		delete(sess.dataChannels, name)
+		sess.mu.Unlock()
+
+		if published == nil {
+			errs = append(errs, fmt.Errorf("data channel %q is not published by session %s", name, sessionId))
+			continue
+		}
+		published.unpublish(sessionId, name)
+	}
+	return errors.Join(errs...)
+}
+
+// authenticate checks the API token and app ID before calling next.
+func (s *Server) authenticate(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+Token {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "invalid API token")
+			return
+		}
+		if r.PathValue("appId") != AppID {
+			writeError(w, http.StatusNotFound, "app_not_found", "unknown app ID")
+			return
+		}
+		next(w, r)
+	})
+}
+
+func (s *Server) handleNewSession(w http.ResponseWriter, r *http.Request) {
+	var request calls.NewSessionRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+
+	pc, err := s.api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+	sess := &session{
+		id: randomID(),
+		pc: pc,
+		// The SFU answers, so it takes the DTLS client role and uses the
+		// even SCTP stream IDs. Starting at 2 avoids clashing with the
+		// in-band channels created by the client.
+		nextChannelID: 2,
+		dataChannels:  make(map[string]*publishedChannel),
+		tracks:        make(map[string]*webrtc.TrackLocalStaticRTP),
+		trackNames:    make(map[string]string),
+
+		trackSubscribers: make(map[string][]trackSubscriber),
+	}
+	pc.OnTrack(sess.forwardTrack)
+	pc.OnDataChannel(func(channel *webrtc.DataChannel) {
+		if channel.Label() == calls.ServerEventsLabel {
+			channel.OnOpen(func() {
+				sess.mu.Lock()
+				sess.serverEvents = channel
+				pending := sess.pendingEvents
+				sess.pendingEvents = nil
+				sess.mu.Unlock()
+				for _, event := range pending {
+					sess.sendEvent(event)
+				}
+			})
+		}
+	})
+
+	response := calls.NewSessionResponse{SessionId: sess.id}
+	if request.SessionDescription != nil {
+		answer, err := sess.answer(*request.SessionDescription)
+		if err != nil {
+			pc.Close()
+			writeError(w, http.StatusBadRequest, "invalid_sdp", err.Error())
+			return
+		}
+		response.Description = answer
+	}
+
+	s.mu.Lock()
+	s.sessions[sess.id] = sess
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusCreated, response)
+}
+
+func (s *Server) handleNewDataChannels(w http.ResponseWriter, r *http.Request) {
+	sess, ok := s.session(w, r.PathValue("sessionId"))
+	if !ok {
+		return
+	}
+	var request calls.DataChannelRequests
+	if !readJSON(w, r, &request) {
+		return
+	}
+
+	// Errors of single data channels are reported in the response, like
+	// the SFU does, instead of failing the whole request.
+	var response calls.DataChannelResponses
+	for _, dc := range request.DataChannels {
+		item := calls.DataChannelResponse{
+			Location:        dc.Location,
+			DataChannelName: dc.DataChannelName,
+		}
+
+		var published *publishedChannel
+		if dc.Location == "remote" {
+			published, item.ErrorCode, item.ErrorDescription = s.publishedChannel(dc)
+			if item.ErrorCode != "" {
+				response.DataChannels = append(response.DataChannels, item)
+				continue
+			}
+		}
+
+		id, channel, err := sess.createDataChannel(dc.DataChannelName)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_error", err.Error())
+			return
+		}
+		item.Id = id
+
+		if published != nil {
+			published.mu.Lock()
+			published.subscribers = append(published.subscribers, channelSubscriber{sess: sess, channel: channel})
+			published.mu.Unlock()
+		} else {
+			published = &publishedChannel{}
+			channel.OnMessage(published.forward)
+			sess.mu.Lock()
+			sess.dataChannels[dc.DataChannelName] = published
+			sess.mu.Unlock()
+
+			// Once the publisher closes the data channel, the channels of
+			// the subscribers get closed as well.
+			name := dc.DataChannelName
+			channel.OnClose(func() {
+				sess.mu.Lock()
+				if sess.dataChannels[name] == published {
+					delete(sess.dataChannels, name)
+				}
+				sess.mu.Unlock()
+				published.close()
+			})
+		}
+
+		response.DataChannels = append(response.DataChannels, item)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// publishedChannel looks up the data channel a remote data channel request
+// refers to. If it doesn't exist the error code and description are
+// returned.
+func (s *Server) publishedChannel(dc calls.DataChannelRequest) (*publishedChannel, string, string) {
+	if dc.SessionId == nil {
+		return nil, "invalid_request", "remote data channel without session ID"
+	}
+	s.mu.Lock()
+	remote := s.sessions[*dc.SessionId]
+	s.mu.Unlock()
+	if remote == nil {
+		return nil, "session_not_found", fmt.Sprintf("session %s does not exist", *dc.SessionId)
+	}
+	remote.mu.Lock()
+	published := remote.dataChannels[dc.DataChannelName]
+	remote.mu.Unlock()
+	if published == nil {
+		return nil, "data_channel_not_found",
+			fmt.Sprintf("data channel %q is not published by session %s", dc.DataChannelName, *dc.SessionId)
+	}
+	return published, "", ""
+}
+
+func (s *Server) handleNewTracks(w http.ResponseWriter, r *http.Request) {
+	sess, ok := s.session(w, r.PathValue("sessionId"))
+	if !ok {
+		return
+	}
+	var request calls.NewTracksRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+
+	// Local tracks come with an offer from the client, which adds the
+	// transceivers the tracks get published on. An offer without tracks
+	// only renegotiates the session, e.g. after an ICE restart.
+	if request.SessionDescription != nil {
+		response, err := sess.publishTracks(request)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, response)
+		return
+	}
+
+	// Remote tracks get added to the session by the SFU, which then sends
+	// an offer to the client. The request is validated before adding any
+	// transceiver, so an invalid one leaves the session untouched.
+	for _, locator := range request.Tracks {
+		if locator.Location != "remote" || locator.SessionId == nil {
+			writeError(w, http.StatusBadRequest, "invalid_request", "local tracks require a session description")
+			return
+		}
+	}
+	sess.negotiationMu.Lock()
+	defer sess.negotiationMu.Unlock()
+
+	// Tracks which can't be found are reported in the response, the others
+	// still get added.
+	var response calls.NewTracksResponse
+	transceivers := make(map[int]*webrtc.RTPTransceiver)
+	for i, locator := range request.Tracks {
+		s.mu.Lock()
+		remote := s.sessions[*locator.SessionId]
+		s.mu.Unlock()
+		var track *webrtc.TrackLocalStaticRTP
+		if remote != nil {
+			remote.mu.Lock()
+			track = remote.tracks[locator.TrackName]
+			remote.mu.Unlock()
+		}
+		if track == nil {
+			continue
+		}
+
+		transceiver, err := sess.pc.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionSendonly,
+		})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_error", err.Error())
+			return
+		}
+		go drainRTCP(transceiver.Sender())
+		transceivers[i] = transceiver
+	}
+
+	if len(transceivers) > 0 {
+		offer, err := sess.offer()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_error", err.Error())
+			return
+		}
+		response.RequiresImmediateRenegotiation = true
+		response.SessionDescription = offer
+	}
+	var added []events.Event
+	for i, locator := range request.Tracks {
+		item := calls.NewTrackResponse{
+			TrackName: locator.TrackName,
+			SessionId: locator.SessionId,
+		}
+		if transceiver := transceivers[i]; transceiver != nil {
+			item.Mid = transceiver.Mid()
+			s.addTrackSubscriber(*locator.SessionId, locator.TrackName,
+				trackSubscriber{sess: sess, mid: item.Mid, sender: transceiver.Sender()})
+			added = append(added, events.Event{
+				Type:      events.TrackAdded,
+				SessionId: *locator.SessionId,
+				TrackName: locator.TrackName,
+				Mid:       item.Mid,
+			})
+		} else {
+			item.ErrorCode = "track_not_found"
+			item.ErrorDescription = fmt.Sprintf("track %q is not published by session %s", locator.TrackName, *locator.SessionId)
+		}
+		response.Tracks = append(response.Tracks, item)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+	for _, event := range added {
+		sess.sendEvent(event)
+	}
+}
+
+// addTrackSubscriber remembers the sender forwarding a published track, so
+// that the subscriber can be told when the track gets closed.
+func (s *Server) addTrackSubscriber(publisherId, trackName string, subscriber trackSubscriber) {
+	s.mu.Lock()
+	publisher := s.sessions[publisherId]
+	s.mu.Unlock()
+	if publisher == nil {
+		return
+	}
+	publisher.mu.Lock()
+	publisher.trackSubscribers[trackName] = append(publisher.trackSubscribers[trackName], subscriber)
+	publisher.mu.Unlock()
+}
+
+func (s *Server) handleRenegotiate(w http.ResponseWriter, r *http.Request) {
+	sess, ok := s.session(w, r.PathValue("sessionId"))
+	if !ok {
+		return
+	}
+	var request calls.RenegotiateRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	if request.SessionDescription.Type != "answer" {
+		writeError(w, http.StatusBadRequest, "invalid_sdp", "expected an answer")
+		return
+	}
+
+	sess.negotiationMu.Lock()
+	defer sess.negotiationMu.Unlock()
+
+	err := sess.pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  request.SessionDescription.Sdp,
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_sdp", err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, calls.RenegotiateResponse{})
+}
+
+// handleCloseTracks closes tracks of a session. Unless the close is
+// forced, the request has to contain an offer in which the transceivers of
+// the tracks are inactive. Closed published tracks can't be subscribed
+// anymore, and their subscribers get an RTCP BYE.
+func (s *Server) handleCloseTracks(w http.ResponseWriter, r *http.Request) {
+	sess, ok := s.session(w, r.PathValue("sessionId"))
+	if !ok {
+		return
+	}
+	var request calls.CloseTracksRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+
+	var response calls.CloseTracksResponse
+	if !request.Force {
+		if request.SessionDescription == nil || request.SessionDescription.Type != "offer" {
+			writeError(w, http.StatusBadRequest, "invalid_request", "closing tracks without force requires an offer")
+			return
+		}
+		answer, err := sess.answer(*request.SessionDescription)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_sdp", err.Error())
+			return
+		}
+		response.SessionDescription = answer
+	}
+
+	for _, track := range request.Tracks {
+		sess.mu.Lock()
+		name, published := sess.trackNames[track.Mid]
+		subscribers := sess.trackSubscribers[name]
+		if published {
+			delete(sess.tracks, name)
+			delete(sess.trackNames, track.Mid)
+			delete(sess.trackSubscribers, name)
+		}
+		sess.mu.Unlock()
+
+		for _, subscriber := range subscribers {
+			subscriber.end(sess.id, name)
+		}
+		response.Tracks = append(response.Tracks, calls.NewTrackResponse{TrackName: name, Mid: track.Mid})
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// end stops forwarding the track to the subscriber and tells it with an
+// RTCP BYE and a trackRemoved event that the track is gone.
+func (t trackSubscriber) end(publisherId, trackName string) {
+	var sources []uint32
+	for _, encoding := range t.sender.GetParameters().Encodings {
+		sources = append(sources, uint32(encoding.SSRC))
+	}
+	// Pion panics checking whether negotiation is needed when a sender has
+	// no track, so the forwarded track is replaced with an idle one with the
+	// same IDs instead of nil.
+	if forwarded, ok := t.sender.Track().(*webrtc.TrackLocalStaticRTP); ok {
+		idle, err := webrtc.NewTrackLocalStaticRTP(forwarded.Codec(), forwarded.ID(), forwarded.StreamID())
+		if err == nil {
+			err = t.sender.ReplaceTrack(idle)
+		}
+		if err != nil {
+			log.Printf("error stopping forwarded track: %v", err)
+		}
+	}
+	if err := t.sess.pc.WriteRTCP([]rtcp.Packet{&rtcp.Goodbye{Sources: sources}}); err != nil {
+		log.Printf("error sending RTCP BYE: %v", err)
+	}
+	t.sess.sendEvent(events.Event{
+		Type:      events.TrackRemoved,
+		SessionId: publisherId,
+		TrackName: trackName,
+		Mid:       t.mid,
+	})
+}
+
+// sendEvent sends an event on the server-events data channel of the
+// session. Until the client opened the channel, events get queued.
+func (sess *session) sendEvent(event events.Event) {
+	sess.mu.Lock()
+	channel := sess.serverEvents
+	if channel == nil {
+		sess.pendingEvents = append(sess.pendingEvents, event)
+	}
+	sess.mu.Unlock()
+	if channel == nil {
+		return
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("error marshalling server event: %v", err)
+		return
+	}
+	if err := channel.SendText(string(data)); err != nil {
+		log.Printf("error sending server event: %v", err)
+	}
+}
+
+// session looks up a session and writes an error response if it doesn't
+// exist.
+func (s *Server) session(w http.ResponseWriter, id string) (*session, bool) {
+	s.mu.Lock()
+	sess := s.sessions[id]
+	s.mu.Unlock()
+	if sess == nil {
+		writeError(w, http.StatusNotFound, "session_not_found", fmt.Sprintf("session %s does not exist", id))
+		return nil, false
+	}
+	return sess, true
+}
+
+// answer applies an offer from the client and returns the answer including
+// all ICE candidates.
+func (sess *session) answer(offer calls.SessionDescription) (*calls.SessionDescription, error) {
+	sess.negotiationMu.Lock()
+	defer sess.negotiationMu.Unlock()
+
+	err := sess.pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offer.Sdp,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error setting remote description: %w", err)
+	}
+
+	answer, err := sess.pc.CreateAnswer(nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating answer: %w", err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(sess.pc)
+	if err := sess.pc.SetLocalDescription(answer); err != nil {
+		return nil, fmt.Errorf("error setting local description: %w", err)
+	}
+	<-gatherComplete
+
+	return &calls.SessionDescription{Type: "answer", Sdp: sess.pc.LocalDescription().SDP}, nil
+}
+
+// offer creates an offer for the session. The caller has to hold
+// negotiationMu.
+func (sess *session) offer() (*calls.SessionDescription, error) {
+	offer, err := sess.pc.CreateOffer(nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating offer: %w", err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(sess.pc)
+	if err := sess.pc.SetLocalDescription(offer); err != nil {
+		return nil, fmt.Errorf("error setting local description: %w", err)
+	}
+	<-gatherComplete
+
+	return &calls.SessionDescription{Type: "offer", Sdp: sess.pc.LocalDescription().SDP}, nil
+}
+
+// publishTracks registers the local tracks of the request, so that other
+// sessions can subscribe to them, and answers the offer.
+func (sess *session) publishTracks(request calls.NewTracksRequest) (*calls.NewTracksResponse, error) {
+	response := &calls.NewTracksResponse{}
+	for _, locator := range request.Tracks {
+		if locator.Location != "local" || locator.Mid == "" {
+			return nil, fmt.Errorf("track %q must be local and have a mid", locator.TrackName)
+		}
+		response.Tracks = append(response.Tracks, calls.NewTrackResponse{
+			TrackName: locator.TrackName,
+			Mid:       locator.Mid,
+		})
+	}
+
+	answer, err := sess.answer(*request.SessionDescription)
+	if err != nil {
+		return nil, err
+	}
+	response.SessionDescription = answer
+
+	// The codecs are only known once the offer has been answered.
+	for _, locator := range request.Tracks {
+		transceiver := sess.transceiver(locator.Mid)
+		if transceiver == nil {
+			return nil, fmt.Errorf("no transceiver for mid %q", locator.Mid)
+		}
+		codecs := transceiver.Receiver().GetParameters().Codecs
+		if len(codecs) == 0 {
+			return nil, fmt.Errorf("no codec negotiated for mid %q", locator.Mid)
+		}
+		track, err := webrtc.NewTrackLocalStaticRTP(codecs[0].RTPCodecCapability, locator.TrackName, sess.id)
+		if err != nil {
+			return nil, err
+		}
+		sess.mu.Lock()
+		sess.tracks[locator.TrackName] = track
+		sess.trackNames[locator.Mid] = locator.TrackName
+		sess.mu.Unlock()
+	}
+
+	return response, nil
+}
+
+// transceiver returns the transceiver of the session with the given mid.
+func (sess *session) transceiver(mid string) *webrtc.RTPTransceiver {
+	for _, transceiver := range sess.pc.GetTransceivers() {
+		if transceiver.Mid() == mid {
+			return transceiver
+		}
+	}
+	return nil
+}
+
+// forwardTrack writes all RTP packets of a published track to the local
+// track which subscribers are bound to.
+func (sess *session) forwardTrack(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	var mid string
+	for _, transceiver := range sess.pc.GetTransceivers() {
+		if transceiver.Receiver() == receiver {
+			mid = transceiver.Mid()
+		}
+	}
+
+	sess.mu.Lock()
+	track := sess.tracks[sess.trackNames[mid]]
+	sess.mu.Unlock()
+	if track == nil {
+		log.Printf("session %s received unpublished track on mid %q", sess.id, mid)
+		return
+	}
+
+	for {
+		packet, _, err := remote.ReadRTP()
+		if err != nil {
+			return
+		}
+		// Writing only fails for subscribers which went away already, so
+		// errors are ignored here.
+		_ = track.WriteRTP(packet)
+	}
+}
+
+// createDataChannel creates a negotiated data channel with the next free ID
+// on the session.
+func (sess *session) createDataChannel(name string) (uint16, *webrtc.DataChannel, error) {
+	sess.mu.Lock()
+	id := sess.nextChannelID
+	sess.nextChannelID += 2
+	sess.mu.Unlock()
+
+	negotiated := true
+	channel, err := sess.pc.CreateDataChannel(name, &webrtc.DataChannelInit{
+		Negotiated: &negotiated,
+		ID:         &id,
+	})
+	if err != nil {
+		return 0, nil, fmt.Errorf("error creating data channel %q: %w", name, err)
+	}
+	return id, channel, nil
+}
+
+// forward sends a message received on the published channel to all
+// subscribers whose channels are open.
+func (p *publishedChannel) forward(msg webrtc.DataChannelMessage) {
+	p.mu.Lock()
+	subscribers := append([]channelSubscriber(nil), p.subscribers...)
+	p.mu.Unlock()
+
+	for _, subscriber := range subscribers {
+		if subscriber.channel.ReadyState() != webrtc.DataChannelStateOpen {
+			continue
+		}
+		var err error
+		if msg.IsString {
+			err = subscriber.channel.SendText(string(msg.Data))
+		} else {
+			err = subscriber.channel.Send(msg.Data)
+		}
+		if err != nil {
+			log.Printf("error forwarding data channel message: %v", err)
+		}
+	}
+}
+
+// close closes the data channels of all subscribers.
+func (p *publishedChannel) close() {
+	for _, subscriber := range p.takeSubscribers() {
+		subscriber.closeChannel()
+	}
+}
+
+// unpublish tells all subscribers with a dataChannelRemoved event that the
+// publisher closed the data channel, and closes their data channels.
+func (p *publishedChannel) unpublish(publisherId, name string) {
+	for _, subscriber := range p.takeSubscribers() {
+		subscriber.sess.sendEvent(events.Event{
+			Type:            events.DataChannelRemoved,
+			SessionId:       publisherId,
+			DataChannelName: name,
+		})
+		subscriber.closeChannel()
+	}
+}
+
+func (p *publishedChannel) takeSubscribers() []channelSubscriber {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	subscribers := p.subscribers
+	p.subscribers = nil
+	return subscribers
+}
+
+func (c channelSubscriber) closeChannel() {
+	if err := c.channel.Close(); err != nil {
+		log.Printf("error closing subscribed data channel: %v", err)
+	}
+}
+
+// drainRTCP reads incoming RTCP packets, so that the interceptors of the
+// sender get to process them.
+func drainRTCP(sender *webrtc.RTPSender) {
+	buf := make([]byte, 1500)
+	for {
+		if _, _, err := sender.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+func randomID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// readJSON decodes the request body and writes an error response if it
+// isn't valid JSON.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.ContentLength == 0 {
+		return true
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("error writing response: %v", err)
+	}
+}
+
+// writeError writes an error response in the format of the Calls API.
+func writeError(w http.ResponseWriter, statusCode int, errorCode, errorDescription string) {
+	writeJSON(w, statusCode, map[string]string{
+		"errorCode":        errorCode,
+		"errorDescription": errorDescription,
+	})
+}
@@ -0,0 +1,341 @@
+// Package calls implements a small client for the Cloudflare Calls SFU HTTP
+// API.
+package calls
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultBaseURL is the base URL of the Cloudflare Calls API.
+const DefaultBaseURL = "https://rtc.live.cloudflare.com/v1"
+
+// Client talks to the Calls SFU HTTP API on behalf of a single Calls app.
+type Client struct {
+	BaseURL    string
+	AppID      string
+	Token      string
+	HTTPClient *http.Client
+	// Debug includes unredacted response bodies in errors. Otherwise SDP
+	// secrets and credentials get masked.
+	Debug bool
+	// Retry is the policy for retrying failed API calls.
+	Retry RetryPolicy
+	// OnAPICall is called after every API call, e.g. to collect metrics.
+	OnAPICall func(call APICall)
+
+	// sleep waits between retries, it is replaced in tests.
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// NewClient returns a Client for the given Calls app which uses the
+// default API base URL.
+func NewClient(appID, token string) *Client {
+	return &Client{
+		BaseURL:    DefaultBaseURL,
+		AppID:      appID,
+		Token:      token,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+		Retry:      DefaultRetryPolicy,
+	}
+}
+
+// APICall describes a finished call of the API, including all retries.
+type APICall struct {
+	Method string
+	// Endpoint is the path of the endpoint below the app, with the session
+	// ID as placeholder, e.g. /sessions/{sessionId}/tracks/new. Calls of the
+	// TURN API report TurnCredentialsEndpoint.
+	Endpoint string
+	// SessionId is empty for calls creating a session.
+	SessionId string
+	Duration  time.Duration
+	Err       error
+}
+
+// endpointURL returns the URL of an endpoint for the given session.
+func (c *Client) endpointURL(endpoint, sessionId string) string {
+	return fmt.Sprintf("%s/apps/%s%s", c.BaseURL, c.AppID, strings.Replace(endpoint, "{sessionId}", sessionId, 1))
+}
+
+// NewSession creates a new session on the SFU. The offer is optional, the
+// SFU answers it in the returned session description.
+func (c *Client) NewSession(ctx context.Context, offer *SessionDescription) (*NewSessionResponse, error) {
+	requestBody := NewSessionRequest{
+		SessionDescription: offer,
+	}
+	var response NewSessionResponse
+
+	err := c.httpApiCaller(ctx, http.MethodPost, "/sessions/new", "", requestBody, http.StatusCreated, &response)
+	if err != nil {
+		return nil, fmt.Errorf("error making SFU session HTTP API call: %w", err)
+	}
+
+	return &response, nil
+}
+
+// NewTracks adds local or remote tracks to a session.
+func (c *Client) NewTracks(ctx context.Context, sessionId string, request NewTracksRequest) (*NewTracksResponse, error) {
+	var response NewTracksResponse
+
+	err := c.httpApiCaller(ctx, http.MethodPost, "/sessions/{sessionId}/tracks/new", sessionId, request, http.StatusOK, &response)
+	if err != nil {
+		return nil, fmt.Errorf("error making new tracks HTTP API call: %w", err)
+	}
+
+	return &response, nil
+}
+
+// NewDataChannels publishes or subscribes to data channels of a session.
+func (c *Client) NewDataChannels(ctx context.Context, sessionId string, request DataChannelRequests) (*DataChannelResponses, error) {
+	var response DataChannelResponses
+
+	err := c.httpApiCaller(ctx, http.MethodPost, "/sessions/{sessionId}/datachannels/new", sessionId, request, http.StatusOK, &response)
+	if err != nil {
+		return nil, fmt.Errorf("error making data channel HTTP API call: %w", err)
+	}
+
+	return &response, nil
+}
+
+// DataChannelResult is the outcome of publishing or subscribing a single
+// data channel.
+type DataChannelResult struct {
+	Name string
+	// SessionId is the session which published a subscribed data channel,
+	// it is empty for published data channels.
+	SessionId string
+	// Id has to be used for the negotiated data channel, it is only valid
+	// if Err is nil.
+	Id  uint16
+	Err error
+}
+
+// RemoteDataChannel identifies a data channel published by another session.
+type RemoteDataChannel struct {
+	SessionId string
+	Name      string
+}
+
+// PublishDataChannels publishes data channels from the session. It returns
+// a result per channel name in the same order, so that a failure of single
+// channels doesn't affect the others. The error is only set if the request
+// as a whole failed.
+func (c *Client) PublishDataChannels(ctx context.Context, sessionId string, channelNames ...string) ([]DataChannelResult, error) {
+	// Request body for the data channels API.
+	requestBody := DataChannelRequests{}
+	for _, channelName := range channelNames {
+		requestBody.DataChannels = append(requestBody.DataChannels, DataChannelRequest{
+			Location:        "local",
+			DataChannelName: channelName,
+		})
+	}
+
+	results, err := c.newDataChannels(ctx, sessionId, requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("error publishing data channels: %w", err)
+	}
+	return results, nil
+}
+
+// SubscribeDataChannels subscribes the session to data channels published
+// by other sessions. Like PublishDataChannels it returns a result per
+// channel in the same order.
+func (c *Client) SubscribeDataChannels(ctx context.Context, sessionId string, channels ...RemoteDataChannel) ([]DataChannelResult, error) {
+	// Request body for the data channels API.
+	requestBody := DataChannelRequests{}
+	for _, channel := range channels {
+		remoteSessionId := channel.SessionId
+		requestBody.DataChannels = append(requestBody.DataChannels, DataChannelRequest{
+			Location:        "remote",
+			DataChannelName: channel.Name,
+			SessionId:       &remoteSessionId,
+		})
+	}
+
+	results, err := c.newDataChannels(ctx, sessionId, requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("error subscribing data channels: %w", err)
+	}
+	return results, nil
+}
+
+// newDataChannels makes a data channels request and maps the response to a
+// result per requested channel. The SFU answers in the order of the
+// request, channels missing in the response are reported as failed.
+func (c *Client) newDataChannels(ctx context.Context, sessionId string, request DataChannelRequests) ([]DataChannelResult, error) {
+	if len(request.DataChannels) == 0 {
+		return nil, nil
+	}
+
+	response, err := c.NewDataChannels(ctx, sessionId, request)
+	if err != nil {
+		return nil, err
+	}
+	if err := response.Err(); err != nil {
+		return nil, err
+	}
+
+	results := make([]DataChannelResult, len(request.DataChannels))
+	for i, dc := range request.DataChannels {
+		results[i].Name = dc.DataChannelName
+		if dc.SessionId != nil {
+			results[i].SessionId = *dc.SessionId
+		}
+		if i >= len(response.DataChannels) {
+			results[i].Err = fmt.Errorf("data channel %q missing in response", dc.DataChannelName)
+			continue
+		}
+		item := response.DataChannels[i]
+		if item.DataChannelName != "" && item.DataChannelName != dc.DataChannelName {
+			results[i].Err = fmt.Errorf("expected data channel %q in response, got %q", dc.DataChannelName, item.DataChannelName)
+			continue
+		}
+		results[i].Id = item.Id
+		results[i].Err = item.Err()
+	}
+	return results, nil
+}
+
+// Renegotiate sends the answer to an offer of the SFU, e.g. after
+// subscribing to tracks. Offers of the client are sent with NewTracks
+// instead.
+func (c *Client) Renegotiate(ctx context.Context, sessionId string, description SessionDescription) (*RenegotiateResponse, error) {
+	requestBody := RenegotiateRequest{
+		SessionDescription: description,
+	}
+	var response RenegotiateResponse
+
+	err := c.httpApiCaller(ctx, http.MethodPut, "/sessions/{sessionId}/renegotiate", sessionId, requestBody, http.StatusOK, &response)
+	if err != nil {
+		return nil, fmt.Errorf("error making renegotiate HTTP API call: %w", err)
+	}
+
+	return &response, nil
+}
+
+// CloseTracks closes tracks of a session.
+func (c *Client) CloseTracks(ctx context.Context, sessionId string, request CloseTracksRequest) (*CloseTracksResponse, error) {
+	var response CloseTracksResponse
+
+	err := c.httpApiCaller(ctx, http.MethodPut, "/sessions/{sessionId}/tracks/close", sessionId, request, http.StatusOK, &response)
+	if err != nil {
+		return nil, fmt.Errorf("error making close tracks HTTP API call: %w", err)
+	}
+
+	return &response, nil
+}
+
+// GetSession returns the current state of a session.
+func (c *Client) GetSession(ctx context.Context, sessionId string) (*SessionStateResponse, error) {
+	var response SessionStateResponse
+
+	err := c.httpApiCaller(ctx, http.MethodGet, "/sessions/{sessionId}", sessionId, nil, http.StatusOK, &response)
+	if err != nil {
+		return nil, fmt.Errorf("error making session state HTTP API call: %w", err)
+	}
+
+	return &response, nil
+}
+
+// httpApiCaller makes a generic HTTP API call and unmarshals the response.
+// Failed calls are retried according to the retry policy of the client.
+func (c *Client) httpApiCaller(ctx context.Context, method, endpoint, sessionId string, reqBody interface{}, expectedStatusCode int, respData interface{}) (err error) {
+	if c.OnAPICall != nil {
+		start := time.Now()
+		defer func() {
+			c.OnAPICall(APICall{Method: method, Endpoint: endpoint, SessionId: sessionId, Duration: time.Since(start), Err: err})
+		}()
+	}
+	caller := caller{httpClient: c.HTTPClient, token: c.Token, debug: c.Debug, retry: c.Retry, sleep: c.sleep}
+	return caller.call(ctx, method, c.endpointURL(endpoint, sessionId), isSafe(method), reqBody, expectedStatusCode, respData)
+}
+
+// caller sends the requests of an API client with the client's settings.
+type caller struct {
+	httpClient *http.Client
+	token      string
+	debug      bool
+	retry      RetryPolicy
+	sleep      func(ctx context.Context, d time.Duration) error
+}
+
+// call makes an API call and unmarshals the response, retrying failed
+// attempts according to the retry policy. Safe calls are retried on more
+// errors than others, see RetryPolicy.
+func (c caller) call(ctx context.Context, method, url string, safe bool, reqBody interface{}, expectedStatusCode int, respData interface{}) error {
+	var jsonBody []byte
+	if reqBody != nil {
+		var err error
+		jsonBody, err = json.Marshal(reqBody)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request body: %w", err)
+		}
+	}
+
+	sleep := c.sleep
+	if sleep == nil {
+		sleep = sleepContext
+	}
+	for attempt := 1; ; attempt++ {
+		wait, err := c.doRequest(ctx, method, url, jsonBody, expectedStatusCode, respData)
+		if err == nil || attempt >= c.retry.MaxAttempts || !shouldRetry(safe, err) {
+			return err
+		}
+		wait = min(max(wait, c.retry.backoff(attempt)), c.retry.MaxBackoff)
+		if sleepErr := sleep(ctx, wait); sleepErr != nil {
+			return err
+		}
+	}
+}
+
+// doRequest makes a single attempt of an API call. On failure it also
+// returns how long the API asked to wait before retrying.
+func (c caller) doRequest(ctx context.Context, method, url string, jsonBody []byte, expectedStatusCode int, respData interface{}) (time.Duration, error) {
+	var reqBodyReader io.Reader
+	if jsonBody != nil {
+		reqBodyReader = bytes.NewReader(jsonBody)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBodyReader)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.token))
+	if jsonBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := c.httpClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if resp.StatusCode != expectedStatusCode {
+		return retryAfter(resp.Header, time.Now()), newAPIError(req, resp, bodyBytes, c.debug)
+	}
+
+	if respData != nil {
+		if err := json.Unmarshal(bodyBytes, respData); err != nil {
+			return 0, &DecodeError{Method: method, URL: url, RequestID: requestID(resp), Err: err}
+		}
+	}
+	return 0, nil
+}
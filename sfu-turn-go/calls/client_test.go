@@ -0,0 +1,253 @@
+package calls
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a client for the handler which records the waits
+// between retries instead of sleeping.
+func newTestClient(t *testing.T, handler http.HandlerFunc) (*Client, *[]time.Duration) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	var waits []time.Duration
+	client := NewClient("app", "token")
+	client.BaseURL = server.URL
+	client.HTTPClient = server.Client()
+	client.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return ctx.Err()
+	}
+	return client, &waits
+}
+
+func TestAPIError(t *testing.T) {
+	var attempts atomic.Int32
+	client, _ := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.Header().Set("Cf-Ray", "ray-id")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"errorCode":"unauthorized","errorDescription":"invalid token"}`))
+	})
+
+	_, err := client.GetSession(context.Background(), "session")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected an APIError, got %v", err)
+	}
+	if apiErr.StatusCode != http.StatusUnauthorized || apiErr.ErrorCode != "unauthorized" ||
+		apiErr.ErrorDescription != "invalid token" || apiErr.RequestID != "ray-id" {
+		t.Errorf("unexpected error %+v", apiErr)
+	}
+	if apiErr.Temporary() {
+		t.Error("401 must not be temporary")
+	}
+	if n := attempts.Load(); n != 1 {
+		t.Errorf("client errors must not be retried, got %d attempts", n)
+	}
+}
+
+func TestRetrySafe(t *testing.T) {
+	var attempts atomic.Int32
+	client, waits := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) < 3 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"tracks":[]}`))
+	})
+
+	if _, err := client.GetSession(context.Background(), "session"); err != nil {
+		t.Fatalf("GetSession failed: %v", err)
+	}
+	if n := attempts.Load(); n != 3 {
+		t.Errorf("expected 3 attempts, got %d", n)
+	}
+	if len(*waits) != 2 {
+		t.Fatalf("expected 2 waits, got %v", *waits)
+	}
+	for i, wait := range *waits {
+		backoff := client.Retry.InitialBackoff << i
+		if wait < backoff/2 || wait > backoff {
+			t.Errorf("wait %d is %v, expected between %v and %v", i, wait, backoff/2, backoff)
+		}
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	var attempts atomic.Int32
+	client, _ := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		http.Error(w, "boom", http.StatusInternalServerError)
+	})
+
+	_, err := client.GetSession(context.Background(), "session")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected an APIError with status 500, got %v", err)
+	}
+	if n := attempts.Load(); n != int32(client.Retry.MaxAttempts) {
+		t.Errorf("expected %d attempts, got %d", client.Retry.MaxAttempts, n)
+	}
+
+	// Creating a session and renegotiating change the session, so they
+	// must not be retried on server errors.
+	attempts.Store(0)
+	if _, err := client.NewSession(context.Background(), nil); err == nil {
+		t.Fatal("expected NewSession to fail")
+	}
+	if n := attempts.Load(); n != 1 {
+		t.Errorf("expected 1 attempt of NewSession, got %d", n)
+	}
+	attempts.Store(0)
+	if _, err := client.Renegotiate(context.Background(), "session", SessionDescription{Type: "answer", Sdp: "sdp"}); err == nil {
+		t.Fatal("expected Renegotiate to fail")
+	}
+	if n := attempts.Load(); n != 1 {
+		t.Errorf("expected 1 attempt of Renegotiate, got %d", n)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	var attempts atomic.Int32
+	client, waits := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch attempts.Add(1) {
+		case 1:
+			w.Header().Set("Retry-After", "3")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		case 2:
+			w.Header().Set("Retry-After", "3600")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"sessionId":"session"}`))
+	})
+
+	// Rate limited requests are retried even if they aren't safe.
+	response, err := client.NewSession(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("NewSession failed: %v", err)
+	}
+	if response.SessionId != "session" {
+		t.Errorf("unexpected session ID %q", response.SessionId)
+	}
+	// Retry-After is honored up to MaxBackoff.
+	want := []time.Duration{3 * time.Second, client.Retry.MaxBackoff}
+	if !slices.Equal(*waits, want) {
+		t.Errorf("expected to wait %v, waited %v", want, *waits)
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	client, _ := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`not json`))
+	})
+
+	_, err := client.GetSession(context.Background(), "session")
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) {
+		t.Fatalf("expected a DecodeError, got %v", err)
+	}
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"3", 3 * time.Second},
+		{"-1", 0},
+		{now.Add(time.Minute).Format(http.TimeFormat), time.Minute},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{"soon", 0},
+	} {
+		header := http.Header{}
+		header.Set("Retry-After", tc.value)
+		if got := retryAfter(header, now); got != tc.want {
+			t.Errorf("retryAfter(%q) = %v, want %v", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestDataChannelResults(t *testing.T) {
+	client, _ := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var request DataChannelRequests
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("error decoding request: %v", err)
+		}
+		// Only answer the first channel, with an error for the second.
+		response := DataChannelResponses{DataChannels: []DataChannelResponse{
+			{Location: "local", DataChannelName: "one", Id: 2},
+			{Location: "local", DataChannelName: "two", ErrorCode: "failed", ErrorDescription: "no"},
+		}}
+		json.NewEncoder(w).Encode(response)
+	})
+
+	results, err := client.PublishDataChannels(context.Background(), "session", "one", "two", "three")
+	if err != nil {
+		t.Fatalf("PublishDataChannels failed: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %+v", results)
+	}
+	if results[0].Name != "one" || results[0].Id != 2 || results[0].Err != nil {
+		t.Errorf("unexpected result for the first channel: %+v", results[0])
+	}
+	if results[1].Err == nil || results[2].Err == nil {
+		t.Errorf("expected errors for the other channels: %+v", results[1:])
+	}
+
+	results, err = client.PublishDataChannels(context.Background(), "session")
+	if err != nil || len(results) != 0 {
+		t.Errorf("expected no results and no error without channels, got %v %v", results, err)
+	}
+}
+
+func TestOnAPICall(t *testing.T) {
+	var paths []string
+	client, _ := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if r.URL.Path == "/apps/app/sessions/new" {
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"sessionId":"session"}`))
+			return
+		}
+		http.Error(w, "bad request", http.StatusBadRequest)
+	})
+	var calls []APICall
+	client.OnAPICall = func(call APICall) {
+		calls = append(calls, call)
+	}
+
+	if _, err := client.NewSession(context.Background(), nil); err != nil {
+		t.Fatalf("NewSession failed: %v", err)
+	}
+	if _, err := client.CloseTracks(context.Background(), "session", CloseTracksRequest{Force: true}); err == nil {
+		t.Fatal("expected CloseTracks to fail")
+	}
+
+	if len(paths) != 2 || paths[1] != "/apps/app/sessions/session/tracks/close" {
+		t.Errorf("unexpected request paths %v", paths)
+	}
+	if len(calls) != 2 {
+		t.Fatalf("expected 2 observed calls, got %+v", calls)
+	}
+	if c := calls[0]; c.Method != http.MethodPost || c.Endpoint != "/sessions/new" || c.SessionId != "" || c.Err != nil {
+		t.Errorf("unexpected call %+v", c)
+	}
+	if c := calls[1]; c.Method != http.MethodPut || c.Endpoint != "/sessions/{sessionId}/tracks/close" || c.SessionId != "session" || c.Err == nil {
+		t.Errorf("unexpected call %+v", c)
+	}
+}
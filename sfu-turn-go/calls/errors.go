@@ -0,0 +1,160 @@
+package calls
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Err returns an error if the request as a whole or any of the requested
+// tracks failed, similar to checkNewTracksResponse in the TypeScript
+// examples.
+func (r *NewTracksResponse) Err() error {
+	if r.ErrorCode != "" {
+		return fmt.Errorf("new tracks request failed: %s: %s", r.ErrorCode, r.ErrorDescription)
+	}
+	for _, track := range r.Tracks {
+		if err := track.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Err returns an error if the track failed.
+func (r *NewTrackResponse) Err() error {
+	if r.ErrorCode != "" {
+		return fmt.Errorf("track %q failed: %s: %s", r.TrackName, r.ErrorCode, r.ErrorDescription)
+	}
+	return nil
+}
+
+// Err returns an error if the data channel failed.
+func (r *DataChannelResponse) Err() error {
+	if r.ErrorCode != "" {
+		return fmt.Errorf("data channel %q failed: %s: %s", r.DataChannelName, r.ErrorCode, r.ErrorDescription)
+	}
+	return nil
+}
+
+// Err returns an error if the data channels request as a whole failed.
+// Errors of single data channels are reported by their own Err method.
+func (r *DataChannelResponses) Err() error {
+	if r.ErrorCode != "" {
+		return fmt.Errorf("data channels request failed: %s: %s", r.ErrorCode, r.ErrorDescription)
+	}
+	return nil
+}
+
+// Err returns an error if the renegotiation failed.
+func (r *RenegotiateResponse) Err() error {
+	if r.ErrorCode != "" {
+		return fmt.Errorf("renegotiation failed: %s: %s", r.ErrorCode, r.ErrorDescription)
+	}
+	return nil
+}
+
+// Err returns an error if the request as a whole or any of the tracks to
+// close failed.
+func (r *CloseTracksResponse) Err() error {
+	if r.ErrorCode != "" {
+		return fmt.Errorf("close tracks request failed: %s: %s", r.ErrorCode, r.ErrorDescription)
+	}
+	for _, track := range r.Tracks {
+		if track.ErrorCode != "" {
+			return fmt.Errorf("closing track with mid %q failed: %s: %s", track.Mid, track.ErrorCode, track.ErrorDescription)
+		}
+	}
+	return nil
+}
+
+// APIError is returned by the Client when the API responds with an
+// unexpected status code.
+type APIError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	// ErrorCode and ErrorDescription are set if the response body contains
+	// a Calls error object.
+	ErrorCode        string
+	ErrorDescription string
+	// RequestID identifies the request in Cloudflare's logs.
+	RequestID string
+	// Body is the response body, redacted unless the Client is in debug
+	// mode.
+	Body string
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("API request %s %s failed with status %s", e.Method, e.URL, e.Status)
+	if e.RequestID != "" {
+		msg += fmt.Sprintf(" (request ID %s)", e.RequestID)
+	}
+	if e.ErrorCode != "" {
+		return fmt.Sprintf("%s: %s: %s", msg, e.ErrorCode, e.ErrorDescription)
+	}
+	return fmt.Sprintf("%s: %s", msg, e.Body)
+}
+
+// Temporary reports whether the request may succeed when it is retried,
+// which is the case for rate limiting and server errors.
+func (e *APIError) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// DecodeError is returned by the Client when the response has the expected
+// status code, but its body can't be decoded.
+type DecodeError struct {
+	Method    string
+	URL       string
+	RequestID string
+	Err       error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to unmarshal response body of %s %s: %v", e.Method, e.URL, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// newAPIError builds the APIError for a response with an unexpected status
+// code. The body is only kept verbatim when debugging.
+func newAPIError(req *http.Request, resp *http.Response, body []byte, debug bool) *APIError {
+	apiErr := &APIError{
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RequestID:  requestID(resp),
+		Body:       string(body),
+	}
+	if !debug {
+		apiErr.Body = Redact(apiErr.Body)
+	}
+
+	var callsErr struct {
+		ErrorCode        string `json:"errorCode"`
+		ErrorDescription string `json:"errorDescription"`
+	}
+	if json.Unmarshal(body, &callsErr) == nil {
+		apiErr.ErrorCode = callsErr.ErrorCode
+		apiErr.ErrorDescription = callsErr.ErrorDescription
+	}
+	return apiErr
+}
+
+// requestID returns the ID Cloudflare assigned to the request.
+func requestID(resp *http.Response) string {
+	if id := resp.Header.Get("Cf-Ray"); id != "" {
+		return id
+	}
+	return resp.Header.Get("X-Request-Id")
+}
@@ -0,0 +1,37 @@
+package calls
+
+import "regexp"
+
+// Redacted replaces secrets in redacted strings.
+const Redacted = "[REDACTED]"
+
+var redactions = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// ICE passwords and DTLS fingerprints in SDP, both in plain SDP and in
+	// SDP embedded in JSON strings.
+	{regexp.MustCompile(`(a=ice-pwd:)[^\s\\"]+`), "${1}" + Redacted},
+	{regexp.MustCompile(`(a=fingerprint:\S+ )[0-9A-Fa-f:]+`), "${1}" + Redacted},
+	// Bearer tokens, e.g. from an Authorization header.
+	{regexp.MustCompile(`(?i)(bearer\s+)[^\s"]+`), "${1}" + Redacted},
+	// Secrets in JSON bodies, like the TURN credential.
+	{regexp.MustCompile(`("(?:credential|password|token)"\s*:\s*")[^"]*"`), "${1}" + Redacted + `"`},
+}
+
+// Redact masks TURN credentials, bearer tokens and the ICE password and DTLS
+// fingerprint lines of SDP in s, so that it can be logged safely.
+func Redact(s string) string {
+	for _, r := range redactions {
+		s = r.re.ReplaceAllString(s, r.repl)
+	}
+	return s
+}
+
+// RedactSecret masks a secret completely unless it is empty.
+func RedactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return Redacted
+}
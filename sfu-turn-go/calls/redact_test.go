@@ -0,0 +1,54 @@
+package calls
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{
+			name: "sdp",
+			in:   "a=ice-ufrag:abcd\r\na=ice-pwd:secretpassword\r\na=fingerprint:sha-256 AB:CD:EF:01\r\n",
+			want: "a=ice-ufrag:abcd\r\na=ice-pwd:[REDACTED]\r\na=fingerprint:sha-256 [REDACTED]\r\n",
+		},
+		{
+			name: "sdp in json",
+			in:   `{"sdp":"v=0\r\na=ice-pwd:secretpassword\r\na=setup:actpass"}`,
+			want: `{"sdp":"v=0\r\na=ice-pwd:[REDACTED]\r\na=setup:actpass"}`,
+		},
+		{
+			name: "bearer token",
+			in:   "Authorization: Bearer abc.def-123",
+			want: "Authorization: Bearer [REDACTED]",
+		},
+		{
+			name: "turn credential",
+			in:   `{"urls":["turn:turn.cloudflare.com:3478"],"username":"user","credential":"c2VjcmV0"}`,
+			want: `{"urls":["turn:turn.cloudflare.com:3478"],"username":"user","credential":"[REDACTED]"}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Redact(tc.in); got != tc.want {
+				t.Errorf("Redact(%q) = %q, want %q", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestErrorBodyRedaction(t *testing.T) {
+	body := `{"errorCode":"bad","sessionDescription":{"sdp":"a=ice-pwd:topsecret"}}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/apps/app/sessions/new", nil)
+	resp := &http.Response{StatusCode: http.StatusBadRequest, Status: "400 Bad Request"}
+
+	if err := newAPIError(req, resp, []byte(body), false); strings.Contains(err.Body, "topsecret") {
+		t.Errorf("error leaks the ICE password: %v", err.Body)
+	}
+	if err := newAPIError(req, resp, []byte(body), true); !strings.Contains(err.Body, "topsecret") {
+		t.Errorf("debug error does not contain the full body: %v", err.Body)
+	}
+}
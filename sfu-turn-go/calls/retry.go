@@ -0,0 +1,104 @@
+package calls
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how the Client retries failed API calls.
+//
+// Requests without side effects, like getting the state of a session, are
+// retried on network errors and on temporary errors of the API. Other
+// requests, like creating a new session or renegotiating, are only retried
+// when they were rate limited, because the SFU didn't process them in that
+// case. Generating TURN credentials has no side effects, so it is retried
+// like a GET request.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts per API call, values
+	// below 2 disable retries.
+	MaxAttempts int
+	// InitialBackoff is the backoff before the first retry, it is doubled
+	// for every further retry up to MaxBackoff. A random jitter of up to
+	// half the backoff is subtracted. A longer Retry-After of the API is
+	// honored up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy of clients created by NewClient.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 250 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+}
+
+// backoff returns the jittered backoff before the given retry, starting
+// at 1.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < retry && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, p.MaxBackoff)
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff - rand.N(backoff/2+1)
+}
+
+// shouldRetry reports whether a request which failed with err may be
+// retried.
+func shouldRetry(safe bool, err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		if apiErr.StatusCode == http.StatusTooManyRequests {
+			return true
+		}
+		return apiErr.Temporary() && safe
+	}
+	var decodeErr *DecodeError
+	if errors.As(err, &decodeErr) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	// Network errors.
+	return safe
+}
+
+// isSafe reports whether requests with the method have no side effects.
+// The PUT requests of the API, like renegotiating, change the session, so
+// they are not safe to repeat when it's unknown whether the SFU got them.
+func isSafe(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+// retryAfter parses the Retry-After header, which holds either a number of
+// seconds or an HTTP date. It returns 0 if the header is missing or invalid.
+func retryAfter(header http.Header, now time.Time) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0)
+	}
+	return 0
+}
+
+// sleepContext waits for d or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
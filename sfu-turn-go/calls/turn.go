@@ -0,0 +1,89 @@
+package calls
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TurnCredentialsEndpoint is the endpoint generating TURN credentials, with
+// the TURN key ID as placeholder. It is the Endpoint of the APICalls of a
+// TurnClient.
+const TurnCredentialsEndpoint = "/turn/keys/{keyId}/credentials/generate-ice-servers"
+
+// ICEServer is an entry of the iceServers list returned by the TURN API.
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`   // Use omitempty to handle missing fields
+	Credential string   `json:"credential,omitempty"` // Use omitempty to handle missing fields
+}
+
+// generateICEServersRequest is the body of a generate-ice-servers request.
+type generateICEServersRequest struct {
+	// TTL is the lifetime of the credentials in seconds.
+	TTL int `json:"ttl"`
+}
+
+// generateICEServersResponse is the response of a generate-ice-servers
+// request.
+type generateICEServersResponse struct {
+	ICEServers []ICEServer `json:"iceServers"`
+}
+
+// TurnClient generates short-lived credentials for Cloudflare's TURN
+// service with a TURN key. It reports failures and retries calls like the
+// Client does.
+type TurnClient struct {
+	BaseURL    string
+	KeyID      string
+	Token      string
+	HTTPClient *http.Client
+	// Debug includes unredacted response bodies in errors.
+	Debug bool
+	// Retry is the policy for retrying failed API calls.
+	Retry RetryPolicy
+	// OnAPICall is called after every API call, e.g. to collect metrics.
+	OnAPICall func(call APICall)
+
+	// sleep waits between retries, it is replaced in tests.
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// NewTurnClient returns a TurnClient for the given TURN key which uses the
+// default API base URL.
+func NewTurnClient(keyID, token string) *TurnClient {
+	return &TurnClient{
+		BaseURL:    DefaultBaseURL,
+		KeyID:      keyID,
+		Token:      token,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+		Retry:      DefaultRetryPolicy,
+	}
+}
+
+// GenerateICEServers generates credentials valid for ttl. Every iceServers
+// entry of the response is returned, including STUN-only entries which
+// come without a username and credential.
+func (c *TurnClient) GenerateICEServers(ctx context.Context, ttl time.Duration) (servers []ICEServer, err error) {
+	if c.OnAPICall != nil {
+		start := time.Now()
+		defer func() {
+			c.OnAPICall(APICall{Method: http.MethodPost, Endpoint: TurnCredentialsEndpoint, Duration: time.Since(start), Err: err})
+		}()
+	}
+	url := c.BaseURL + strings.Replace(TurnCredentialsEndpoint, "{keyId}", c.KeyID, 1)
+	requestBody := generateICEServersRequest{TTL: int(ttl.Seconds())}
+	var response generateICEServersResponse
+
+	caller := caller{httpClient: c.HTTPClient, token: c.Token, debug: c.Debug, retry: c.Retry, sleep: c.sleep}
+	if err := caller.call(ctx, http.MethodPost, url, true, requestBody, http.StatusCreated, &response); err != nil {
+		return nil, fmt.Errorf("error making TURN HTTP API call: %w", err)
+	}
+	if len(response.ICEServers) == 0 {
+		return nil, errors.New("API response did not contain any ICE servers")
+	}
+	return response.ICEServers, nil
+}
@@ -0,0 +1,101 @@
+package calls
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestTurnClient returns a TURN client for the handler which records the
+// waits between retries instead of sleeping.
+func newTestTurnClient(t *testing.T, handler http.HandlerFunc) (*TurnClient, *[]time.Duration) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	var waits []time.Duration
+	client := NewTurnClient("key", "token")
+	client.BaseURL = server.URL
+	client.HTTPClient = server.Client()
+	client.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return ctx.Err()
+	}
+	return client, &waits
+}
+
+func TestGenerateICEServers(t *testing.T) {
+	var attempts atomic.Int32
+	client, waits := newTestTurnClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/turn/keys/key/credentials/generate-ice-servers" || r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		var request generateICEServersRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.TTL != 3600 {
+			t.Errorf("unexpected request body %+v: %v", request, err)
+		}
+		// Generating credentials is retried on server errors, although
+		// it is a POST request.
+		if attempts.Add(1) == 1 {
+			w.Header().Set("Retry-After", "2")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"iceServers":[{"urls":["stun:stun.example.com:3478"]},{"urls":["turn:turn.example.com:3478"],"username":"user","credential":"secret"}]}`))
+	})
+	var calls []APICall
+	client.OnAPICall = func(call APICall) { calls = append(calls, call) }
+
+	servers, err := client.GenerateICEServers(context.Background(), time.Hour)
+	if err != nil {
+		t.Fatalf("GenerateICEServers failed: %v", err)
+	}
+	want := []ICEServer{
+		{URLs: []string{"stun:stun.example.com:3478"}},
+		{URLs: []string{"turn:turn.example.com:3478"}, Username: "user", Credential: "secret"},
+	}
+	if !reflect.DeepEqual(servers, want) {
+		t.Errorf("got servers %+v, want %+v", servers, want)
+	}
+	if len(*waits) != 1 || (*waits)[0] != 2*time.Second {
+		t.Errorf("unexpected waits %v, want the Retry-After of 2s", *waits)
+	}
+	if len(calls) != 1 || calls[0].Endpoint != TurnCredentialsEndpoint || calls[0].Method != http.MethodPost || calls[0].Err != nil {
+		t.Errorf("unexpected API calls %+v", calls)
+	}
+}
+
+func TestGenerateICEServersErrors(t *testing.T) {
+	var attempts atomic.Int32
+	client, _ := newTestTurnClient(t, func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.Header().Set("Cf-Ray", "ray-id")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"credential":"leaked"}`))
+	})
+	_, err := client.GenerateICEServers(context.Background(), time.Hour)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected an APIError, got %v", err)
+	}
+	if apiErr.StatusCode != http.StatusUnauthorized || apiErr.RequestID != "ray-id" || apiErr.Body != `{"credential":"[REDACTED]"}` {
+		t.Errorf("unexpected error %+v", apiErr)
+	}
+	if n := attempts.Load(); n != 1 {
+		t.Errorf("client errors must not be retried, got %d attempts", n)
+	}
+
+	client, _ = newTestTurnClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"iceServers":[]}`))
+	})
+	if _, err := client.GenerateICEServers(context.Background(), time.Hour); err == nil {
+		t.Error("expected an error for a response without ICE servers")
+	}
+}
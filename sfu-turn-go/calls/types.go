@@ -0,0 +1,131 @@
+package calls
+
+// ServerEventsLabel is the label of the data channel the SFU sends events
+// on.
+const ServerEventsLabel = "server-events"
+
+// SessionDescription is an SDP offer or answer as exchanged with the Calls API.
+type SessionDescription struct {
+	Type string `json:"type"`
+	Sdp  string `json:"sdp"`
+}
+
+// NewSessionRequest is the body of a sessions/new request.
+type NewSessionRequest struct {
+	SessionDescription *SessionDescription `json:"sessionDescription,omitempty"`
+}
+
+// NewSessionResponse represents the response of a sessions/new request.
+type NewSessionResponse struct {
+	SessionId   string              `json:"sessionId"`
+	Description *SessionDescription `json:"sessionDescription,omitempty"`
+}
+
+// TrackLocator identifies a track, either one published by the calling
+// session ("local") or one published by another session ("remote").
+type TrackLocator struct {
+	Location                 string  `json:"location"`
+	SessionId                *string `json:"sessionId,omitempty"`
+	TrackName                string  `json:"trackName"`
+	Mid                      string  `json:"mid,omitempty"`
+	Kind                     string  `json:"kind,omitempty"`
+	BidirectionalMediaStream bool    `json:"bidirectionalMediaStream,omitempty"`
+}
+
+// NewTracksRequest is the body of a tracks/new request.
+type NewTracksRequest struct {
+	SessionDescription *SessionDescription `json:"sessionDescription,omitempty"`
+	Tracks             []TrackLocator      `json:"tracks"`
+}
+
+// NewTrackResponse describes a single track of a tracks/new response.
+type NewTrackResponse struct {
+	TrackName        string  `json:"trackName"`
+	Mid              string  `json:"mid"`
+	SessionId        *string `json:"sessionId,omitempty"`
+	ErrorCode        string  `json:"errorCode,omitempty"`
+	ErrorDescription string  `json:"errorDescription,omitempty"`
+}
+
+// NewTracksResponse represents the response of a tracks/new request.
+type NewTracksResponse struct {
+	RequiresImmediateRenegotiation bool                `json:"requiresImmediateRenegotiation"`
+	Tracks                         []NewTrackResponse  `json:"tracks"`
+	SessionDescription             *SessionDescription `json:"sessionDescription,omitempty"`
+	ErrorCode                      string              `json:"errorCode,omitempty"`
+	ErrorDescription               string              `json:"errorDescription,omitempty"`
+}
+
+type DataChannelRequest struct {
+	Location        string  `json:"location"`
+	DataChannelName string  `json:"dataChannelName"`
+	SessionId       *string `json:"sessionId,omitempty"`
+}
+
+type DataChannelRequests struct {
+	DataChannels []DataChannelRequest `json:"dataChannels"`
+}
+
+type DataChannelResponse struct {
+	Location         string `json:"location"`
+	DataChannelName  string `json:"dataChannelName"`
+	Id               uint16 `json:"id"`
+	ErrorCode        string `json:"errorCode,omitempty"`
+	ErrorDescription string `json:"errorDescription,omitempty"`
+}
+
+type DataChannelResponses struct {
+	DataChannels     []DataChannelResponse `json:"dataChannels"`
+	ErrorCode        string                `json:"errorCode,omitempty"`
+	ErrorDescription string                `json:"errorDescription,omitempty"`
+}
+
+// RenegotiateRequest is the body of a renegotiate request.
+type RenegotiateRequest struct {
+	SessionDescription SessionDescription `json:"sessionDescription"`
+}
+
+// RenegotiateResponse represents the response of a renegotiate request.
+type RenegotiateResponse struct {
+	SessionDescription *SessionDescription `json:"sessionDescription,omitempty"`
+	ErrorCode          string              `json:"errorCode,omitempty"`
+	ErrorDescription   string              `json:"errorDescription,omitempty"`
+}
+
+// CloseTrackObject identifies a track to close by its mid.
+type CloseTrackObject struct {
+	Mid string `json:"mid"`
+}
+
+// CloseTracksRequest is the body of a tracks/close request. With Force set
+// the tracks are closed without renegotiating, in which case no
+// SessionDescription needs to be provided.
+type CloseTracksRequest struct {
+	SessionDescription *SessionDescription `json:"sessionDescription,omitempty"`
+	Tracks             []CloseTrackObject  `json:"tracks"`
+	Force              bool                `json:"force"`
+}
+
+// CloseTracksResponse represents the response of a tracks/close request.
+type CloseTracksResponse struct {
+	RequiresImmediateRenegotiation bool                `json:"requiresImmediateRenegotiation"`
+	Tracks                         []NewTrackResponse  `json:"tracks"`
+	SessionDescription             *SessionDescription `json:"sessionDescription,omitempty"`
+	ErrorCode                      string              `json:"errorCode,omitempty"`
+	ErrorDescription               string              `json:"errorDescription,omitempty"`
+}
+
+// TrackState describes a track as reported by the session state endpoint.
+type TrackState struct {
+	Location  string `json:"location"`
+	Mid       string `json:"mid"`
+	TrackName string `json:"trackName"`
+	Status    string `json:"status"`
+}
+
+// SessionStateResponse represents the current state of a session.
+type SessionStateResponse struct {
+	Tracks           []TrackState `json:"tracks"`
+	ErrorCode        string       `json:"errorCode,omitempty"`
+	ErrorDescription string       `json:"errorDescription,omitempty"`
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/calls-examples/sfu-turn-go/calls"
+	"github.com/pion/webrtc/v3"
+)
+
+// config holds all settings of the example. Secrets are only read from
+// environment variables or files, so that they don't end up in the shell
+// history.
+type config struct {
+	TurnKeyID           string
+	TurnAPIToken        string
+	CallsAppID          string
+	CallsAppToken       string
+	BaseURL             string
+	TurnBaseURL         string
+	CABundle            string
+	TurnTTL             time.Duration
+	ChannelName         string
+	TrackName           string
+	TransportPolicy     webrtc.ICETransportPolicy
+	TurnTransport       string
+	APITimeout          time.Duration
+	APIAttempts         int
+	GatherTimeout       time.Duration
+	ConnectTimeout      time.Duration
+	ShutdownTimeout     time.Duration
+	TrickleICE          bool // off by default like in turn-go, so that every offer carries all candidates
+	ReconnectAttempts   int
+	ReconnectMaxBackoff time.Duration
+	StatsInterval       time.Duration
+	StatsJSON           bool
+	MetricsAddr         string
+	OTLPEndpoint        string
+	Debug               bool
+}
+
+// parseConfig parses the command line flags, falling back to environment
+// variables for everything which isn't set on the command line.
+func parseConfig(args []string, output io.Writer) (*config, error) {
+	var cfg config
+	var turnTokenFile, callsTokenFile, transportPolicy string
+
+	fs := flag.NewFlagSet("sfu-turn-go", flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.StringVar(&cfg.TurnKeyID, "turn-key-id", os.Getenv("CLOUDFLARE_TURN_KEY_ID"),
+		"TURN key ID (env CLOUDFLARE_TURN_KEY_ID)")
+	fs.StringVar(&turnTokenFile, "turn-api-token-file", os.Getenv("CLOUDFLARE_TURN_API_TOKEN_FILE"),
+		"file containing the TURN API token, otherwise read from env CLOUDFLARE_TURN_API_TOKEN (env CLOUDFLARE_TURN_API_TOKEN_FILE)")
+	fs.StringVar(&cfg.CallsAppID, "calls-app-id", os.Getenv("CLOUDFLARE_CALLS_APP_ID"),
+		"Calls app ID (env CLOUDFLARE_CALLS_APP_ID)")
+	fs.StringVar(&callsTokenFile, "calls-app-token-file", os.Getenv("CLOUDFLARE_CALLS_APP_TOKEN_FILE"),
+		"file containing the Calls app token, otherwise read from env CLOUDFLARE_CALLS_APP_TOKEN (env CLOUDFLARE_CALLS_APP_TOKEN_FILE)")
+	fs.StringVar(&cfg.BaseURL, "base-url", envOrDefault("CLOUDFLARE_API_BASE_URL", calls.DefaultBaseURL),
+		"base URL of the Calls and TURN API (env CLOUDFLARE_API_BASE_URL)")
+	fs.StringVar(&cfg.TurnBaseURL, "turn-base-url", os.Getenv("CLOUDFLARE_TURN_API_BASE_URL"),
+		"base URL of the TURN API, defaults to -base-url (env CLOUDFLARE_TURN_API_BASE_URL)")
+	fs.StringVar(&cfg.CABundle, "ca-bundle", os.Getenv("CLOUDFLARE_CA_BUNDLE"),
+		"PEM file with additional CA certificates to trust (env CLOUDFLARE_CA_BUNDLE)")
+	fs.DurationVar(&cfg.TurnTTL, "turn-ttl", 24*time.Hour,
+		"lifetime of the requested TURN credentials")
+	fs.StringVar(&cfg.ChannelName, "channel", "channel-one",
+		"name of the data channel published by peer1")
+	fs.StringVar(&cfg.TrackName, "track", "audio-one",
+		"name of the audio track published by peer1")
+	fs.StringVar(&transportPolicy, "ice-transport-policy", "relay",
+		"ICE transport policy: relay to only connect through TURN, turn-udp, turn-tcp or turns to only connect through TURN over UDP, TCP or TLS, or all to allow every candidate")
+	fs.DurationVar(&cfg.APITimeout, "api-timeout", 10*time.Second,
+		"timeout of a single API request")
+	fs.IntVar(&cfg.APIAttempts, "api-attempts", calls.DefaultRetryPolicy.MaxAttempts,
+		"maximum number of attempts of a Calls or TURN API request, 1 disables retries")
+	fs.DurationVar(&cfg.GatherTimeout, "gather-timeout", 15*time.Second,
+		"how long to wait for ICE gathering to finish when not trickling candidates")
+	fs.DurationVar(&cfg.ConnectTimeout, "connect-timeout", 30*time.Second,
+		"how long to wait for connecting to the SFU")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", 5*time.Second,
+		"how long to wait for sending buffered messages and closing the tracks on shutdown")
+	fs.BoolVar(&cfg.TrickleICE, "trickle-ice", false,
+		"send the offers to the SFU without waiting for ICE gathering, later candidates are sent by renegotiating")
+	fs.IntVar(&cfg.ReconnectAttempts, "reconnect-attempts", 5,
+		"how often to restart ICE after the connection to the SFU was lost, 0 disables reconnecting")
+	fs.DurationVar(&cfg.ReconnectMaxBackoff, "reconnect-max-backoff", 30*time.Second,
+		"maximum wait between two reconnect attempts")
+	fs.DurationVar(&cfg.StatsInterval, "stats-interval", 0,
+		"how often to print a connection-quality report, 0 prints one only after connecting")
+	fs.BoolVar(&cfg.StatsJSON, "stats-json", false,
+		"print the connection-quality reports as JSON")
+	fs.StringVar(&cfg.MetricsAddr, "metrics-addr", "",
+		"address to serve Prometheus metrics on at /metrics, e.g. :9090; disabled if empty")
+	fs.StringVar(&cfg.OTLPEndpoint, "otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		"base URL of an OpenTelemetry collector to export traces of the session setup to with OTLP/HTTP, e.g. http://localhost:4318; disabled if empty (env OTEL_EXPORTER_OTLP_ENDPOINT)")
+	fs.BoolVar(&cfg.Debug, "debug", false,
+		"log credentials, tokens and SDP secrets instead of masking them")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: sfu-turn-go [flags]")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "The TURN API token and the Calls app token are read from the environment")
+		fmt.Fprintln(fs.Output(), "variables CLOUDFLARE_TURN_API_TOKEN and CLOUDFLARE_CALLS_APP_TOKEN, or from")
+		fmt.Fprintln(fs.Output(), "the files given with the -*-token-file flags.")
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v, tokens have to be passed through the environment or files", fs.Args())
+	}
+
+	var errs []error
+	var err error
+	if cfg.TurnKeyID == "" {
+		errs = append(errs, errors.New("missing TURN key ID, set -turn-key-id or CLOUDFLARE_TURN_KEY_ID"))
+	}
+	if cfg.CallsAppID == "" {
+		errs = append(errs, errors.New("missing Calls app ID, set -calls-app-id or CLOUDFLARE_CALLS_APP_ID"))
+	}
+	if cfg.TurnAPIToken, err = readSecret("CLOUDFLARE_TURN_API_TOKEN", turnTokenFile); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.CallsAppToken, err = readSecret("CLOUDFLARE_CALLS_APP_TOKEN", callsTokenFile); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.TurnTTL < time.Minute {
+		errs = append(errs, fmt.Errorf("-turn-ttl %v is too short, it must be at least 1m", cfg.TurnTTL))
+	}
+	if cfg.ChannelName == "" {
+		errs = append(errs, errors.New("-channel must not be empty"))
+	}
+	if cfg.TrackName == "" {
+		errs = append(errs, errors.New("-track must not be empty"))
+	}
+	if cfg.TransportPolicy, cfg.TurnTransport, err = parseTransportPolicy(transportPolicy); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.APITimeout <= 0 || cfg.GatherTimeout <= 0 || cfg.ConnectTimeout <= 0 || cfg.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("timeouts must be positive"))
+	}
+	if cfg.StatsInterval < 0 {
+		errs = append(errs, errors.New("-stats-interval must not be negative"))
+	}
+	if cfg.APIAttempts < 1 {
+		errs = append(errs, errors.New("-api-attempts must be at least 1"))
+	}
+	if cfg.ReconnectAttempts < 0 {
+		errs = append(errs, errors.New("-reconnect-attempts must not be negative"))
+	}
+	if cfg.ReconnectMaxBackoff < reconnectInitialBackoff {
+		errs = append(errs, fmt.Errorf("-reconnect-max-backoff must be at least %v", reconnectInitialBackoff))
+	}
+	if cfg.TurnBaseURL == "" {
+		cfg.TurnBaseURL = cfg.BaseURL
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return &cfg, nil
+}
+
+// readSecret reads a secret from the given file, or from the environment
+// variable key if no file is given.
+func readSecret(key, file string) (string, error) {
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("error reading %s: %w", key, err)
+		}
+		secret := strings.TrimSpace(string(data))
+		if secret == "" {
+			return "", fmt.Errorf("file %s for %s is empty", file, key)
+		}
+		return secret, nil
+	}
+
+	secret := os.Getenv(key)
+	if secret == "" {
+		return "", fmt.Errorf("missing %s, set it in the environment or pass a token file", key)
+	}
+	return secret, nil
+}
+
+// parseTransportPolicy parses the value of the -ice-transport-policy flag
+// into the policy of the PeerConnections and the transport the TURN URLs
+// are restricted to.
+func parseTransportPolicy(policy string) (webrtc.ICETransportPolicy, string, error) {
+	switch policy {
+	case "relay":
+		return webrtc.ICETransportPolicyRelay, "", nil
+	case "turn-udp":
+		return webrtc.ICETransportPolicyRelay, turnTransportUDP, nil
+	case "turn-tcp":
+		return webrtc.ICETransportPolicyRelay, turnTransportTCP, nil
+	case "turns":
+		return webrtc.ICETransportPolicyRelay, turnTransportTLS, nil
+	case "all":
+		return webrtc.ICETransportPolicyAll, "", nil
+	default:
+		return webrtc.ICETransportPolicyAll, "", fmt.Errorf("invalid ICE transport policy %q, must be relay, turn-udp, turn-tcp, turns or all", policy)
+	}
+}
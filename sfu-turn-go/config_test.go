@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// clearConfigEnv makes sure the tests don't pick up any configuration from
+// the environment they are running in.
+func clearConfigEnv(t *testing.T) {
+	for _, key := range []string{
+		"CLOUDFLARE_TURN_KEY_ID", "CLOUDFLARE_TURN_API_TOKEN", "CLOUDFLARE_TURN_API_TOKEN_FILE",
+		"CLOUDFLARE_CALLS_APP_ID", "CLOUDFLARE_CALLS_APP_TOKEN", "CLOUDFLARE_CALLS_APP_TOKEN_FILE",
+		"CLOUDFLARE_API_BASE_URL", "CLOUDFLARE_TURN_API_BASE_URL", "CLOUDFLARE_CA_BUNDLE",
+	} {
+		t.Setenv(key, "")
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	clearConfigEnv(t)
+	t.Setenv("CLOUDFLARE_TURN_KEY_ID", "turn-key")
+	t.Setenv("CLOUDFLARE_TURN_API_TOKEN", "turn-token")
+	t.Setenv("CLOUDFLARE_CALLS_APP_ID", "app-id")
+	t.Setenv("CLOUDFLARE_API_BASE_URL", "http://localhost:8080/v1")
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("calls-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := parseConfig([]string{
+		"-calls-app-token-file", tokenFile,
+		"-turn-ttl", "1h",
+		"-ice-transport-policy", "all",
+	}, io.Discard)
+	if err != nil {
+		t.Fatalf("parseConfig failed: %v", err)
+	}
+
+	if cfg.TurnKeyID != "turn-key" || cfg.TurnAPIToken != "turn-token" {
+		t.Errorf("unexpected TURN settings: %q %q", cfg.TurnKeyID, cfg.TurnAPIToken)
+	}
+	if cfg.CallsAppID != "app-id" || cfg.CallsAppToken != "calls-token" {
+		t.Errorf("unexpected Calls settings: %q %q", cfg.CallsAppID, cfg.CallsAppToken)
+	}
+	if cfg.TurnBaseURL != "http://localhost:8080/v1" {
+		t.Errorf("TURN base URL %q does not default to the base URL", cfg.TurnBaseURL)
+	}
+	if cfg.TurnTTL != time.Hour || cfg.TransportPolicy != webrtc.ICETransportPolicyAll {
+		t.Errorf("unexpected TTL %v or policy %v", cfg.TurnTTL, cfg.TransportPolicy)
+	}
+	if cfg.ChannelName != "channel-one" {
+		t.Errorf("unexpected default channel name %q", cfg.ChannelName)
+	}
+	if cfg.TrickleICE {
+		t.Error("trickle ICE is enabled by default")
+	}
+}
+
+func TestParseConfigValidation(t *testing.T) {
+	clearConfigEnv(t)
+
+	_, err := parseConfig([]string{"-ice-transport-policy", "host", "-turn-ttl", "10s", "-reconnect-attempts", "-1"}, io.Discard)
+	if err == nil {
+		t.Fatal("expected an error for an empty configuration")
+	}
+	for _, want := range []string{
+		"missing TURN key ID",
+		"missing Calls app ID",
+		"CLOUDFLARE_TURN_API_TOKEN",
+		"CLOUDFLARE_CALLS_APP_TOKEN",
+		"-turn-ttl",
+		`invalid ICE transport policy "host"`,
+		"-reconnect-attempts",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+
+	// Tokens must not be passed as positional arguments anymore.
+	if _, err := parseConfig([]string{"token"}, io.Discard); err == nil {
+		t.Fatal("expected an error for positional arguments")
+	}
+}
+
+func TestParseTransportPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy    string
+		want      webrtc.ICETransportPolicy
+		transport string
+	}{
+		{"relay", webrtc.ICETransportPolicyRelay, ""},
+		{"turn-udp", webrtc.ICETransportPolicyRelay, turnTransportUDP},
+		{"turn-tcp", webrtc.ICETransportPolicyRelay, turnTransportTCP},
+		{"turns", webrtc.ICETransportPolicyRelay, turnTransportTLS},
+		{"all", webrtc.ICETransportPolicyAll, ""},
+	} {
+		policy, transport, err := parseTransportPolicy(tc.policy)
+		if err != nil || policy != tc.want || transport != tc.transport {
+			t.Errorf("parseTransportPolicy(%q) = %v, %q, %v; want %v, %q", tc.policy, policy, transport, err, tc.want, tc.transport)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/cloudflare/calls-examples/sfu-turn-go/calls"
+	"github.com/pion/webrtc/v3"
+)
+
+// publishDataChannels publishes the data channels on the SFU with a single
+// datachannels/new request and creates the matching negotiated data channels
+// on the PeerConnection. The returned map holds the data channels keyed by
+// name. If single channels fail, the others are returned together with an
+// error.
+func publishDataChannels(ctx context.Context, client *calls.Client, pc *webrtc.PeerConnection, sessionId string, channelNames ...string) (map[string]*webrtc.DataChannel, error) {
+	results, err := client.PublishDataChannels(ctx, sessionId, channelNames...)
+	if err != nil {
+		return nil, err
+	}
+
+	channels := make(map[string]*webrtc.DataChannel, len(results))
+	var errs []error
+	for _, result := range results {
+		channel, err := createNegotiatedDataChannel(pc, result.Name, result)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		channels[result.Name] = channel
+	}
+	return channels, errors.Join(errs...)
+}
+
+// subscribeDataChannels subscribes the session to data channels published by
+// other sessions with a single datachannels/new request and creates the
+// matching negotiated data channels on the PeerConnection. As the same name
+// may be published by several sessions, the returned map is keyed by the
+// remote data channel. Like with publishDataChannels, the failure of single
+// channels doesn't affect the others.
+func subscribeDataChannels(ctx context.Context, client *calls.Client, pc *webrtc.PeerConnection, sessionId string, remoteChannels ...calls.RemoteDataChannel) (map[calls.RemoteDataChannel]*webrtc.DataChannel, error) {
+	results, err := client.SubscribeDataChannels(ctx, sessionId, remoteChannels...)
+	if err != nil {
+		return nil, err
+	}
+
+	channels := make(map[calls.RemoteDataChannel]*webrtc.DataChannel, len(results))
+	var errs []error
+	for _, result := range results {
+		channel, err := createNegotiatedDataChannel(pc, result.Name, result)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		channels[calls.RemoteDataChannel{SessionId: result.SessionId, Name: result.Name}] = channel
+	}
+	return channels, errors.Join(errs...)
+}
+
+// createNegotiatedDataChannel creates the data channel with the ID the SFU
+// assigned to it, unless the SFU failed to create it.
+func createNegotiatedDataChannel(pc *webrtc.PeerConnection, label string, result calls.DataChannelResult) (*webrtc.DataChannel, error) {
+	if result.Err != nil {
+		return nil, result.Err
+	}
+
+	negotiated := true
+	id := result.Id
+	channel, err := pc.CreateDataChannel(label, &webrtc.DataChannelInit{
+		Negotiated: &negotiated,
+		ID:         &id,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating data channel %q: %w", label, err)
+	}
+	return channel, nil
+}
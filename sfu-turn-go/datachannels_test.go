@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/calls-examples/sfu-turn-go/calls"
+	"github.com/cloudflare/calls-examples/sfu-turn-go/calls/callstest"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestPublishSubscribeManyDataChannels(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	sfu := callstest.NewServer()
+	defer sfu.Close()
+	client := sfu.Client()
+	api := callstest.NewAPI()
+
+	publisher, publisherSession := connectSession(t, ctx, api, client)
+	subscriber, subscriberSession := connectSession(t, ctx, api, client)
+
+	var names []string
+	var remoteChannels []calls.RemoteDataChannel
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("topic-%d", i)
+		names = append(names, name)
+		remoteChannels = append(remoteChannels, calls.RemoteDataChannel{SessionId: publisherSession, Name: name})
+	}
+
+	published, err := publishDataChannels(ctx, client, publisher, publisherSession, names...)
+	if err != nil {
+		t.Fatalf("error publishing data channels: %v", err)
+	}
+	if len(published) != len(names) {
+		t.Fatalf("expected %d published channels, got %d", len(names), len(published))
+	}
+
+	missing := calls.RemoteDataChannel{SessionId: publisherSession, Name: "missing"}
+	subscribed, err := subscribeDataChannels(ctx, client, subscriber, subscriberSession, append(remoteChannels, missing)...)
+	if err == nil {
+		t.Fatal("expected an error for the missing channel")
+	}
+	if len(subscribed) != len(names) || subscribed[missing] != nil {
+		t.Fatalf("expected only the existing channels to be subscribed, got %d", len(subscribed))
+	}
+
+	// Every subscribed channel has to receive the messages of its own topic.
+	type message struct{ channel, data string }
+	messages := make(chan message, 100)
+	for remote, channel := range subscribed {
+		name := remote.Name
+		channel.OnMessage(func(msg webrtc.DataChannelMessage) {
+			messages <- message{name, string(msg.Data)}
+		})
+	}
+
+	// The SFU drops messages while the subscriber channels aren't open yet,
+	// so keep sending until every topic made it through.
+	received := make(map[string]bool)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for len(received) < len(names) {
+		select {
+		case msg := <-messages:
+			if msg.data != msg.channel {
+				t.Fatalf("channel %s received %q", msg.channel, msg.data)
+			}
+			received[msg.channel] = true
+		case <-ticker.C:
+			for name, channel := range published {
+				if !received[name] && channel.ReadyState() == webrtc.DataChannelStateOpen {
+					if err := channel.SendText(name); err != nil {
+						t.Fatalf("error sending message: %v", err)
+					}
+				}
+			}
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for messages, received %d of %d topics", len(received), len(names))
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Package events parses the messages the SFU sends on the server-events
+// data channel, see calls.ServerEventsLabel.
+//
+// The format of the events is provisional: the Calls API doesn't document
+// the messages of this channel, so the types below are an example of how
+// such events could be handled, matched only by the fake SFU in
+// callstest. They are internal, so that they aren't mistaken for a part of
+// the Calls API, and will have to follow the real messages once these are
+// documented.
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/cloudflare/calls-examples/sfu-turn-go/calls"
+)
+
+// Type identifies the kind of an Event.
+type Type string
+
+const (
+	// TrackAdded is sent when a track was added to the session.
+	TrackAdded Type = "trackAdded"
+	// TrackRemoved is sent when the publisher of a subscribed track
+	// closed it.
+	TrackRemoved Type = "trackRemoved"
+	// DataChannelRemoved is sent when the publisher of a subscribed
+	// data channel closed it.
+	DataChannelRemoved Type = "dataChannelRemoved"
+	// RenegotiationNeeded carries an offer from the SFU, which has to
+	// be answered with a renegotiate request.
+	RenegotiationNeeded Type = "renegotiationNeeded"
+	// SessionClosed is sent before the SFU closes the session.
+	SessionClosed Type = "sessionClosed"
+)
+
+// Event is a message of the server-events data channel. Which fields are
+// set depends on the type of the event.
+type Event struct {
+	Type Type `json:"type"`
+	// SessionId is the session which published the track or data channel
+	// of a track or data channel event.
+	SessionId          string                    `json:"sessionId,omitempty"`
+	TrackName          string                    `json:"trackName,omitempty"`
+	Mid                string                    `json:"mid,omitempty"`
+	DataChannelName    string                    `json:"dataChannelName,omitempty"`
+	SessionDescription *calls.SessionDescription `json:"sessionDescription,omitempty"`
+	Reason             string                    `json:"reason,omitempty"`
+}
+
+// Parse parses a message of the server-events data channel. Events of
+// unknown types are returned as well, so that newer SFU versions don't break
+// older clients.
+func Parse(data []byte) (*Event, error) {
+	var event Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, fmt.Errorf("error parsing server event: %w", err)
+	}
+	if event.Type == "" {
+		return nil, errors.New("server event without type")
+	}
+	if event.Type == RenegotiationNeeded && event.SessionDescription == nil {
+		return nil, errors.New("renegotiationNeeded event without session description")
+	}
+	return &event, nil
+}
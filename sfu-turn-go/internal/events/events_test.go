@@ -0,0 +1,60 @@
+package events
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		data    string
+		want    Event
+		wantErr bool
+	}{
+		{
+			name: "track removed",
+			data: `{"type":"trackRemoved","sessionId":"publisher","trackName":"audio","mid":"1"}`,
+			want: Event{Type: TrackRemoved, SessionId: "publisher", TrackName: "audio", Mid: "1"},
+		},
+		{
+			name: "data channel removed",
+			data: `{"type":"dataChannelRemoved","sessionId":"publisher","dataChannelName":"chat"}`,
+			want: Event{Type: DataChannelRemoved, SessionId: "publisher", DataChannelName: "chat"},
+		},
+		{
+			name: "session closed",
+			data: `{"type":"sessionClosed","reason":"idle"}`,
+			want: Event{Type: SessionClosed, Reason: "idle"},
+		},
+		{
+			name: "unknown type",
+			data: `{"type":"somethingNew","extra":true}`,
+			want: Event{Type: "somethingNew"},
+		},
+		{name: "plain text", data: `Hello from peer1!`, wantErr: true},
+		{name: "missing type", data: `{"trackName":"audio"}`, wantErr: true},
+		{name: "renegotiation without offer", data: `{"type":"renegotiationNeeded"}`, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			event, err := Parse([]byte(tc.data))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", event)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			if *event != tc.want {
+				t.Errorf("got %+v, want %+v", *event, tc.want)
+			}
+		})
+	}
+
+	event, err := Parse([]byte(`{"type":"renegotiationNeeded","sessionDescription":{"type":"offer","sdp":"v=0"}}`))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if event.SessionDescription.Type != "offer" || event.SessionDescription.Sdp != "v=0" {
+		t.Errorf("unexpected session description %+v", event.SessionDescription)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/calls-examples/sfu-turn-go/calls"
+	"github.com/pion/webrtc/v3"
+)
+
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	return rec.Body.String()
+}
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	m.ObserveAPICall("/sessions/new", http.MethodPost, 80*time.Millisecond, nil)
+	m.ObserveAPICall("/sessions/{sessionId}/tracks/new", http.MethodPost, 300*time.Millisecond, nil)
+	m.ObserveAPICall("/sessions/{sessionId}/tracks/new", http.MethodPost, 20*time.Second, errors.New("timeout"))
+
+	fetches := 0
+	provider := NewTurnCredentialProvider(func(ctx context.Context, ttl time.Duration) ([]calls.ICEServer, error) {
+		fetches++
+		if fetches == 1 {
+			return nil, errors.New("unavailable")
+		}
+		return []calls.ICEServer{{URLs: []string{"turn:turn.example.com:3478"}, Username: "user", Credential: "secret"}}, nil
+	}, time.Hour)
+	provider.OnRefresh = m.TurnRefresh
+	for range 2 {
+		provider.Refresh(context.Background())
+	}
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("error creating PeerConnection: %v", err)
+	}
+	defer pc.Close()
+	m.AddPeerConnection("peer1", pc)
+	m.SetSessionID("peer1", "session-1")
+	m.PeerConnectionState("peer1", webrtc.PeerConnectionStateConnecting)
+	m.PeerConnectionState("peer1", webrtc.PeerConnectionStateConnected)
+	m.ICEConnectionState("peer1", webrtc.ICEConnectionStateChecking)
+
+	// Label values are escaped by the Prometheus client.
+	if _, err := pc.CreateDataChannel("a \"b\"\\c\nd", nil); err != nil {
+		t.Fatalf("error creating data channel: %v", err)
+	}
+
+	out := scrape(t, m)
+	for _, line := range []string{
+		`calls_api_request_duration_seconds_bucket{endpoint="/sessions/new",method="POST",le="0.1"} 1`,
+		`calls_api_request_duration_seconds_bucket{endpoint="/sessions/{sessionId}/tracks/new",method="POST",le="0.25"} 0`,
+		`calls_api_request_duration_seconds_bucket{endpoint="/sessions/{sessionId}/tracks/new",method="POST",le="0.5"} 1`,
+		`calls_api_request_duration_seconds_bucket{endpoint="/sessions/{sessionId}/tracks/new",method="POST",le="+Inf"} 2`,
+		`calls_api_request_duration_seconds_count{endpoint="/sessions/{sessionId}/tracks/new",method="POST"} 2`,
+		`calls_api_request_errors_total{endpoint="/sessions/new",method="POST"} 0`,
+		`calls_api_request_errors_total{endpoint="/sessions/{sessionId}/tracks/new",method="POST"} 1`,
+		`turn_credential_refreshes_total{result="error"} 1`,
+		`turn_credential_refreshes_total{result="success"} 1`,
+		`webrtc_peer_connection_state_transitions_total{peer="peer1",session_id="session-1",state="connected"} 1`,
+		`webrtc_ice_connection_state_transitions_total{peer="peer1",session_id="session-1",state="checking"} 1`,
+		`webrtc_data_channel_messages_sent_total{id="0",label="a \"b\"\\c\nd",peer="peer1",session_id="session-1"} 0`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("metrics do not contain %q:\n%s", line, out)
+		}
+	}
+	for _, name := range []string{"webrtc_data_channel_bytes_sent_total", "webrtc_data_channel_messages_received_total"} {
+		if !strings.Contains(out, "# TYPE "+name+" counter\n") {
+			t.Errorf("metrics do not declare %s", name)
+		}
+	}
+	if strings.Contains(out, "webrtc_selected_transport{") {
+		t.Errorf("unexpected selected transport of an unconnected PeerConnection:\n%s", out)
+	}
+
+	// A new session replaces the series of the previous one.
+	m.SetSessionID("peer1", "session-2")
+	m.PeerConnectionState("peer1", webrtc.PeerConnectionStateConnected)
+	out = scrape(t, m)
+	if strings.Contains(out, `session_id="session-1"`) {
+		t.Errorf("metrics still contain the previous session:\n%s", out)
+	}
+	if line := `webrtc_peer_connection_state_transitions_total{peer="peer1",session_id="session-2",state="connected"} 1`; !strings.Contains(out, line+"\n") {
+		t.Errorf("metrics do not contain %q:\n%s", line, out)
+	}
+}
+
+func TestMetricsDisabled(t *testing.T) {
+	// A nil *Metrics ignores all observations.
+	var m *Metrics
+	m.ObserveAPICall("/sessions/new", http.MethodPost, time.Second, nil)
+	m.TurnRefresh(nil)
+	m.PeerConnectionState("peer1", webrtc.PeerConnectionStateConnected)
+	m.ICEConnectionState("peer1", webrtc.ICEConnectionStateConnected)
+	m.AddPeerConnection("peer1", nil)
+	m.SetSessionID("peer1", "session-1")
+}
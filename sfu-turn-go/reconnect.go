@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// reconnectInitialBackoff is the wait before the second reconnect attempt.
+const reconnectInitialBackoff = time.Second
+
+// ReconnectPolicy bounds how often and how fast a lost connection is
+// restarted.
+type ReconnectPolicy struct {
+	// MaxAttempts is the number of attempts per lost connection, 0
+	// disables reconnecting.
+	MaxAttempts int
+	// InitialBackoff is the wait before the second attempt. It doubles
+	// with every further attempt, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Timeout is how long an attempt waits for the connection to come back.
+	Timeout time.Duration
+}
+
+// reconnectPolicy returns the ReconnectPolicy configured by the flags.
+func reconnectPolicy(cfg *config) ReconnectPolicy {
+	return ReconnectPolicy{
+		MaxAttempts:    cfg.ReconnectAttempts,
+		InitialBackoff: reconnectInitialBackoff,
+		MaxBackoff:     cfg.ReconnectMaxBackoff,
+		Timeout:        cfg.ConnectTimeout,
+	}
+}
+
+// backoff returns the wait after the given failed attempt.
+func (p ReconnectPolicy) backoff(attempt int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, p.MaxBackoff)
+}
+
+// ReconnectSupervisor restores the connection of a PeerConnection when it
+// gets disconnected or fails, e.g. because a relay allocation died or the
+// network changed. Every attempt restarts ICE and waits for the connection
+// to come back. Failed attempts are retried with a bounded backoff.
+//
+// Pion's ICE agent keeps the TURN servers the PeerConnection was created
+// with, so an ICE restart allocates relays with the same credentials. Once
+// they expired, as told by SetExpiry, or after a restart failed, the
+// attempts call Rebuild instead, which replaces the PeerConnection with a
+// new one using fresh credentials. Credentials refreshed before that, as
+// told by Renew, make the supervisor rebuild the PeerConnection while it is
+// still connected, so that it doesn't break once its own ones expire.
+//
+// The Update method has to be called from the OnConnectionStateChange
+// handler of the current PeerConnection, and the functions have to be set
+// before calling Run.
+type ReconnectSupervisor struct {
+	// Name identifies the PeerConnection in logs.
+	Name   string
+	Policy ReconnectPolicy
+	// Restart performs the ICE restart and renegotiates the session.
+	Restart func(ctx context.Context) error
+	// Rebuild replaces the PeerConnection with a new one and connects it.
+	// It may be nil, in which case only Restart is used.
+	Rebuild func(ctx context.Context) error
+	// Reconnected is called once the connection is back, e.g. to open the
+	// data channels again. It may be nil.
+	Reconnected func(ctx context.Context) error
+
+	// sleep waits between attempts, it is replaced in tests.
+	sleep func(ctx context.Context, d time.Duration) error
+
+	// now returns the current time, it is replaced in tests.
+	now func() time.Time
+
+	mu      sync.Mutex
+	state   webrtc.PeerConnectionState
+	updates int
+	changed chan struct{}
+	expiry  time.Time
+	// renewal is the expiry of the latest credentials passed to Renew.
+	renewal time.Time
+}
+
+// NewReconnectSupervisor returns a ReconnectSupervisor for the PeerConnection
+// with the given name.
+func NewReconnectSupervisor(name string, policy ReconnectPolicy) *ReconnectSupervisor {
+	return &ReconnectSupervisor{
+		Name:    name,
+		Policy:  policy,
+		sleep:   sleepContext,
+		now:     time.Now,
+		changed: make(chan struct{}),
+	}
+}
+
+// SetExpiry records when the TURN credentials of the PeerConnection expire.
+// It may be called on a nil *ReconnectSupervisor, which ignores it.
+func (s *ReconnectSupervisor) SetExpiry(expiry time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expiry = expiry
+}
+
+// expired reports whether the TURN credentials of the PeerConnection
+// expired, so that an ICE restart can't allocate relays anymore.
+func (s *ReconnectSupervisor) expired() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.expiry.IsZero() && !s.now().Before(s.expiry)
+}
+
+// Renew tells the supervisor that refreshed TURN credentials, which expire
+// at expiry, are available. Run rebuilds the PeerConnection with them unless
+// its credentials expire as late already. It may be called on a nil
+// *ReconnectSupervisor, which ignores it.
+func (s *ReconnectSupervisor) Renew(expiry time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if expiry.After(s.renewal) {
+		s.renewal = expiry
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// renewable reports whether the PeerConnection can be rebuilt with
+// credentials which expire later than its own.
+func (s *ReconnectSupervisor) renewable() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Rebuild != nil && !s.expiry.IsZero() && s.expiry.Before(s.renewal)
+}
+
+// Update records a new connection state. It may be called on a nil
+// *ReconnectSupervisor, which ignores the states.
+func (s *ReconnectSupervisor) Update(state webrtc.PeerConnectionState) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+	s.updates++
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Run reconnects the PeerConnection whenever its connection is lost, or
+// rebuilds it when refreshed credentials are available, until ctx is done,
+// the PeerConnection is closed or all attempts to reconnect failed.
+func (s *ReconnectSupervisor) Run(ctx context.Context) error {
+	if s.Policy.MaxAttempts == 0 {
+		return nil
+	}
+	for {
+		state, err := s.wait(ctx, s.updateCount(), func(state webrtc.PeerConnectionState, _ bool) bool {
+			return state == webrtc.PeerConnectionStateDisconnected || state == webrtc.PeerConnectionStateFailed ||
+				state == webrtc.PeerConnectionStateClosed || s.renewable()
+		})
+		if err != nil {
+			return err
+		}
+		switch state {
+		case webrtc.PeerConnectionStateClosed:
+			return nil
+		case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed:
+			log.Printf("Connection of %s is %s, reconnecting", s.Name, state)
+		default:
+			log.Printf("Renewing the TURN credentials of %s before they expire", s.Name)
+		}
+		if err := s.reconnect(ctx); err != nil {
+			return fmt.Errorf("error reconnecting %s: %w", s.Name, err)
+		}
+		log.Printf("%s reconnected", s.Name)
+	}
+}
+
+// reconnect tries to restore the connection at most Policy.MaxAttempts
+// times. It rebuilds the PeerConnection right away if its credentials
+// expired or can be renewed, and after the first failed attempt, as the
+// TURN server may have rejected the credentials before they expired, e.g.
+// after a restart.
+func (s *ReconnectSupervisor) reconnect(ctx context.Context) error {
+	var err error
+	rebuild := s.Rebuild != nil && (s.expired() || s.renewable())
+	for attempt := 1; attempt <= s.Policy.MaxAttempts; attempt++ {
+		if attempt > 1 {
+			backoff := s.Policy.backoff(attempt - 1)
+			log.Printf("Reconnect attempt %d of %s failed: %v, retrying in %v", attempt-1, s.Name, err, backoff)
+			if err := s.sleep(ctx, backoff); err != nil {
+				return err
+			}
+		}
+		if err = s.attempt(ctx, rebuild); err == nil || ctx.Err() != nil {
+			return err
+		}
+		if errors.Is(err, ErrPeerConnectionClosed) {
+			return err
+		}
+		rebuild = s.Rebuild != nil
+	}
+	return fmt.Errorf("giving up after %d attempts: %w", s.Policy.MaxAttempts, err)
+}
+
+func (s *ReconnectSupervisor) attempt(ctx context.Context, rebuild bool) error {
+	updates := s.updateCount()
+	if rebuild {
+		log.Printf("Rebuilding the PeerConnection of %s with new TURN credentials", s.Name)
+		if err := s.Rebuild(ctx); err != nil {
+			return fmt.Errorf("error rebuilding the PeerConnection: %w", err)
+		}
+	} else if err := s.Restart(ctx); err != nil {
+		return fmt.Errorf("error restarting ICE: %w", err)
+	}
+
+	// A disconnected connection may also come back on its own. A failed
+	// one has to change its state after the restart first.
+	waitCtx, cancel := context.WithTimeout(ctx, s.Policy.Timeout)
+	defer cancel()
+	state, err := s.wait(waitCtx, updates, func(state webrtc.PeerConnectionState, updated bool) bool {
+		return state == webrtc.PeerConnectionStateConnected || state == webrtc.PeerConnectionStateClosed ||
+			(state == webrtc.PeerConnectionStateFailed && updated)
+	})
+	switch {
+	case err != nil && ctx.Err() == nil:
+		return fmt.Errorf("timed out after %v waiting for the connection: %w", s.Policy.Timeout, err)
+	case err != nil:
+		return err
+	case state == webrtc.PeerConnectionStateFailed:
+		return ErrPeerConnectionFailed
+	case state == webrtc.PeerConnectionStateClosed:
+		return ErrPeerConnectionClosed
+	}
+
+	if s.Reconnected != nil {
+		return s.Reconnected(ctx)
+	}
+	return nil
+}
+
+func (s *ReconnectSupervisor) updateCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.updates
+}
+
+// wait waits until done returns true for the current connection state.
+// updated tells done whether the state was updated since the given
+// updateCount.
+func (s *ReconnectSupervisor) wait(ctx context.Context, since int, done func(state webrtc.PeerConnectionState, updated bool) bool) (webrtc.PeerConnectionState, error) {
+	for {
+		s.mu.Lock()
+		state, updated, changed := s.state, s.updates > since, s.changed
+		s.mu.Unlock()
+		if done(state, updated) {
+			return state, nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return state, ctx.Err()
+		}
+	}
+}
+
+// sleepContext waits for d or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/calls-examples/sfu-turn-go/calls"
+	"github.com/cloudflare/calls-examples/sfu-turn-go/calls/callstest"
+	"github.com/pion/turn/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestReconnectPolicyBackoff(t *testing.T) {
+	policy := ReconnectPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	var backoffs []time.Duration
+	for attempt := 1; attempt <= 5; attempt++ {
+		backoffs = append(backoffs, policy.backoff(attempt))
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	if !reflect.DeepEqual(backoffs, want) {
+		t.Errorf("backoffs %v, want %v", backoffs, want)
+	}
+}
+
+// newTestSupervisor returns a ReconnectSupervisor which records its sleeps
+// instead of waiting.
+func newTestSupervisor(attempts int) (*ReconnectSupervisor, *[]time.Duration) {
+	s := NewReconnectSupervisor("peer1", ReconnectPolicy{
+		MaxAttempts:    attempts,
+		InitialBackoff: time.Second,
+		MaxBackoff:     2 * time.Second,
+		Timeout:        5 * time.Second,
+	})
+	var sleeps []time.Duration
+	s.sleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		return nil
+	}
+	return s, &sleeps
+}
+
+func TestReconnectSupervisor(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	s, sleeps := newTestSupervisor(3)
+	var mu sync.Mutex
+	var calls []string
+	record := func(call string) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, call)
+	}
+	restarts := 0
+	s.Restart = func(ctx context.Context) error {
+		record("restart")
+		// The first restart fails, the second one gets connected again.
+		if restarts++; restarts == 1 {
+			return errors.New("renegotiation failed")
+		}
+		go func() {
+			s.Update(webrtc.PeerConnectionStateConnecting)
+			s.Update(webrtc.PeerConnectionStateConnected)
+		}()
+		return nil
+	}
+	reconnected := make(chan struct{})
+	s.Reconnected = func(ctx context.Context) error {
+		record("reconnected")
+		close(reconnected)
+		return nil
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	s.Update(webrtc.PeerConnectionStateConnected)
+	s.Update(webrtc.PeerConnectionStateDisconnected)
+	select {
+	case <-reconnected:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the reconnect")
+	}
+
+	s.Update(webrtc.PeerConnectionStateClosed)
+	if err := <-done; err != nil {
+		t.Errorf("Run returned %v after the PeerConnection was closed", err)
+	}
+	want := []string{"restart", "restart", "reconnected"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls %v, want %v", calls, want)
+	}
+	if !reflect.DeepEqual(*sleeps, []time.Duration{time.Second}) {
+		t.Errorf("slept %v, want 1s", *sleeps)
+	}
+}
+
+func TestReconnectSupervisorGivesUp(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	s, sleeps := newTestSupervisor(4)
+	restarts := 0
+	s.Restart = func(ctx context.Context) error {
+		restarts++
+		// The state changes to failed again after the restart.
+		go func() {
+			s.Update(webrtc.PeerConnectionStateConnecting)
+			s.Update(webrtc.PeerConnectionStateFailed)
+		}()
+		return nil
+	}
+
+	s.Update(webrtc.PeerConnectionStateFailed)
+	err := s.Run(ctx)
+	if !errors.Is(err, ErrPeerConnectionFailed) || !strings.Contains(err.Error(), "giving up after 4 attempts") {
+		t.Errorf("Run returned %v, want giving up with ErrPeerConnectionFailed", err)
+	}
+	if restarts != 4 {
+		t.Errorf("restarted %d times, want 4", restarts)
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 2 * time.Second}
+	if !reflect.DeepEqual(*sleeps, want) {
+		t.Errorf("slept %v, want %v", *sleeps, want)
+	}
+
+	// Without attempts Run doesn't supervise at all.
+	s, _ = newTestSupervisor(0)
+	s.Update(webrtc.PeerConnectionStateFailed)
+	if err := s.Run(ctx); err != nil {
+		t.Errorf("Run without attempts returned %v", err)
+	}
+}
+
+func TestReconnectSupervisorRebuild(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, tc := range []struct {
+		name    string
+		expired bool
+		// restartErr fails the ICE restart, if set.
+		restartErr error
+		want       []string
+	}{
+		{name: "valid credentials", want: []string{"restart"}},
+		{name: "expired credentials", expired: true, want: []string{"rebuild"}},
+		{name: "failed restart", restartErr: errors.New("renegotiation failed"), want: []string{"restart", "rebuild"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, _ := newTestSupervisor(3)
+			now := time.Unix(1000, 0)
+			s.now = func() time.Time { return now }
+			s.SetExpiry(now.Add(time.Minute))
+			if tc.expired {
+				now = now.Add(time.Minute)
+			}
+
+			var calls []string
+			connect := func() {
+				go func() {
+					s.Update(webrtc.PeerConnectionStateConnecting)
+					s.Update(webrtc.PeerConnectionStateConnected)
+				}()
+			}
+			s.Restart = func(ctx context.Context) error {
+				calls = append(calls, "restart")
+				if tc.restartErr != nil {
+					return tc.restartErr
+				}
+				connect()
+				return nil
+			}
+			s.Rebuild = func(ctx context.Context) error {
+				calls = append(calls, "rebuild")
+				connect()
+				return nil
+			}
+
+			s.Update(webrtc.PeerConnectionStateFailed)
+			if err := s.reconnect(ctx); err != nil {
+				t.Fatalf("error reconnecting: %v", err)
+			}
+			if !reflect.DeepEqual(calls, tc.want) {
+				t.Errorf("got calls %v, want %v", calls, tc.want)
+			}
+		})
+	}
+}
+
+func TestReconnectSupervisorRenew(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	s, _ := newTestSupervisor(3)
+	expiry := time.Now().Add(time.Hour)
+	s.SetExpiry(expiry)
+	s.Restart = func(ctx context.Context) error {
+		return errors.New("unexpected ICE restart")
+	}
+	rebuilt := make(chan time.Time, 2)
+	var renewed time.Time
+	s.Rebuild = func(ctx context.Context) error {
+		// The rebuilt PeerConnection gets the renewed credentials.
+		s.SetExpiry(renewed)
+		s.Update(webrtc.PeerConnectionStateConnected)
+		rebuilt <- renewed
+		return nil
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	s.Update(webrtc.PeerConnectionStateConnected)
+
+	// Credentials which don't expire later don't help the PeerConnection.
+	s.Renew(expiry)
+	renewed = expiry.Add(time.Hour)
+	s.Renew(renewed)
+	select {
+	case got := <-rebuilt:
+		if !got.Equal(renewed) {
+			t.Errorf("rebuilt with credentials expiring at %v, want %v", got, renewed)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the PeerConnection to be rebuilt")
+	}
+
+	s.Update(webrtc.PeerConnectionStateClosed)
+	if err := <-done; err != nil {
+		t.Errorf("Run returned %v after the PeerConnection was closed", err)
+	}
+	if len(rebuilt) != 0 {
+		t.Errorf("rebuilt the PeerConnection %d more times", len(rebuilt))
+	}
+}
+
+// testTurnServer is a TURN server on the loopback interface which accepts
+// credentials minted like those of the TURN API.
+type testTurnServer struct {
+	addr   string
+	secret string
+	server *turn.Server
+}
+
+func startTestTurnServer(t *testing.T) *testTurnServer {
+	t.Helper()
+	s := &testTurnServer{secret: "test-secret"}
+	s.listen(t, "127.0.0.1:0")
+	t.Cleanup(func() { s.server.Close() })
+	return s
+}
+
+func (s *testTurnServer) listen(t *testing.T, addr string) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		t.Fatalf("error listening for TURN: %v", err)
+	}
+	s.addr = conn.LocalAddr().String()
+	s.server, err = turn.NewServer(turn.ServerConfig{
+		Realm:       "localhost",
+		AuthHandler: turn.NewLongTermAuthHandler(s.secret, nil),
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn: conn,
+			RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+				RelayAddress: net.ParseIP("127.0.0.1"),
+				Address:      "127.0.0.1",
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("error starting TURN server: %v", err)
+	}
+}
+
+// restart restarts the TURN server on the same address, which drops all
+// relay allocations. Unlike a running server, which keeps the allocations
+// until they time out, the restarted one rejects expired credentials right
+// away.
+func (s *testTurnServer) restart(t *testing.T) {
+	t.Helper()
+	if err := s.server.Close(); err != nil {
+		t.Fatalf("error stopping TURN server: %v", err)
+	}
+	s.listen(t, s.addr)
+}
+
+// fetch mints credentials for the TURN server which are valid for ttl.
+func (s *testTurnServer) fetch(ctx context.Context, ttl time.Duration) ([]calls.ICEServer, error) {
+	username, credential, err := turn.GenerateLongTermCredentials(s.secret, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return []calls.ICEServer{{
+		URLs:       []string{"turn:" + s.addr + "?transport=udp"},
+		Username:   username,
+		Credential: credential,
+	}}, nil
+}
+
+func TestReconnectSupervisorRebuildsExpiredSession(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	sfu := callstest.NewServer()
+	defer sfu.Close()
+	client := sfu.Client()
+	turnServer := startTestTurnServer(t)
+
+	// The publisher is only connected through the TURN server with
+	// credentials which expire after two seconds, the subscriber connects
+	// directly.
+	provider := NewTurnCredentialProvider(turnServer.fetch, 2*time.Second)
+	cfg := &config{TransportPolicy: webrtc.ICETransportPolicyRelay, GatherTimeout: 10 * time.Second, ConnectTimeout: 10 * time.Second}
+	setup := &sessionSetup{cfg: cfg, client: client, provider: provider, api: callstest.NewAPI(func(se *webrtc.SettingEngine) {
+		se.SetICETimeouts(time.Second, 2*time.Second, 200*time.Millisecond)
+	})}
+	supervisor := NewReconnectSupervisor("publisher", ReconnectPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     100 * time.Millisecond,
+		Timeout:        10 * time.Second,
+	})
+	pc, watcher, serverEvents, err := setup.newPeer(ctx, "publisher", supervisor)
+	if err != nil {
+		t.Fatalf("error creating publisher: %v", err)
+	}
+	publisher, err := setup.connect(ctx, "publisher", pc, watcher, serverEvents)
+	if err != nil {
+		t.Fatalf("error connecting publisher: %v", err)
+	}
+	defer publisher.Close(ctx)
+	oldSessionId := publisher.ID
+
+	topic, err := publisher.Bus.Publish(ctx, "topic")
+	if err != nil {
+		t.Fatalf("error publishing topic: %v", err)
+	}
+	audioTrack, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "publisher")
+	if err != nil {
+		t.Fatalf("error creating audio track: %v", err)
+	}
+	if _, err := publisher.PublishTracks(ctx, audioTrack); err != nil {
+		t.Fatalf("error publishing tracks: %v", err)
+	}
+	go writeOpusSilence(ctx, audioTrack)
+
+	subscriberPC, subscriberSession := connectSession(t, ctx, callstest.NewAPI(), client)
+	subscriber := NewSession(client, subscriberPC, subscriberSession)
+	tracks := make(chan string, 4)
+	subscriber.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		tracks <- track.ID()
+	})
+	subscription, err := subscriber.Bus.Subscribe(ctx, oldSessionId, "topic")
+	if err != nil {
+		t.Fatalf("error subscribing to topic: %v", err)
+	}
+	if _, err := subscriber.SubscribeTracks(ctx, oldSessionId, "audio"); err != nil {
+		t.Fatalf("error subscribing to tracks: %v", err)
+	}
+	receive := func(what string) {
+		t.Helper()
+		select {
+		case id := <-tracks:
+			if id != "audio" {
+				t.Errorf("received track %q, want audio", id)
+			}
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for the track %s", what)
+		}
+		// The SFU drops messages while the subscriber channel isn't open
+		// yet, so keep writing until one makes it through.
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case msg := <-subscription.Messages():
+				if string(msg) == what {
+					return
+				}
+			case <-ticker.C:
+				if _, err := topic.Write([]byte(what)); err != nil {
+					t.Fatalf("error writing message: %v", err)
+				}
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for the message %s", what)
+			}
+		}
+	}
+	receive("before")
+
+	rebuilt := make(chan struct{})
+	supervisor.Restart = publisher.RestartICE
+	supervisor.Rebuild = func(ctx context.Context) error {
+		return setup.rebuild(ctx, "publisher", publisher, supervisor, func(ctx context.Context, oldSessionId string) error {
+			return subscriber.Resubscribe(ctx, oldSessionId, publisher.ID)
+		})
+	}
+	supervisor.Reconnected = func(ctx context.Context) error {
+		close(rebuilt)
+		return nil
+	}
+	done := make(chan error, 1)
+	go func() { done <- supervisor.Run(ctx) }()
+
+	// Once the credentials expired, the restarted TURN server doesn't let
+	// the publisher allocate a relay with them anymore.
+	time.Sleep(time.Until(provider.Expiry()) + time.Second)
+	turnServer.restart(t)
+
+	select {
+	case <-rebuilt:
+	case err := <-done:
+		t.Fatalf("supervisor stopped: %v", err)
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the publisher to be rebuilt")
+	}
+	if publisher.ID == oldSessionId {
+		t.Errorf("publisher still uses session %s", oldSessionId)
+	}
+	if state := publisher.PC.ConnectionState(); state != webrtc.PeerConnectionStateConnected {
+		t.Errorf("rebuilt PeerConnection is %s", state)
+	}
+	if state := pc.ConnectionState(); state != webrtc.PeerConnectionStateClosed {
+		t.Errorf("replaced PeerConnection is %s", state)
+	}
+
+	// The subscriber receives the track and the messages from the new
+	// session.
+	receive("after")
+}
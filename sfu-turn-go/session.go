@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/calls-examples/sfu-turn-go/calls"
+	"github.com/cloudflare/calls-examples/sfu-turn-go/internal/events"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// drainInterval is how often Session.Close checks whether the data channels
+// have sent all buffered messages.
+const drainInterval = 10 * time.Millisecond
+
+// Session is a PeerConnection connected to a session on the SFU. It keeps
+// track of the data channels and tracks created for the session, so that
+// all of them can be closed on shutdown, or restored when the session is
+// rebuilt on a new PeerConnection.
+type Session struct {
+	// ID and PC change when the session gets rebuilt, which only happens
+	// on the goroutine of its ReconnectSupervisor.
+	ID  string
+	PC  *webrtc.PeerConnection
+	Bus *Bus
+
+	client *calls.Client
+	// ctx is cancelled by Close, it ends the negotiations started by
+	// server events.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// negotiationMu serializes all offer/answer exchanges with the SFU.
+	negotiationMu sync.Mutex
+
+	mu           sync.Mutex
+	closed       bool
+	dataChannels []*webrtc.DataChannel
+	// mids holds the mids of the published and subscribed tracks, keyed by
+	// track name.
+	mids map[string]string
+	// published holds the published tracks and subscribed the sessions
+	// the subscribed tracks were published by, keyed by track name.
+	published    map[string]*webrtc.TrackLocalStaticSample
+	subscribed   map[string]string
+	onTrack      func(*webrtc.TrackRemote, *webrtc.RTPReceiver)
+	onTrackEnded func(trackName string)
+	onEvent      func(event events.Event)
+}
+
+// NewSession returns a Session for the PeerConnection, which has to be
+// connected to the session with the given ID already.
+func NewSession(client *calls.Client, pc *webrtc.PeerConnection, sessionId string) *Session {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Session{
+		ID:     sessionId,
+		PC:     pc,
+		Bus:    NewBus(client, pc, sessionId),
+		client: client,
+		ctx:    ctx,
+		cancel: cancel,
+		mids:   make(map[string]string),
+
+		published:  make(map[string]*webrtc.TrackLocalStaticSample),
+		subscribed: make(map[string]string),
+	}
+}
+
+// AddDataChannel adds a data channel which was created outside of the Bus,
+// so that it gets closed together with the session.
+func (s *Session) AddDataChannel(channel *webrtc.DataChannel) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dataChannels = append(s.dataChannels, channel)
+}
+
+// PublishTracks publishes the local tracks like publishTracks and remembers
+// them for closing.
+func (s *Session) PublishTracks(ctx context.Context, tracks ...*webrtc.TrackLocalStaticSample) (map[string]string, error) {
+	s.negotiationMu.Lock()
+	defer s.negotiationMu.Unlock()
+	mids, err := publishTracks(ctx, s.client, s.PC, s.ID, tracks...)
+	s.addTracks(mids)
+	s.mu.Lock()
+	for _, track := range tracks {
+		if _, ok := mids[track.ID()]; ok {
+			s.published[track.ID()] = track
+		}
+	}
+	s.mu.Unlock()
+	return mids, err
+}
+
+// SubscribeTracks subscribes to tracks of the remote session like
+// subscribeTracks and remembers them for closing. The handler set with
+// OnTrackEnded gets called when the publisher closes one of them.
+func (s *Session) SubscribeTracks(ctx context.Context, remoteSessionId string, trackNames ...string) (map[string]string, error) {
+	s.negotiationMu.Lock()
+	defer s.negotiationMu.Unlock()
+	mids, err := subscribeTracks(ctx, s.client, s.PC, s.ID, remoteSessionId, trackNames...)
+	s.addTracks(mids)
+	s.mu.Lock()
+	for name := range mids {
+		s.subscribed[name] = remoteSessionId
+	}
+	s.mu.Unlock()
+	for name, mid := range mids {
+		if transceiver := transceiverByMid(s.PC, mid); transceiver != nil {
+			go s.watchTrack(name, transceiver.Receiver())
+		}
+	}
+	return mids, err
+}
+
+// OnTrack sets the handler for tracks received by the PeerConnection, and
+// by the ones the session gets rebuilt on.
+func (s *Session) OnTrack(f func(*webrtc.TrackRemote, *webrtc.RTPReceiver)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onTrack = f
+	s.PC.OnTrack(f)
+}
+
+// OnTrackEnded sets a handler which gets called when the publisher of a
+// subscribed track closed it.
+func (s *Session) OnTrackEnded(f func(trackName string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onTrackEnded = f
+}
+
+// CloseTracks closes published or subscribed tracks of the session on the
+// SFU, including the required renegotiation.
+func (s *Session) CloseTracks(ctx context.Context, trackNames ...string) error {
+	s.mu.Lock()
+	var mids []string
+	for _, name := range trackNames {
+		mid, ok := s.mids[name]
+		if !ok {
+			s.mu.Unlock()
+			return fmt.Errorf("track %q does not belong to session %s", name, s.ID)
+		}
+		mids = append(mids, mid)
+	}
+	s.mu.Unlock()
+
+	s.negotiationMu.Lock()
+	err := closeTracks(ctx, s.client, s.PC, s.ID, mids...)
+	s.negotiationMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("error closing tracks of session %s: %w", s.ID, err)
+	}
+
+	s.mu.Lock()
+	for _, name := range trackNames {
+		delete(s.mids, name)
+		delete(s.published, name)
+		delete(s.subscribed, name)
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// SendGatheredCandidates waits until ICE gathering is complete and then
+// renegotiates the session, so that the SFU learns about all local
+// candidates. It is needed with trickle ICE, where the session gets created
+// with an offer sent before gathering finished.
+func (s *Session) SendGatheredCandidates(ctx context.Context) error {
+	select {
+	case <-webrtc.GatheringCompletePromise(s.PC):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	s.negotiationMu.Lock()
+	defer s.negotiationMu.Unlock()
+	if err := offerRenegotiation(ctx, s.client, s.PC, s.ID, nil); err != nil {
+		return fmt.Errorf("error sending ICE candidates of session %s: %w", s.ID, err)
+	}
+	return nil
+}
+
+// RestartICE restarts ICE of the PeerConnection and renegotiates the
+// session with an offer containing the new credentials and candidates, e.g.
+// after the connection to the SFU was lost.
+//
+// Note that the ICE agent of Pion keeps using the TURN servers and
+// credentials the PeerConnection was created with, a configuration set
+// with SetConfiguration afterwards is not applied by the restart. Once
+// they expired the session has to be rebuilt on a new PeerConnection.
+func (s *Session) RestartICE(ctx context.Context) error {
+	s.negotiationMu.Lock()
+	defer s.negotiationMu.Unlock()
+	if err := offerRenegotiation(ctx, s.client, s.PC, s.ID, &webrtc.OfferOptions{ICERestart: true}); err != nil {
+		return fmt.Errorf("error restarting ICE of session %s: %w", s.ID, err)
+	}
+	return nil
+}
+
+// watchTrack waits for the RTCP BYE the SFU sends when the publisher of a
+// subscribed track closes it.
+func (s *Session) watchTrack(trackName string, receiver *webrtc.RTPReceiver) {
+	for {
+		packets, _, err := receiver.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, packet := range packets {
+			if _, ok := packet.(*rtcp.Goodbye); ok {
+				s.trackEnded(trackName)
+				return
+			}
+		}
+	}
+}
+
+// trackEnded forgets about a track closed by its publisher and calls the
+// OnTrackEnded handler. As the SFU reports closed tracks both with an RTCP
+// BYE and an event, the handler is only called once per track.
+func (s *Session) trackEnded(trackName string) {
+	s.mu.Lock()
+	_, ok := s.mids[trackName]
+	delete(s.mids, trackName)
+	handler := s.onTrackEnded
+	s.mu.Unlock()
+
+	if ok && handler != nil {
+		handler(trackName)
+	}
+}
+
+// HandleServerEvents parses the messages the SFU sends on the
+// server-events data channel. Removed tracks and data channels and
+// renegotiations are handled by the session, and all events are passed to
+// the handler set with OnEvent. The data channel gets closed together with
+// the session.
+func (s *Session) HandleServerEvents(channel *webrtc.DataChannel) {
+	s.AddDataChannel(channel)
+	s.handleServerEvents(channel)
+}
+
+func (s *Session) handleServerEvents(channel *webrtc.DataChannel) {
+	channel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		event, err := events.Parse(msg.Data)
+		if err != nil {
+			log.Printf("ignoring message on %s of session %s: %v", channel.Label(), s.ID, err)
+			return
+		}
+		s.handleEvent(*event)
+	})
+}
+
+// OnEvent sets a handler which gets called for every event the SFU sends
+// on the server-events data channel.
+func (s *Session) OnEvent(f func(event events.Event)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onEvent = f
+}
+
+func (s *Session) handleEvent(event events.Event) {
+	switch event.Type {
+	case events.TrackRemoved:
+		s.trackEnded(event.TrackName)
+	case events.DataChannelRemoved:
+		s.Bus.unpublished(calls.RemoteDataChannel{SessionId: event.SessionId, Name: event.DataChannelName})
+	case events.RenegotiationNeeded:
+		s.negotiationMu.Lock()
+		err := answerRenegotiation(s.ctx, s.client, s.PC, s.ID, event.SessionDescription)
+		s.negotiationMu.Unlock()
+		if err != nil {
+			log.Printf("error answering renegotiation of session %s: %v", s.ID, err)
+		}
+	}
+
+	s.mu.Lock()
+	handler := s.onEvent
+	s.mu.Unlock()
+	if handler != nil {
+		handler(event)
+	}
+}
+
+// replacePeerConnection moves the session to a new PeerConnection, which is
+// connected to a new session on the SFU with the given ID, and returns the
+// old PeerConnection. The events of the new session arrive on
+// serverEvents. The tracks and topics are only published and subscribed
+// again by restore, once the new PeerConnection is connected.
+func (s *Session) replacePeerConnection(pc *webrtc.PeerConnection, sessionId string, serverEvents *webrtc.DataChannel) *webrtc.PeerConnection {
+	s.negotiationMu.Lock()
+	defer s.negotiationMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.PC
+	s.PC = pc
+	s.ID = sessionId
+	// The data channels and mids of the old PeerConnection are gone
+	// together with it.
+	s.dataChannels = []*webrtc.DataChannel{serverEvents}
+	s.mids = make(map[string]string)
+	if s.onTrack != nil {
+		pc.OnTrack(s.onTrack)
+	}
+	s.handleServerEvents(serverEvents)
+	s.Bus.rebind(pc, sessionId)
+	return old
+}
+
+// restore publishes and subscribes the tracks and topics of the session
+// again after it was moved to a new PeerConnection.
+func (s *Session) restore(ctx context.Context) error {
+	s.mu.Lock()
+	tracks := make([]*webrtc.TrackLocalStaticSample, 0, len(s.published))
+	for _, track := range s.published {
+		tracks = append(tracks, track)
+	}
+	remotes := make(map[string][]string)
+	for name, remoteSessionId := range s.subscribed {
+		remotes[remoteSessionId] = append(remotes[remoteSessionId], name)
+	}
+	s.mu.Unlock()
+
+	var errs []error
+	if len(tracks) > 0 {
+		if _, err := s.PublishTracks(ctx, tracks...); err != nil {
+			errs = append(errs, fmt.Errorf("error publishing tracks again: %w", err))
+		}
+	}
+	for remoteSessionId, names := range remotes {
+		if _, err := s.SubscribeTracks(ctx, remoteSessionId, names...); err != nil {
+			errs = append(errs, fmt.Errorf("error subscribing to tracks of session %s again: %w", remoteSessionId, err))
+		}
+	}
+	if err := s.Bus.Reopen(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Resubscribe subscribes the tracks and topics subscribed from a remote
+// session again from the session which replaced it, e.g. after the remote
+// peer was rebuilt with new TURN credentials.
+func (s *Session) Resubscribe(ctx context.Context, oldSessionId, newSessionId string) error {
+	s.mu.Lock()
+	var names []string
+	for name, remoteSessionId := range s.subscribed {
+		if remoteSessionId == oldSessionId {
+			names = append(names, name)
+		}
+	}
+	s.mu.Unlock()
+
+	var errs []error
+	if len(names) > 0 {
+		if _, err := s.SubscribeTracks(ctx, newSessionId, names...); err != nil {
+			errs = append(errs, fmt.Errorf("error subscribing to tracks of session %s: %w", newSessionId, err))
+		}
+	}
+	if err := s.Bus.resubscribe(ctx, oldSessionId, newSessionId); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Session) addTracks(mids map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, mid := range mids {
+		s.mids[name] = mid
+	}
+}
+
+// Close shuts the session down. It waits until the data channels have sent
+// the buffered messages, closes the tracks on the SFU and finally closes all
+// data channels and the PeerConnection. The context limits how long
+// draining and closing the tracks may take, the local resources get closed
+// in any case.
+func (s *Session) Close(ctx context.Context) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.cancel()
+	id, pc := s.ID, s.PC
+	dataChannels := append([]*webrtc.DataChannel(nil), s.dataChannels...)
+	var tracks []calls.CloseTrackObject
+	for _, mid := range s.mids {
+		tracks = append(tracks, calls.CloseTrackObject{Mid: mid})
+	}
+	s.mu.Unlock()
+
+	var errs []error
+	if err := drainDataChannels(ctx, append(s.Bus.dataChannels(), dataChannels...)); err != nil {
+		errs = append(errs, fmt.Errorf("error draining data channels: %w", err))
+	}
+
+	// The PeerConnection gets closed right away, so there is no need to
+	// renegotiate the closed tracks.
+	if len(tracks) > 0 {
+		response, err := s.client.CloseTracks(ctx, id, calls.CloseTracksRequest{Tracks: tracks, Force: true})
+		if err == nil {
+			err = response.Err()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error closing tracks of session %s: %w", id, err))
+		}
+	}
+
+	if err := s.Bus.Close(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	for _, channel := range dataChannels {
+		if err := channel.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := pc.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// drainDataChannels waits until the open data channels have no buffered
+// messages left.
+func drainDataChannels(ctx context.Context, channels []*webrtc.DataChannel) error {
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	for {
+		drained := true
+		for _, channel := range channels {
+			if channel.ReadyState() == webrtc.DataChannelStateOpen && channel.BufferedAmount() > 0 {
+				drained = false
+				break
+			}
+		}
+		if drained {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/calls-examples/sfu-turn-go/calls"
+	"github.com/cloudflare/calls-examples/sfu-turn-go/calls/callstest"
+	"github.com/cloudflare/calls-examples/sfu-turn-go/internal/events"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestSessionClose(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	sfu := callstest.NewServer()
+	defer sfu.Close()
+	client := sfu.Client()
+	api := callstest.NewAPI()
+
+	publisherPC, publisherSession := connectSession(t, ctx, api, client)
+	subscriberPC, subscriberSession := connectSession(t, ctx, api, client)
+	publisher := NewSession(client, publisherPC, publisherSession)
+
+	topic, err := publisher.Bus.Publish(ctx, "topic")
+	if err != nil {
+		t.Fatalf("error publishing topic: %v", err)
+	}
+	audioTrack, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio-one", "publisher")
+	if err != nil {
+		t.Fatalf("error creating audio track: %v", err)
+	}
+	if _, err := publisher.PublishTracks(ctx, audioTrack); err != nil {
+		t.Fatalf("error publishing tracks: %v", err)
+	}
+
+	if err := publisher.Close(ctx); err != nil {
+		t.Fatalf("error closing session: %v", err)
+	}
+	if err := publisher.Close(ctx); err != nil {
+		t.Errorf("closing a session twice must not fail: %v", err)
+	}
+	if state := publisherPC.ConnectionState(); state != webrtc.PeerConnectionStateClosed {
+		t.Errorf("PeerConnection is %s after closing the session", state)
+	}
+	if _, err := topic.Write([]byte("late")); err == nil {
+		t.Error("expected writing to a closed session to fail")
+	}
+
+	// The track has been closed on the SFU, so it can't be subscribed
+	// anymore.
+	if _, err := subscribeTracks(ctx, client, subscriberPC, subscriberSession, publisherSession, "audio-one"); err == nil {
+		t.Error("expected subscribing to a closed track to fail")
+	}
+}
+
+func TestSessionCloseNotifiesSubscribers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	sfu := callstest.NewServer()
+	defer sfu.Close()
+	client := sfu.Client()
+	api := callstest.NewAPI()
+
+	publisherPC, publisherSession := connectSession(t, ctx, api, client)
+	subscriberPC, subscriberSession := connectSession(t, ctx, api, client)
+	publisher := NewSession(client, publisherPC, publisherSession)
+	// The fake SFU closes the topics, which the Calls API has no endpoint for.
+	publisher.Bus.CloseOnSFU = sfu.CloseDataChannels
+	subscriber := NewSession(client, subscriberPC, subscriberSession)
+
+	topic, err := publisher.Bus.Publish(ctx, "topic")
+	if err != nil {
+		t.Fatalf("error publishing topic: %v", err)
+	}
+	subscription, err := subscriber.Bus.Subscribe(ctx, publisherSession, "topic")
+	if err != nil {
+		t.Fatalf("error subscribing to topic: %v", err)
+	}
+
+	audioTrack, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio-one", "publisher")
+	if err != nil {
+		t.Fatalf("error creating audio track: %v", err)
+	}
+	if _, err := publisher.PublishTracks(ctx, audioTrack); err != nil {
+		t.Fatalf("error publishing tracks: %v", err)
+	}
+	go writeOpusSilence(ctx, audioTrack)
+
+	receiving := make(chan struct{})
+	subscriberPC.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		if _, _, err := track.ReadRTP(); err == nil {
+			close(receiving)
+		}
+	})
+	ended := make(chan string, 1)
+	subscriber.OnTrackEnded(func(trackName string) {
+		ended <- trackName
+	})
+	if _, err := subscriber.SubscribeTracks(ctx, publisherSession, "audio-one"); err != nil {
+		t.Fatalf("error subscribing tracks: %v", err)
+	}
+	select {
+	case <-receiving:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for RTP from the subscribed track")
+	}
+
+	if err := publisher.CloseTracks(ctx, "audio-one"); err != nil {
+		t.Fatalf("error closing track: %v", err)
+	}
+	if err := publisher.CloseTracks(ctx, "audio-one"); err == nil {
+		t.Error("expected an error closing a track twice")
+	}
+	select {
+	case name := <-ended:
+		if name != "audio-one" {
+			t.Errorf("track %q ended, want audio-one", name)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the subscriber to learn about the closed track")
+	}
+
+	if err := topic.Close(ctx); err != nil {
+		t.Fatalf("error closing topic: %v", err)
+	}
+	select {
+	case <-subscription.Done():
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the subscription to end")
+	}
+	if err := subscription.Err(); !errors.Is(err, ErrUnpublished) {
+		t.Errorf("subscription ended with %v, want ErrUnpublished", err)
+	}
+
+	if err := subscriber.Close(ctx); err != nil {
+		t.Errorf("error closing subscriber session: %v", err)
+	}
+	if err := publisher.Close(ctx); err != nil {
+		t.Errorf("error closing publisher session: %v", err)
+	}
+}
+
+func TestSessionServerEvents(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	sfu := callstest.NewServer()
+	defer sfu.Close()
+	client := sfu.Client()
+	api := callstest.NewAPI()
+
+	publisherPC, publisherSession := connectSession(t, ctx, api, client)
+	subscriberPC, subscriberSession, serverEvents := connectSessionWithEvents(t, ctx, api, client)
+	publisher := NewSession(client, publisherPC, publisherSession)
+	// The fake SFU closes the topics, which the Calls API has no endpoint for.
+	publisher.Bus.CloseOnSFU = sfu.CloseDataChannels
+	subscriber := NewSession(client, subscriberPC, subscriberSession)
+
+	received := make(chan events.Event, 10)
+	subscriber.OnEvent(func(event events.Event) {
+		received <- event
+	})
+	ended := make(chan string, 10)
+	subscriber.OnTrackEnded(func(trackName string) {
+		ended <- trackName
+	})
+	subscriber.HandleServerEvents(serverEvents)
+
+	audioTrack, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio-one", "publisher")
+	if err != nil {
+		t.Fatalf("error creating audio track: %v", err)
+	}
+	if _, err := publisher.PublishTracks(ctx, audioTrack); err != nil {
+		t.Fatalf("error publishing tracks: %v", err)
+	}
+	mids, err := subscriber.SubscribeTracks(ctx, publisherSession, "audio-one")
+	if err != nil {
+		t.Fatalf("error subscribing tracks: %v", err)
+	}
+
+	nextEvent := func() events.Event {
+		t.Helper()
+		select {
+		case event := <-received:
+			return event
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for a server event")
+			return events.Event{}
+		}
+	}
+	want := events.Event{Type: events.TrackAdded, SessionId: publisherSession, TrackName: "audio-one", Mid: mids["audio-one"]}
+	if event := nextEvent(); event != want {
+		t.Errorf("got event %+v, want %+v", event, want)
+	}
+
+	if err := publisher.CloseTracks(ctx, "audio-one"); err != nil {
+		t.Fatalf("error closing track: %v", err)
+	}
+	want.Type = events.TrackRemoved
+	if event := nextEvent(); event != want {
+		t.Errorf("got event %+v, want %+v", event, want)
+	}
+
+	// The track is reported as ended only once, even though the SFU sends
+	// both an RTCP BYE and an event.
+	if name := <-ended; name != "audio-one" {
+		t.Errorf("track %q ended, want audio-one", name)
+	}
+	select {
+	case name := <-ended:
+		t.Errorf("track %q reported as ended twice", name)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Closing a published topic closes it on the SFU, which tells the
+	// subscriber with an event and ends its subscription.
+	topic, err := publisher.Bus.Publish(ctx, "topic")
+	if err != nil {
+		t.Fatalf("error publishing topic: %v", err)
+	}
+	subscription, err := subscriber.Bus.Subscribe(ctx, publisherSession, "topic")
+	if err != nil {
+		t.Fatalf("error subscribing to topic: %v", err)
+	}
+	if err := topic.Close(ctx); err != nil {
+		t.Fatalf("error closing topic: %v", err)
+	}
+	want = events.Event{Type: events.DataChannelRemoved, SessionId: publisherSession, DataChannelName: "topic"}
+	if event := nextEvent(); event != want {
+		t.Errorf("got event %+v, want %+v", event, want)
+	}
+	select {
+	case <-subscription.Done():
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the subscription to end")
+	}
+	if err := subscription.Err(); !errors.Is(err, ErrUnpublished) {
+		t.Errorf("subscription ended with %v, want ErrUnpublished", err)
+	}
+	if _, err := subscriber.Bus.Subscribe(ctx, publisherSession, "topic"); err == nil {
+		t.Error("expected an error subscribing to a closed topic")
+	}
+}
+
+func TestSessionTrickleICE(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	sfu := callstest.NewServer()
+	defer sfu.Close()
+	client := sfu.Client()
+
+	pc, err := callstest.NewAPI().NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("error creating PeerConnection: %v", err)
+	}
+	defer pc.Close()
+	connected := make(chan struct{})
+	pc.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
+		if pcs == webrtc.PeerConnectionStateConnected {
+			close(connected)
+		}
+	})
+	if _, err := pc.CreateDataChannel(calls.ServerEventsLabel, nil); err != nil {
+		t.Fatalf("error creating data channel: %v", err)
+	}
+
+	// The offer is created before gathering starts, so the session gets
+	// created without any candidates.
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("error creating offer: %v", err)
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatalf("error setting local description: %v", err)
+	}
+	response, err := client.NewSession(ctx, &calls.SessionDescription{Type: "offer", Sdp: offer.SDP})
+	if err != nil {
+		t.Fatalf("error creating session: %v", err)
+	}
+	err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: response.Description.Sdp})
+	if err != nil {
+		t.Fatalf("error setting remote description: %v", err)
+	}
+	if sdp := sfu.RemoteDescription(response.SessionId); strings.Contains(sdp, "a=candidate") {
+		t.Fatalf("initial offer already contains candidates:\n%s", sdp)
+	}
+
+	session := NewSession(client, pc, response.SessionId)
+	if err := session.SendGatheredCandidates(ctx); err != nil {
+		t.Fatalf("error sending candidates: %v", err)
+	}
+	if sdp := sfu.RemoteDescription(response.SessionId); !strings.Contains(sdp, "a=candidate") {
+		t.Errorf("SFU did not receive any candidates:\n%s", sdp)
+	}
+	if state := pc.SignalingState(); state != webrtc.SignalingStateStable {
+		t.Errorf("signaling state is %s after sending the candidates", state)
+	}
+
+	select {
+	case <-connected:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the PeerConnection to connect")
+	}
+}
+
+func TestSessionRestartICE(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	sfu := callstest.NewServer()
+	defer sfu.Close()
+	cfg := &config{GatherTimeout: 10 * time.Second, ConnectTimeout: 10 * time.Second}
+	setup := &sessionSetup{cfg: cfg, client: sfu.Client()}
+
+	pc, watcher, serverEvents := newSetupPeer(t, callstest.NewAPI(), webrtc.Configuration{})
+	iceStates := make(chan webrtc.ICEConnectionState, 16)
+	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		iceStates <- state
+	})
+	session, err := setup.connect(ctx, "peer1", pc, watcher, serverEvents)
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+	ufrag := iceUfrag(sfu.RemoteDescription(session.ID))
+	for len(iceStates) > 0 {
+		<-iceStates
+	}
+
+	if err := session.RestartICE(ctx); err != nil {
+		t.Fatalf("error restarting ICE: %v", err)
+	}
+	if restarted := iceUfrag(sfu.RemoteDescription(session.ID)); restarted == ufrag {
+		t.Errorf("ICE username fragment %q unchanged after the restart", ufrag)
+	}
+	if sdp := sfu.RemoteDescription(session.ID); !strings.Contains(sdp, "a=candidate") {
+		t.Errorf("restart offer does not contain any candidates:\n%s", sdp)
+	}
+
+	// The agent goes through checking again before it is connected with
+	// the new credentials.
+	checking := false
+	for {
+		select {
+		case state := <-iceStates:
+			checking = checking || state == webrtc.ICEConnectionStateChecking
+			if checking && state == webrtc.ICEConnectionStateConnected {
+				return
+			}
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for the connection after the ICE restart")
+		}
+	}
+}
+
+// iceUfrag returns the first ICE username fragment of the SDP.
+func iceUfrag(sdp string) string {
+	for _, line := range strings.Split(sdp, "\r\n") {
+		if ufrag, ok := strings.CutPrefix(line, "a=ice-ufrag:"); ok {
+			return ufrag
+		}
+	}
+	return ""
+}
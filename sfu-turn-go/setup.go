@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/cloudflare/calls-examples/sfu-turn-go/calls"
+	"github.com/cloudflare/calls-examples/sfu-turn-go/internal/events"
+	"github.com/pion/webrtc/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// sessionSetup creates PeerConnections with TURN credentials and connects
+// them to new sessions on the SFU.
+type sessionSetup struct {
+	cfg    *config
+	client *calls.Client
+	// provider hands out the TURN credentials of new PeerConnections.
+	provider *TurnCredentialProvider
+	// api creates the PeerConnections, the default API is used if nil.
+	api *webrtc.API
+	// metrics and tracer may be nil.
+	metrics *Metrics
+	tracer  trace.Tracer
+}
+
+// startSpan starts a span of a setup step below the current span of ctx.
+func (s *sessionSetup) startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	tracer := s.tracer
+	if tracer == nil {
+		tracer = noop.Tracer{}
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// newPeer creates a PeerConnection for peer with the current TURN
+// credentials of the provider, and the server-events data channel the SFU
+// sends its events on. Its connection state is followed by the returned
+// watcher and by supervisor, which may be nil, and which learns when the
+// credentials expire.
+func (s *sessionSetup) newPeer(ctx context.Context, peer string, supervisor *ReconnectSupervisor) (*webrtc.PeerConnection, *connectionWatcher, *webrtc.DataChannel, error) {
+	configuration, err := createNewWebrtcConfiguration(ctx, s.provider, s.cfg.TransportPolicy)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	expiry := s.provider.Expiry()
+
+	api := s.api
+	if api == nil {
+		api = webrtc.NewAPI()
+	}
+	pc, err := api.NewPeerConnection(configuration)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error creating PeerConnection: %w", err)
+	}
+
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			log.Printf("ICE gathering of %s has finished", peer)
+			return
+		}
+		log.Printf("%s gathered ICE candidate: %v", peer, candidate.ToJSON())
+	})
+	pc.OnICEConnectionStateChange(func(is webrtc.ICEConnectionState) {
+		log.Printf("%s ICE connection state: %v", peer, is)
+		s.metrics.ICEConnectionState(peer, is)
+	})
+	watcher := newConnectionWatcher()
+	pc.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
+		log.Printf("%s connection state: %v", peer, pcs)
+		s.metrics.PeerConnectionState(peer, pcs)
+		watcher.Update(pcs)
+		supervisor.Update(pcs)
+	})
+
+	// The SFU sends events like added and removed tracks on this data
+	// channel, which get handled by the session once it is established.
+	serverEvents, err := pc.CreateDataChannel(calls.ServerEventsLabel, nil)
+	if err != nil {
+		pc.Close()
+		return nil, nil, nil, fmt.Errorf("error creating data channel: %w", err)
+	}
+	serverEvents.OnOpen(func() {
+		log.Printf("System data channel on %s opened", peer)
+	})
+
+	supervisor.SetExpiry(expiry)
+	s.metrics.AddPeerConnection(peer, pc)
+	return pc, watcher, serverEvents, nil
+}
+
+// connect creates a session on the SFU for the PeerConnection of peer and
+// waits until it is connected. Unless trickle ICE is enabled the offer is
+// only sent once ICE gathering has finished. The events sent by the SFU on
+// serverEvents are logged.
+//
+// Every wait is bound by ctx and the timeouts of the configuration, and
+// ends early if the PeerConnection fails or is closed, which watcher has to
+// be updated about. connect returns an error instead of waiting any longer.
+func (s *sessionSetup) connect(ctx context.Context, peer string, pc *webrtc.PeerConnection, watcher *connectionWatcher, serverEvents *webrtc.DataChannel) (*Session, error) {
+	sessionId, err := s.newSession(ctx, peer, pc, watcher)
+	if err != nil {
+		return nil, err
+	}
+
+	// The session keeps track of everything created for the peer, so that
+	// it can be closed on shutdown.
+	session := NewSession(s.client, pc, sessionId)
+	session.OnEvent(func(event events.Event) {
+		log.Printf("%s received server event: %+v", peer, event)
+	})
+	session.HandleServerEvents(serverEvents)
+	if s.cfg.TrickleICE {
+		sendGatheredCandidates(ctx, session, peer)
+	}
+
+	if err := s.waitConnected(ctx, peer, sessionId, watcher); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// rebuild moves the session of peer to a new PeerConnection with fresh
+// TURN credentials and a new session on the SFU, e.g. because the
+// credentials of the current one expired, so that an ICE restart can't
+// connect anymore. Once connected, the tracks and topics of the session are
+// published and subscribed again and moved is called with the ID of the
+// replaced session, if it isn't nil, e.g. to move the subscriptions of
+// other sessions. The replaced PeerConnection is closed last.
+func (s *sessionSetup) rebuild(ctx context.Context, peer string, session *Session, supervisor *ReconnectSupervisor, moved func(ctx context.Context, oldSessionId string) error) (err error) {
+	oldSessionId := session.ID
+	ctx, span := s.startSpan(ctx, "rebuild session", attribute.String("peer", peer), attribute.String("calls.session_id", oldSessionId))
+	defer func() { endSpan(span, err) }()
+
+	// The replaced PeerConnection must not tell the supervisor about
+	// failing or getting closed anymore.
+	session.PC.OnConnectionStateChange(func(webrtc.PeerConnectionState) {})
+
+	pc, watcher, serverEvents, err := s.newPeer(ctx, peer, supervisor)
+	if err != nil {
+		return err
+	}
+	sessionId, err := s.newSession(ctx, peer, pc, watcher)
+	if err != nil {
+		closeDetached(pc)
+		return err
+	}
+	old := session.replacePeerConnection(pc, sessionId, serverEvents)
+	defer closeDetached(old)
+	if s.cfg.TrickleICE {
+		sendGatheredCandidates(ctx, session, peer)
+	}
+
+	if err := s.waitConnected(ctx, peer, sessionId, watcher); err != nil {
+		return err
+	}
+	if err := session.restore(ctx); err != nil {
+		return fmt.Errorf("error restoring session %s: %w", sessionId, err)
+	}
+	if moved != nil {
+		return moved(ctx, oldSessionId)
+	}
+	return nil
+}
+
+// newSession sends the offer of the PeerConnection in a sessions/new
+// request and applies the answer of the SFU. It returns the ID of the new
+// session.
+func (s *sessionSetup) newSession(ctx context.Context, peer string, pc *webrtc.PeerConnection, watcher *connectionWatcher) (string, error) {
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating offer: %w", err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return "", fmt.Errorf("error setting local description: %w", err)
+	}
+
+	// Unless trickle ICE is enabled we wait here for gathering to finish,
+	// so that all the ICE candidates are included in the SDP offer.
+	if !s.cfg.TrickleICE {
+		log.Printf("Waiting for ICE gathering of %s to finish", peer)
+		_, span := s.startSpan(ctx, "ice gathering", attribute.String("peer", peer))
+		err := watcher.Wait(ctx, s.cfg.GatherTimeout, gatherComplete, "ICE gathering")
+		endSpan(span, err)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	sessionCtx, span := s.startSpan(ctx, "sessions/new", attribute.String("peer", peer))
+	response, err := s.client.NewSession(sessionCtx, &calls.SessionDescription{Type: "offer", Sdp: pc.LocalDescription().SDP})
+	if err != nil {
+		endSpan(span, err)
+		return "", fmt.Errorf("error requesting a session ID: %w", err)
+	}
+	span.SetAttributes(attribute.String("calls.session_id", response.SessionId))
+	span.End()
+	log.Printf("sessionID for %s: %v", peer, response.SessionId)
+	s.metrics.SetSessionID(peer, response.SessionId)
+
+	err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: response.Description.Sdp})
+	if err != nil {
+		return "", fmt.Errorf("error setting remote description: %w", err)
+	}
+	return response.SessionId, nil
+}
+
+// waitConnected waits until the PeerConnection of peer is connected to the
+// SFU.
+func (s *sessionSetup) waitConnected(ctx context.Context, peer, sessionId string, watcher *connectionWatcher) error {
+	log.Printf("Waiting for %s to connect to the SFU", peer)
+	_, span := s.startSpan(ctx, "ice/dtls connect", attribute.String("peer", peer), attribute.String("calls.session_id", sessionId))
+	err := watcher.WaitConnected(ctx, s.cfg.ConnectTimeout, "the connection to the SFU")
+	endSpan(span, err)
+	return err
+}
+
+// closeDetached closes a PeerConnection which was replaced, without
+// reporting its closed state to the handlers set during its setup.
+func closeDetached(pc *webrtc.PeerConnection) {
+	pc.OnConnectionStateChange(func(webrtc.PeerConnectionState) {})
+	if err := pc.Close(); err != nil {
+		log.Printf("error closing replaced PeerConnection: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/calls-examples/sfu-turn-go/calls"
+	"github.com/cloudflare/calls-examples/sfu-turn-go/calls/callstest"
+	"github.com/pion/webrtc/v3"
+)
+
+// newSetupPeer returns a PeerConnection with a server-events data channel
+// and a watcher following its connection state.
+func newSetupPeer(t *testing.T, api *webrtc.API, configuration webrtc.Configuration) (*webrtc.PeerConnection, *connectionWatcher, *webrtc.DataChannel) {
+	t.Helper()
+	pc, err := api.NewPeerConnection(configuration)
+	if err != nil {
+		t.Fatalf("error creating PeerConnection: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	watcher := newConnectionWatcher()
+	pc.OnConnectionStateChange(watcher.Update)
+	serverEvents, err := pc.CreateDataChannel(calls.ServerEventsLabel, nil)
+	if err != nil {
+		t.Fatalf("error creating data channel: %v", err)
+	}
+	return pc, watcher, serverEvents
+}
+
+func TestSessionSetupConnect(t *testing.T) {
+	sfu := callstest.NewServer()
+	defer sfu.Close()
+
+	for _, trickle := range []bool{false, true} {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+		cfg := &config{TrickleICE: trickle, GatherTimeout: 10 * time.Second, ConnectTimeout: 10 * time.Second}
+		setup := &sessionSetup{cfg: cfg, client: sfu.Client()}
+
+		pc, watcher, serverEvents := newSetupPeer(t, callstest.NewAPI(), webrtc.Configuration{})
+		session, err := setup.connect(ctx, "peer1", pc, watcher, serverEvents)
+		if err != nil {
+			t.Fatalf("error connecting with trickle ICE %v: %v", trickle, err)
+		}
+		if session.ID == "" || pc.ConnectionState() != webrtc.PeerConnectionStateConnected {
+			t.Errorf("session %q is %s with trickle ICE %v", session.ID, pc.ConnectionState(), trickle)
+		}
+	}
+}
+
+func TestSessionSetupFailures(t *testing.T) {
+	sfu := callstest.NewServer()
+	defer sfu.Close()
+
+	// Without any ICE servers a relay-only PeerConnection has no candidates
+	// and never connects, like when TURN is unreachable.
+	unreachable := webrtc.Configuration{ICETransportPolicy: webrtc.ICETransportPolicyRelay}
+	var se webrtc.SettingEngine
+	se.SetICETimeouts(200*time.Millisecond, 300*time.Millisecond, 100*time.Millisecond)
+	failingAPI := webrtc.NewAPI(webrtc.WithSettingEngine(se))
+
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"errorCode":"bad_request","errorDescription":"invalid offer"}`, http.StatusBadRequest)
+	}))
+	defer rejecting.Close()
+	rejectingClient := calls.NewClient(callstest.AppID, callstest.Token)
+	rejectingClient.BaseURL = rejecting.URL
+	rejectingClient.HTTPClient = rejecting.Client()
+
+	for _, tc := range []struct {
+		name          string
+		client        *calls.Client
+		api           *webrtc.API
+		configuration webrtc.Configuration
+		timeout       time.Duration
+		close         bool
+		want          error
+	}{
+		{name: "rejected offer", client: rejectingClient, api: callstest.NewAPI(), timeout: 10 * time.Second},
+		{name: "failed", client: sfu.Client(), api: failingAPI, configuration: unreachable, timeout: 10 * time.Second, want: ErrPeerConnectionFailed},
+		{name: "timeout", client: sfu.Client(), api: callstest.NewAPI(), configuration: unreachable, timeout: 200 * time.Millisecond, want: context.DeadlineExceeded},
+		{name: "closed", client: sfu.Client(), api: callstest.NewAPI(), configuration: unreachable, timeout: 10 * time.Second, close: true, want: ErrPeerConnectionClosed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+			cfg := &config{GatherTimeout: 10 * time.Second, ConnectTimeout: tc.timeout}
+			setup := &sessionSetup{cfg: cfg, client: tc.client}
+
+			pc, watcher, serverEvents := newSetupPeer(t, tc.api, tc.configuration)
+			if tc.close {
+				time.AfterFunc(200*time.Millisecond, func() { pc.Close() })
+			}
+			session, err := setup.connect(ctx, "peer1", pc, watcher, serverEvents)
+			if err == nil {
+				t.Fatalf("connected session %q", session.ID)
+			}
+			if tc.want != nil && !errors.Is(err, tc.want) {
+				t.Errorf("got error %v, want %v", err, tc.want)
+			}
+			if ctx.Err() != nil {
+				t.Errorf("connect returned only after the test timed out: %v", err)
+			}
+		})
+	}
+}
@@ -2,514 +2,408 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/cloudflare/calls-examples/sfu-turn-go/calls"
 	"github.com/pion/webrtc/v3"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
-// IceServer represents the structure of an iceServer entry in the JSON.
-type IceServer struct {
-	URLs       []string `json:"urls"`
-	Username   string   `json:"username,omitempty"`   // Use omitempty to handle missing fields
-	Credential string   `json:"credential,omitempty"` // Use omitempty to handle missing fields
-}
-
-// TurnResponse represents the top-level JSON structure.
-type TurnResponse struct {
-	IceServers []IceServer `json:"iceServers"`
-}
-
-type SessionDescription struct {
-	Type string `json:"type"`
-	Sdp  string `json:"sdp"`
-}
+// debug disables the redaction of secrets in logs and errors.
+var debug bool
 
-// SessionResponse represents the top-level JSON structure.
-type SessionResponse struct {
-	SessionId   string             `json:"sessionId"`
-	Description SessionDescription `json:"sessionDescription"`
-}
-
-type DataChannelRequest struct {
-	Location        string  `json:"location"`
-	DataChannelName string  `json:"dataChannelName"`
-	SessionId       *string `json:"sessionId,omitempty"`
-}
-
-type DataChannelRequests struct {
-	DataChannels []DataChannelRequest `json:"dataChannels"`
-}
-
-type DataChannelResponse struct {
-	Location        string `json:"location"`
-	DataChannelName string `json:"dataChannelName"`
-	Id              uint16 `json:"id"`
-}
-
-type DataChannelResponses struct {
-	DataChannels []DataChannelResponse `json:"dataChannels"`
-}
-
-// apiCaller makes a generic HTTP API call and unmarshals the response.
-func httpApiCaller(url, apiToken string, reqBody interface{}, expectedStatusCode int, respData interface{}) error {
-	var reqBodyReader io.Reader
-	if reqBody != nil {
-		jsonBody, err := json.Marshal(reqBody)
-		if err != nil {
-			return fmt.Errorf("failed to marshal request body: %w", err)
-		}
-		reqBodyReader = bytes.NewBuffer(jsonBody)
+// logSafe masks credentials, tokens and SDP secrets in s unless debugging.
+func logSafe(s string) string {
+	if debug {
+		return s
 	}
+	return calls.Redact(s)
+}
 
-	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, reqBodyReader)
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+// logSecret masks a secret completely unless debugging.
+func logSecret(secret string) string {
+	if debug {
+		return secret
 	}
+	return calls.RedactSecret(secret)
+}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiToken))
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+func createNewWebrtcConfiguration(ctx context.Context, provider *TurnCredentialProvider, policy webrtc.ICETransportPolicy) (webrtc.Configuration, error) {
+	// Fetch TURN credentials from Cloudflare API, or reuse the cached ones.
+	iceServers, err := provider.ICEServers(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+		return webrtc.Configuration{}, err
 	}
-	defer resp.Body.Close()
-
-	bodyBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read response body: %w", err)
+	for _, server := range iceServers {
+		log.Printf("Received from Cloudflare API urls: %v, username: %v, credential: %v", server.URLs, logSecret(server.Username), logSecret(fmt.Sprint(server.Credential)))
 	}
 
-	if resp.StatusCode != expectedStatusCode {
-		return fmt.Errorf("API request failed with status %s (%d): %s", resp.Status, resp.StatusCode, string(bodyBytes))
-	}
+	// Set up Cloudflare TURN server configuration, by default with the
+	// relay-only policy. The provider already restricted the URLs to the
+	// TURN transport of the policy, if any.
+	return webrtc.Configuration{
+		ICEServers:         iceServers,
+		ICETransportPolicy: policy,
+	}, nil
+}
 
-	if respData != nil {
-		if err := json.Unmarshal(bodyBytes, respData); err != nil {
-			return fmt.Errorf("failed to unmarshal response body: %w", err)
+// sendGatheredCandidates sends the ICE candidates gathered after the session
+// was created to the SFU in the background.
+func sendGatheredCandidates(ctx context.Context, session *Session, peer string) {
+	go func() {
+		if err := session.SendGatheredCandidates(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("error sending ICE candidates of %s: %v", peer, err)
 		}
-	}
-	return nil
+	}()
 }
 
-// Helper function to fetch TURN credentials from Cloudflare API.
-func getCloudflareTurnCredentials(apiToken, accountID string) (string, string, error) {
-	// API endpoint for TURN credentials.
-	endpoint := fmt.Sprintf("https://rtc.live.cloudflare.com/v1/turn/keys/%s/credentials/generate-ice-servers", accountID)
-
-	// Request body for the TURN credentials API.
-	requestBody := map[string]interface{}{
-		"ttl": 86400, // Time-to-live in seconds (24 hours)
-	}
-	var response TurnResponse
-
-	err := httpApiCaller(endpoint, apiToken, requestBody, http.StatusCreated, &response)
-	if err != nil {
-		return "", "", fmt.Errorf("error making TURN HTTP API call: %v", err)
-	}
-
-	var username, credential string
-	// Iterate over the iceServers array.
-	for _, server := range response.IceServers {
-		// Check if both Username and Credential are present.
-		if server.Username != "" {
-			username = server.Username
+// superviseSession reconnects the session in the background whenever its
+// connection to the SFU is lost. Every attempt restarts ICE with a
+// renegotiation and finally reopens the data channels of the Bus which got
+// closed in the meantime. Once the TURN credentials expired, or after a
+// failed attempt, rebuild moves the session to a new PeerConnection
+// instead, as it does when the supervisor renews the credentials.
+func superviseSession(ctx context.Context, supervisor *ReconnectSupervisor, session *Session, rebuild func(ctx context.Context) error) {
+	supervisor.Restart = session.RestartICE
+	supervisor.Rebuild = rebuild
+	supervisor.Reconnected = session.Bus.Reopen
+	go func() {
+		if err := supervisor.Run(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("%v", err)
 		}
-		if server.Credential != "" {
-			credential = server.Credential
-		}
-	}
-
-	return username, credential, nil
+	}()
 }
 
-func getCloudflareSfuSession(apiToken, appId, sdp string) (string, string, error) {
-	// API endpoint for SFU session.
-	endpoint := fmt.Sprintf("https://rtc.live.cloudflare.com/v1/apps/%s/sessions/new", appId)
-
-	// Request body for the data channels API.
-	requestBody := map[string]interface{}{
-		"sessionDescription": SessionDescription{
-			Type: "offer",
-			Sdp:  sdp,
-		},
+func main() {
+	cfg, err := parseConfig(os.Args[1:], os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
 	}
-	var response SessionResponse
-
-	err := httpApiCaller(endpoint, apiToken, requestBody, http.StatusCreated, &response)
 	if err != nil {
-		return "", "", fmt.Errorf("error making SFU session HTTP API call: %v", err)
+		fmt.Fprintf(os.Stderr, "%v\n\nRun with -h for usage.\n", err)
+		os.Exit(2)
 	}
 
-	return response.SessionId, response.Description.Sdp, nil
-}
+	debug = cfg.Debug
 
-func publishDataChannel(apiToken, appId, sessionId, channelName string) (uint16, error) {
-	endpoint := fmt.Sprintf("https://rtc.live.cloudflare.com/v1/apps/%s/sessions/%s/datachannels/new", appId, sessionId)
-
-	// Request body for the data channels API.
-	dataChannel := DataChannelRequest{
-		Location:        "local",
-		DataChannelName: channelName,
-	}
-	requestBody := DataChannelRequests{
-		DataChannels: []DataChannelRequest{dataChannel},
-	}
-	var response DataChannelResponses
-
-	err := httpApiCaller(endpoint, apiToken, requestBody, http.StatusOK, &response)
+	httpClient, err := newHTTPClient(cfg.CABundle, cfg.APITimeout)
 	if err != nil {
-		return 0, fmt.Errorf("error making data channel publish HTTP API call: %v", err)
+		log.Fatalf("error creating HTTP client: %v", err)
+	}
+
+	// SIGINT and SIGTERM cancel the context, after which the sessions get
+	// closed gracefully.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	sfuClient := calls.NewClient(cfg.CallsAppID, cfg.CallsAppToken)
+	sfuClient.BaseURL = cfg.BaseURL
+	sfuClient.HTTPClient = httpClient
+	sfuClient.Debug = cfg.Debug
+	sfuClient.Retry.MaxAttempts = cfg.APIAttempts
+	turnClient := calls.NewTurnClient(cfg.TurnKeyID, cfg.TurnAPIToken)
+	turnClient.BaseURL = cfg.TurnBaseURL
+	turnClient.HTTPClient = httpClient
+	turnClient.Debug = cfg.Debug
+	turnClient.Retry.MaxAttempts = cfg.APIAttempts
+
+	// Metrics are only collected if they are served, otherwise metrics
+	// stays nil and ignores all observations.
+	var metrics *Metrics
+	if cfg.MetricsAddr != "" {
+		metrics = NewMetrics()
+		server, err := serveMetrics(cfg.MetricsAddr, metrics)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		defer server.Close()
+		sfuClient.OnAPICall = func(call calls.APICall) {
+			metrics.ObserveAPICall(call.Endpoint, call.Method, call.Duration, call.Err)
+		}
+		turnClient.OnAPICall = sfuClient.OnAPICall
 	}
 
-	return response.DataChannels[0].Id, nil
-}
+	// Traces are only recorded if they are exported, otherwise tracer is a
+	// no-op and tracerProvider stays nil.
+	var tracer trace.Tracer = noop.Tracer{}
+	var tracerProvider *sdktrace.TracerProvider
+	if cfg.OTLPEndpoint != "" {
+		exportClient, err := newHTTPClient(cfg.CABundle, cfg.APITimeout)
+		if err != nil {
+			log.Fatalf("error creating HTTP client: %v", err)
+		}
+		tracerProvider, err = newTracerProvider(ctx, cfg.OTLPEndpoint, exportClient)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		tracer = tracerProvider.Tracer(tracerName)
 
-func subscribeDataChannel(apiToken, appId, sessionId, remoteSessionId, channelName string) (uint16, error) {
-	endpoint := fmt.Sprintf("https://rtc.live.cloudflare.com/v1/apps/%s/sessions/%s/datachannels/new", appId, sessionId)
+		// The trace context is propagated to the Calls and TURN APIs.
+		httpClient.Transport = tracingTransport(httpClient.Transport, tracerProvider)
 
-	// Request body for the data channels API.
-	dataChannel := DataChannelRequest{
-		Location:        "remote",
-		DataChannelName: channelName,
-		SessionId:       &remoteSessionId,
-	}
-	requestBody := DataChannelRequests{
-		DataChannels: []DataChannelRequest{dataChannel},
+		// A trace context passed in by the caller is continued, including
+		// its sampling decision. An invalid one starts a new trace.
+		if traceparent := os.Getenv("TRACEPARENT"); traceparent != "" {
+			ctx, err = contextWithTraceparent(ctx, traceparent)
+			if err != nil {
+				log.Printf("ignoring TRACEPARENT: %v", err)
+			}
+		}
 	}
-	var response DataChannelResponses
-
-	err := httpApiCaller(endpoint, apiToken, requestBody, http.StatusOK, &response)
-	if err != nil {
-		return 0, fmt.Errorf("error making data channel subscribe HTTP API call: %v", err)
+	// shutdownTracing exports the remaining spans.
+	shutdownTracing := func(ctx context.Context) {
+		if tracerProvider == nil {
+			return
+		}
+		if err := tracerProvider.Shutdown(ctx); err != nil {
+			log.Printf("error exporting spans: %v", err)
+		}
 	}
 
-	return response.DataChannels[0].Id, nil
-}
-
-func createNewWebrtcConfiguration(apiToken string, accountID string) webrtc.Configuration {
-	// Fetch TURN credentials from Cloudflare API.
-	username, credential, err := getCloudflareTurnCredentials(apiToken, accountID)
-	if err != nil {
-		log.Fatalf("error fetching TURN credentials: %v", err)
-	}
-	log.Printf("Received from Cloudflare API username: %v, credential: %v", username, credential)
+	// Every step of setting up the sessions gets a span below this one.
+	setupCtx, setupSpan := tracer.Start(ctx, "session setup")
 
-	// Set up Cloudflare TURN server configuration with the relay-only policy.
-	return webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{
-					// TODO these should get extracted from the API call as well
-					// instead of being hard coded.
-					"turn:turn.cloudflare.com:3478?transport=udp",
-					"turn:turn.cloudflare.com:3478?transport=tcp",
-					"turns:turn.cloudflare.com:5349?transport=tcp",
-				},
-				// Use the credentials from Cloudflare API.
-				Username:   username,
-				Credential: credential,
-			},
-		},
-		ICETransportPolicy: webrtc.ICETransportPolicyRelay, // Enforce relay-only.
-	}
-}
+	// The credentials get shared by both PeerConnections. They are
+	// restricted to the TURN transport selected with -ice-transport-policy.
+	// Pion's ICE agent keeps the credentials the PeerConnections were
+	// created with, so the supervisors rebuild the PeerConnections with the
+	// refreshed ones before they expire.
+	turnProvider := NewTurnCredentialProvider(func(ctx context.Context, ttl time.Duration) ([]calls.ICEServer, error) {
+		ctx, span := tracer.Start(ctx, "turn credentials")
+		servers, err := turnClient.GenerateICEServers(ctx, ttl)
+		if err == nil {
+			servers, err = filterTurnTransport(servers, cfg.TurnTransport)
+		}
+		endSpan(span, err)
+		return servers, err
+	}, cfg.TurnTTL)
+	turnProvider.OnRefresh = metrics.TurnRefresh
 
-func main() {
-	// Check if the required command-line arguments are provided.
-	if len(os.Args) != 5 {
-		fmt.Println("Usage: go run main.go <cloudflare_turn_api_token> <cloudflare_turn_account_id> <cloudflare_sfu_api_token> <cloudflare_sfu_appid>")
-		os.Exit(1)
+	// failSetup ends the setup span and exports it before exiting, as
+	// log.Fatalf skips the deferred calls.
+	failSetup := func(err error) {
+		endSpan(setupSpan, err)
+		shutdownTracing(ctx)
+		log.Fatalf("%v", err)
 	}
 
-	// Get the Cloudflare API token and account ID from the command line.
-	turnApiToken := os.Args[1]
-	turnAccountID := os.Args[2]
-	sfuApiToken := os.Args[3]
-	sfuAppID := os.Args[4]
-
 	// ==========================================================================================
 	// Create two PeerConnections which are only allowed to connect through the TURN relays each.
 	// ==========================================================================================
 
+	// Both peers get created and connected to their sessions the same way.
+	// Their supervisors follow the connection states and reconnect them
+	// once the setup is done.
+	setup := &sessionSetup{cfg: cfg, client: sfuClient, provider: turnProvider, metrics: metrics, tracer: tracer}
+	supervisor1 := NewReconnectSupervisor("peer1", reconnectPolicy(cfg))
+	supervisor2 := NewReconnectSupervisor("peer2", reconnectPolicy(cfg))
+
 	// Create the first RTCPeerConnection (peer1).
-	peer1, err := webrtc.NewPeerConnection(createNewWebrtcConfiguration(turnApiToken, turnAccountID))
+	peer1, watcher1, systemDataChannel1, err := setup.newPeer(setupCtx, "peer1", supervisor1)
 	if err != nil {
-		log.Fatalf("error creating peer1: %v", err)
+		failSetup(fmt.Errorf("error creating peer1: %w", err))
 	}
 	defer peer1.Close()
 
 	// Create the second RTCPeerConnection (peer2).
-	peer2, err := webrtc.NewPeerConnection(createNewWebrtcConfiguration(turnApiToken, turnAccountID))
+	peer2, watcher2, systemDataChannel2, err := setup.newPeer(setupCtx, "peer2", supervisor2)
 	if err != nil {
-		log.Fatalf("error creating peer2: %v", err)
+		failSetup(fmt.Errorf("error creating peer2: %w", err))
 	}
 	defer peer2.Close()
 
-	// ===============================================
-	// Set up ICE call backs for both PeerConnections.
-	// ===============================================
-
-	// Gather ICE candidates for peer1.
-	gatherComplete1 := make(chan struct{})
-	peer1.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-		if candidate == nil {
-			close(gatherComplete1)
-			return
-		}
-		candJson := candidate.ToJSON()
-		log.Printf("Peer1 gathered ICE candidate: %v", candJson)
-	})
-
-	peer1.OnICEConnectionStateChange(func(is webrtc.ICEConnectionState) {
-		log.Printf("Peer1 ICE connection state: %v", is)
-	})
-
-	connected1 := make(chan struct{})
-	peer1.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
-		log.Printf("Peer1 connection state: %v", pcs)
-		if pcs == webrtc.PeerConnectionStateConnected {
-			close(connected1)
-		}
-	})
-
-	// Gather ICE candidates for peer2.
-	gatherComplete2 := make(chan struct{})
-	peer2.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-		if candidate == nil {
-			close(gatherComplete2)
-			return
-		}
-		candJson := candidate.ToJSON()
-		log.Printf("Peer2 gathered ICE candidate: %v", candJson)
-	})
-
-	peer2.OnICEConnectionStateChange(func(is webrtc.ICEConnectionState) {
-		log.Printf("Peer2 ICE connection state: %v", is)
-	})
-
-	connected2 := make(chan struct{})
-	peer2.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
-		log.Printf("Peer2 connection state: %v", pcs)
-		if pcs == webrtc.PeerConnectionStateConnected {
-			close(connected2)
-		}
-	})
-
-	// ==============================================
-	// Set up data channels for both PeerConnections.
-	// ==============================================
-
-	// Create the system event data channels on peer1 and peer2.
-	// These are not (yet) used for anything.
-	systemDataChannel1, err := peer1.CreateDataChannel("server-events", nil)
-	if err != nil {
-		log.Fatalf("error creating data channel on peer1: %v", err)
-	}
-	systemDataChannel2, err := peer2.CreateDataChannel("server-events", nil)
-	if err != nil {
-		log.Fatalf("error creating data channel on peer2: %v", err)
-	}
-
-	// Send test messages to the SFU.
-	systemDataChannel1.OnOpen(func() {
-		log.Println("System data channel on peer1 opened")
-		err = systemDataChannel1.SendText("Hello from peer1!")
-		if err != nil {
-			log.Fatalf("error sending message from peer1: %v", err)
-		}
-	})
-	systemDataChannel2.OnOpen(func() {
-		log.Println("System data channel on peer2 opened")
-		err = systemDataChannel2.SendText("Hello from peer2!")
-		if err != nil {
-			log.Fatalf("error sending message from peer2: %v", err)
-		}
-	})
-
 	// =============================================
 	// Next we establish PeerConnection1 to the SFU.
 	// And start publishing a data channel.
 	// =============================================
 
-	// Create an offer from peer1.
-	offer1, err := peer1.CreateOffer(nil)
+	sfuSession1, err := setup.connect(setupCtx, "peer1", peer1, watcher1, systemDataChannel1)
 	if err != nil {
-		log.Fatalf("error creating offer peer1: %v", err)
+		failSetup(fmt.Errorf("error connecting peer1 to the SFU: %w", err))
 	}
+	sessionId1 := sfuSession1.ID
 
-	// Set peer1's local description.
-	err = peer1.SetLocalDescription(offer1)
-	if err != nil {
-		log.Fatalf("error setting local description for peer1: %v", err)
+	// Report which candidates peer1 got connected with. peer2 gets added
+	// once it is connected as well.
+	reporter := NewStatsReporter(os.Stdout, cfg.StatsJSON)
+	reporter.Add("peer1", peer1)
+	if err := reporter.Report(); err != nil {
+		log.Printf("%v", err)
 	}
 
-	// We wait here for gathering to finish, so that all the ICE
-	// candidates are included in the SDP offer.
-	fmt.Printf("waiting for gathering to finish for peer1\n")
-	<-gatherComplete1
-
-	sessionId1, sdpAnswer1, err := getCloudflareSfuSession(sfuApiToken, sfuAppID, peer1.LocalDescription().SDP)
+	// Messages from peer1 to peer2 go through a data channel published by
+	// peer1 on the SFU.
+	publishCtx, span := tracer.Start(setupCtx, "publish data channel", trace.WithAttributes(attribute.String("calls.session_id", sessionId1)))
+	publisher, err := sfuSession1.Bus.Publish(publishCtx, cfg.ChannelName)
+	endSpan(span, err)
 	if err != nil {
-		log.Fatalf("error requesting a session ID for peer1: %v", err)
+		failSetup(fmt.Errorf("error publishing data channel for peer1: %w", err))
 	}
-	fmt.Printf("sessionID for peer1: %v\n", sessionId1)
 
-	// Set peer1's remote description with the answer.
-	err = peer1.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sdpAnswer1})
+	// Publish an audio track from peer1 as well, which carries silence.
+	audioTrack, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, cfg.TrackName, "peer1")
 	if err != nil {
-		log.Fatalf("error setting remote description for peer1: %v", err)
-	}
-
-	log.Printf("Waiting for PeerConnection1 to connect to the SFU")
-	<-connected1
-
-	// For illustration purposes lets try to find the IP address and port
-	// number peer1 got connected to. Unfortunately Pion doesn't fill the
-	// SelectedCandidatePairID field of the TransportStats, so this is a little
-	// hacky workaround.
-	stats := peer1.GetStats()
-	for _, s := range stats {
-		switch stat := s.(type) {
-		case webrtc.ICECandidatePairStats:
-			if stat.State == webrtc.StatsICECandidatePairStateSucceeded && stat.Nominated {
-				remoteID := stat.RemoteCandidateID
-				for _, allStats := range stats {
-					switch allType := allStats.(type) {
-					case webrtc.ICECandidateStats:
-						if allType.Type == webrtc.StatsTypeRemoteCandidate &&
-							allType.ID == remoteID {
-							log.Printf("Peer1 is connected to IP(%s) Port(%d)", allType.IP, allType.Port)
-						}
-					default:
-					}
-				}
-			}
-		default:
-		}
+		failSetup(fmt.Errorf("error creating audio track on peer1: %w", err))
 	}
-
-	publisherId, err := publishDataChannel(sfuApiToken, sfuAppID, sessionId1, "channel-one")
+	publishCtx, span = tracer.Start(setupCtx, "publish tracks", trace.WithAttributes(attribute.String("calls.session_id", sessionId1)))
+	publishedMids, err := sfuSession1.PublishTracks(publishCtx, audioTrack)
+	endSpan(span, err)
 	if err != nil {
-		log.Fatalf("error publishing data channel request for peer1: %v", err)
+		failSetup(fmt.Errorf("error publishing tracks for peer1: %w", err))
 	}
-	fmt.Printf("publisher channel id: %v\n", publisherId)
-
-	negotiated := true
+	log.Printf("published tracks (name: mid): %v", publishedMids)
 
-	// Add the data channel to the PeerConnection.
-	publisherDataChannel, err := peer1.CreateDataChannel("channel-one",
-		&webrtc.DataChannelInit{
-			Negotiated: &negotiated,
-			ID:         &publisherId,
-		})
-	if err != nil {
-		log.Fatalf("error creating data channel on peer1: %v", err)
-	}
+	go func() {
+		if err := writeOpusSilence(ctx, audioTrack); err != nil && ctx.Err() == nil {
+			log.Printf("error writing audio on peer1: %v", err)
+		}
+	}()
 
 	// =====================================================
 	// Now it's time to establish the second PeerConnection.
 	// And subscribe to the data channel from peer 1.
 	// =====================================================
 
-	// Create an offer from peer2.
-	offer2, err := peer2.CreateOffer(nil)
-	if err != nil {
-		log.Fatalf("error creating offer for peer2: %v", err)
-	}
-
-	// Set peer2's local description.
-	err = peer2.SetLocalDescription(offer2)
+	sfuSession2, err := setup.connect(setupCtx, "peer2", peer2, watcher2, systemDataChannel2)
 	if err != nil {
-		log.Fatalf("error setting local description for peer2: %v", err)
+		failSetup(fmt.Errorf("error connecting peer2 to the SFU: %w", err))
 	}
+	sessionId2 := sfuSession2.ID
 
-	// We wait here for gathering to finish, so that all the ICE
-	// candidates are included in the SDP offer.
-	fmt.Printf("waiting for gathering to finish for peer2\n")
-	<-gatherComplete2
+	reporter.Add("peer2", peer2)
+	startStatsReporter(ctx, cfg, reporter)
 
-	sessionId2, sdpAnswer1, err := getCloudflareSfuSession(sfuApiToken, sfuAppID, peer2.LocalDescription().SDP)
+	subscribeCtx, span := tracer.Start(setupCtx, "subscribe data channel", trace.WithAttributes(attribute.String("calls.session_id", sessionId2)))
+	subscription, err := sfuSession2.Bus.Subscribe(subscribeCtx, sessionId1, cfg.ChannelName)
+	endSpan(span, err)
 	if err != nil {
-		log.Fatalf("error requesting a session ID for peer2: %v", err)
-	}
-	fmt.Printf("sessionID for peer2: %v\n", sessionId2)
-
-	// Set peer2's remote description with the answer.
-	err = peer2.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: sdpAnswer1})
-	if err != nil {
-		log.Fatalf("error setting remote description for peer2: %v", err)
-	}
-
-	log.Printf("Waiting for PeerConnection2 to connect to the SFU")
-	<-connected2
-
-	subscriberId, err := subscribeDataChannel(sfuApiToken, sfuAppID, sessionId2, sessionId1, "channel-one")
+		failSetup(fmt.Errorf("error subscribing to data channel from peer1 on peer2: %w", err))
+	}
+	go func() {
+		for {
+			select {
+			case msg := <-subscription.Messages():
+				log.Printf("peer 2 received: %v\n", string(msg))
+			case <-subscription.Done():
+				log.Printf("subscribed data channel %q on peer2 closed", cfg.ChannelName)
+				return
+			}
+		}
+	}()
+
+	// Receive the audio track published by peer1. The handler has to be in
+	// place before the renegotiation adds the track to peer2.
+	sfuSession2.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		log.Printf("peer2 receiving %s track %q from stream %q", track.Kind(), track.ID(), track.StreamID())
+		var packets int
+		for {
+			if _, _, err := track.ReadRTP(); err != nil {
+				log.Printf("peer2 stopped receiving track %q after %d packets: %v", track.ID(), packets, err)
+				return
+			}
+			packets++
+		}
+	})
+	sfuSession2.OnTrackEnded(func(trackName string) {
+		log.Printf("peer1 closed track %q subscribed by peer2", trackName)
+	})
+	subscribeCtx, span = tracer.Start(setupCtx, "subscribe tracks", trace.WithAttributes(attribute.String("calls.session_id", sessionId2)))
+	subscribedMids, err := sfuSession2.SubscribeTracks(subscribeCtx, sessionId1, cfg.TrackName)
+	endSpan(span, err)
 	if err != nil {
-		log.Fatalf("error subscribing to data channel from peer1 on peer2: %v", err)
-	}
-	log.Printf("subscribed channel id: %v\n", subscriberId)
-
-	subscriberDataChannel, err := peer2.CreateDataChannel("channel-one-subscribed",
-		&webrtc.DataChannelInit{
-			Negotiated: &negotiated,
-			ID:         &subscriberId,
+		failSetup(fmt.Errorf("error subscribing to tracks from peer1 on peer2: %w", err))
+	}
+	log.Printf("subscribed tracks (name: mid): %v", subscribedMids)
+	setupSpan.End()
+
+	// A rebuilt peer1 publishes its track and data channel from a new
+	// session, which peer2 then subscribes to instead. The peers get rebuilt
+	// one after the other, so that peer2 doesn't resubscribe while it is
+	// being rebuilt itself.
+	var rebuilding sync.Mutex
+	superviseSession(ctx, supervisor1, sfuSession1, func(ctx context.Context) error {
+		rebuilding.Lock()
+		defer rebuilding.Unlock()
+		return setup.rebuild(ctx, "peer1", sfuSession1, supervisor1, func(ctx context.Context, oldSessionId string) error {
+			reporter.Add("peer1", sfuSession1.PC)
+			return sfuSession2.Resubscribe(ctx, oldSessionId, sfuSession1.ID)
 		})
-
-	subscriberDataChannel.OnOpen(func() {
-		log.Printf("subscribed data channel opened on peer2\n")
 	})
-	subscriberDataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
-		log.Printf("peer 2 received: %v\n", string(msg.Data))
+	superviseSession(ctx, supervisor2, sfuSession2, func(ctx context.Context) error {
+		rebuilding.Lock()
+		defer rebuilding.Unlock()
+		return setup.rebuild(ctx, "peer2", sfuSession2, supervisor2, func(context.Context, string) error {
+			reporter.Add("peer2", sfuSession2.PC)
+			return nil
+		})
 	})
 
-	// Read from the console and send messages from peer1 to peer2.
-	reader := bufio.NewReader(os.Stdin)
-	for {
-		fmt.Print("Enter message to send from peer1 (\"exit\" to quit): ")
-		msg, _ := reader.ReadString('\n')
-		msg = strings.TrimSpace(msg)
-
-		if msg == "exit" {
-			log.Println("Exiting...")
-			break
+	// Refresh the credentials in the background before they expire, and
+	// rebuild the peers with them.
+	turnProvider.OnRenew = func(expiry time.Time) {
+		supervisor1.Renew(expiry)
+		supervisor2.Renew(expiry)
+	}
+	go turnProvider.Run(ctx)
+
+	// Read from the console and send messages from peer1 to peer2, until
+	// "exit" is entered or a signal is received.
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		reader := bufio.NewReader(os.Stdin)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- strings.TrimSpace(line)
 		}
+	}()
+	fmt.Print("Enter message to send from peer1 (\"exit\" to quit): ")
+loop:
+	for {
+		select {
+		case msg, ok := <-lines:
+			if !ok || msg == "exit" {
+				log.Println("Exiting...")
+				break loop
+			}
 
-		if publisherDataChannel.ReadyState() == webrtc.DataChannelStateOpen {
-			err = publisherDataChannel.SendText(msg)
-			if err != nil {
+			// Messages are queued until the data channel is open.
+			if _, err := publisher.Write([]byte(msg)); err != nil {
 				log.Printf("error sending message from peer1: %v", err)
 			}
-		} else {
-			log.Println("Data channel is not open.  Cannot send message.")
+			fmt.Print("Enter message to send from peer1 (\"exit\" to quit): ")
+		case <-ctx.Done():
+			log.Println("Received signal, shutting down...")
+			break loop
 		}
 	}
+	stop()
 
-	// Close the data channels and peer connections.  These will be closed
-	// automatically by the defer statements, but it's good to be explicit.
-	if systemDataChannel1 != nil {
-		systemDataChannel1.Close()
-	}
-	if systemDataChannel2 != nil {
-		systemDataChannel2.Close()
+	// Close the sessions, which sends the buffered messages, closes the
+	// tracks on the SFU and closes the data channels and PeerConnections.
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancelShutdown()
+	if err := sfuSession2.Close(shutdownCtx); err != nil {
+		log.Printf("error closing session of peer2: %v", err)
 	}
-	if publisherDataChannel != nil {
-		systemDataChannel1.Close()
+	if err := sfuSession1.Close(shutdownCtx); err != nil {
+		log.Printf("error closing session of peer1: %v", err)
 	}
-	if subscriberDataChannel != nil {
-		subscriberDataChannel.Close()
-	}
-
-	peer1.Close()
-	peer2.Close()
+	shutdownTracing(shutdownCtx)
 }
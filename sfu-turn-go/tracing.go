@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of the spans of the session setup.
+const tracerName = "github.com/cloudflare/calls-examples/sfu-turn-go"
+
+// newTracerProvider returns a TracerProvider which exports its spans in
+// batches to the OpenTelemetry collector at endpoint with OTLP/HTTP, e.g.
+// http://localhost:4318. Spans with a remote parent follow its sampling
+// decision, all other traces are sampled.
+func newTracerProvider(ctx context.Context, endpoint string, client *http.Client) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(ctx,
+		otlptracehttp.WithEndpointURL(strings.TrimSuffix(endpoint, "/")+"/v1/traces"),
+		otlptracehttp.WithHTTPClient(client))
+	if err != nil {
+		return nil, fmt.Errorf("error creating OTLP exporter: %w", err)
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "sfu-turn-go"))),
+	), nil
+}
+
+// tracingTransport propagates the W3C trace context of the request context
+// on every request sent by base, and records a client span for it.
+func tracingTransport(base http.RoundTripper, provider trace.TracerProvider) http.RoundTripper {
+	return otelhttp.NewTransport(base,
+		otelhttp.WithTracerProvider(provider),
+		otelhttp.WithPropagators(propagation.TraceContext{}))
+}
+
+// contextWithTraceparent returns a context in which new spans continue the
+// trace of a W3C traceparent value, e.g. passed in by the caller through the
+// TRACEPARENT environment variable. An invalid value is reported and ctx is
+// returned unchanged.
+func contextWithTraceparent(ctx context.Context, traceparent string) (context.Context, error) {
+	remote := propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{"traceparent": traceparent})
+	if !trace.SpanContextFromContext(remote).IsValid() {
+		return ctx, fmt.Errorf("invalid traceparent %q", traceparent)
+	}
+	return remote, nil
+}
+
+// endSpan records err, if any, as the status of span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSetupSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	setup := &sessionSetup{tracer: provider.Tracer(tracerName)}
+
+	ctx, root := setup.startSpan(context.Background(), "session setup")
+	_, child := setup.startSpan(ctx, "sessions/new")
+	endSpan(child, errors.New("failed"))
+	endSpan(root, nil)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("recorded %d spans, want 2", len(spans))
+	}
+	c, r := spans[0], spans[1]
+	if c.Parent().SpanID() != r.SpanContext().SpanID() || c.SpanContext().TraceID() != r.SpanContext().TraceID() {
+		t.Errorf("span %q is not a child of %q", c.Name(), r.Name())
+	}
+	if c.Status().Code != codes.Error || c.Status().Description != "failed" || len(c.Events()) != 1 {
+		t.Errorf("child ended with status %+v and events %v, want the error", c.Status(), c.Events())
+	}
+	if r.Status().Code != codes.Unset {
+		t.Errorf("root ended with status %+v", r.Status())
+	}
+
+	// Without a tracer no spans are recorded.
+	_, span := (&sessionSetup{}).startSpan(context.Background(), "session setup")
+	if span.SpanContext().IsValid() {
+		t.Error("span recorded without a tracer")
+	}
+}
+
+func TestContextWithTraceparent(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(recorder),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())))
+	tracer := provider.Tracer(tracerName)
+
+	for _, tc := range []struct {
+		traceparent string
+		sampled     bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", false},
+	} {
+		ctx, err := contextWithTraceparent(context.Background(), tc.traceparent)
+		if err != nil {
+			t.Fatalf("contextWithTraceparent(%q) failed: %v", tc.traceparent, err)
+		}
+		_, span := tracer.Start(ctx, "session setup")
+		sc := span.SpanContext()
+		span.End()
+		if sc.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("span of %q got trace ID %s", tc.traceparent, sc.TraceID())
+		}
+		if sc.IsSampled() != tc.sampled {
+			t.Errorf("span of %q sampled: %v, want %v", tc.traceparent, sc.IsSampled(), tc.sampled)
+		}
+	}
+	if len(recorder.Ended()) != 1 {
+		t.Errorf("recorded %d spans, want only the sampled one", len(recorder.Ended()))
+	}
+
+	for _, traceparent := range []string{"", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", "01-4bf92f3577b34da6a3ce929d0e0e4736"} {
+		ctx := context.Background()
+		if got, err := contextWithTraceparent(ctx, traceparent); err == nil || got != ctx {
+			t.Errorf("contextWithTraceparent(%q) = %v, %v; want an error", traceparent, got, err)
+		}
+	}
+}
+
+func TestTracingTransport(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+	}))
+	defer server.Close()
+
+	provider := sdktrace.NewTracerProvider()
+	client := &http.Client{Transport: tracingTransport(http.DefaultTransport, provider)}
+	ctx, span := provider.Tracer(tracerName).Start(context.Background(), "sessions/new")
+	defer span.End()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	traceparent := (<-headers).Get("traceparent")
+	want := "00-" + span.SpanContext().TraceID().String() + "-"
+	if len(traceparent) != 55 || traceparent[:36] != want || traceparent[53:] != "01" {
+		t.Errorf("traceparent %q is not part of trace %s", traceparent, span.SpanContext().TraceID())
+	}
+	if traceparent[36:52] == span.SpanContext().SpanID().String() {
+		t.Error("request is not sent in a client span of its own")
+	}
+	if req.Header.Get("traceparent") != "" {
+		t.Error("transport modified the request")
+	}
+}
+
+func TestNewTracerProvider(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+	}))
+	defer collector.Close()
+
+	provider, err := newTracerProvider(context.Background(), collector.URL+"/", collector.Client())
+	if err != nil {
+		t.Fatalf("newTracerProvider failed: %v", err)
+	}
+	_, span := provider.Tracer(tracerName).Start(context.Background(), "session setup")
+	span.End()
+	if err := provider.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	select {
+	case r := <-requests:
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("unexpected export request %s %s (%s)", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+		}
+	default:
+		t.Error("no spans exported on shutdown")
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cloudflare/calls-examples/sfu-turn-go/calls"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// publishTracks adds the local tracks to the PeerConnection and publishes
+// them on the SFU with a tracks/new request. The track IDs are used as the
+// track names on the SFU. The returned map holds the mid of every published
+// track, keyed by track name. If single tracks fail, the mids of the
+// others are returned together with an error. If the whole request fails,
+// the offer is rolled back and the tracks are removed again, so that later
+// negotiations start from a stable state again.
+func publishTracks(ctx context.Context, client *calls.Client, pc *webrtc.PeerConnection, sessionId string, tracks ...*webrtc.TrackLocalStaticSample) (map[string]string, error) {
+	transceivers := make([]*webrtc.RTPTransceiver, 0, len(tracks))
+	offered := false
+	fail := func(err error) (map[string]string, error) {
+		if offered {
+			err = rollbackOffer(pc, err)
+		}
+		for _, transceiver := range transceivers {
+			if removeErr := pc.RemoveTrack(transceiver.Sender()); removeErr != nil {
+				err = errors.Join(err, fmt.Errorf("error removing track: %w", removeErr))
+			}
+		}
+		return nil, err
+	}
+
+	for _, track := range tracks {
+		transceiver, err := pc.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionSendonly,
+		})
+		if err != nil {
+			return fail(fmt.Errorf("error adding track %q: %w", track.ID(), err))
+		}
+		transceivers = append(transceivers, transceiver)
+
+		// Read incoming RTCP packets. Before these packets are returned
+		// they are processed by interceptors, e.g. for NACK handling.
+		go func() {
+			rtcpBuf := make([]byte, 1500)
+			for {
+				if _, _, err := transceiver.Sender().Read(rtcpBuf); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return fail(fmt.Errorf("error creating offer: %w", err))
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return fail(fmt.Errorf("error setting local description: %w", err))
+	}
+	offered = true
+	if err := waitGathering(ctx, gatherComplete); err != nil {
+		return fail(err)
+	}
+
+	// The mids only get assigned when setting the local description, so
+	// the mid to track name mapping can only be built now.
+	mids := make(map[string]string, len(tracks))
+	request := calls.NewTracksRequest{
+		SessionDescription: &calls.SessionDescription{
+			Type: "offer",
+			Sdp:  pc.LocalDescription().SDP,
+		},
+	}
+	for i, transceiver := range transceivers {
+		trackName := tracks[i].ID()
+		mids[trackName] = transceiver.Mid()
+		request.Tracks = append(request.Tracks, calls.TrackLocator{
+			Location:  "local",
+			Mid:       transceiver.Mid(),
+			TrackName: trackName,
+		})
+	}
+
+	response, err := client.NewTracks(ctx, sessionId, request)
+	if err != nil {
+		return fail(err)
+	}
+	if response.ErrorCode != "" {
+		return fail(response.Err())
+	}
+	if response.SessionDescription == nil {
+		return fail(fmt.Errorf("new tracks response did not contain an answer"))
+	}
+
+	err = pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  response.SessionDescription.Sdp,
+	})
+	if err != nil {
+		return fail(fmt.Errorf("error setting remote description: %w", err))
+	}
+
+	return mids, trackErrors(response, mids)
+}
+
+// subscribeTracks subscribes the session to tracks published by the remote
+// session. The SFU answers with an offer for the new tracks, which gets
+// answered right away. Incoming tracks are delivered through the OnTrack
+// handler of the PeerConnection. The returned map holds the mid of every
+// subscribed track, keyed by track name. Like with publishTracks, the
+// failure of single tracks doesn't affect the others.
+func subscribeTracks(ctx context.Context, client *calls.Client, pc *webrtc.PeerConnection, sessionId, remoteSessionId string, trackNames ...string) (map[string]string, error) {
+	request := calls.NewTracksRequest{}
+	for _, trackName := range trackNames {
+		request.Tracks = append(request.Tracks, calls.TrackLocator{
+			Location:  "remote",
+			SessionId: &remoteSessionId,
+			TrackName: trackName,
+		})
+	}
+
+	response, err := client.NewTracks(ctx, sessionId, request)
+	if err != nil {
+		return nil, err
+	}
+	if response.ErrorCode != "" {
+		return nil, response.Err()
+	}
+
+	mids := make(map[string]string, len(response.Tracks))
+	for _, track := range response.Tracks {
+		mids[track.TrackName] = track.Mid
+	}
+	tracksErr := trackErrors(response, mids)
+
+	// Pulling tracks always requires a renegotiation, as the SFU has to
+	// add new transceivers to the session.
+	if response.RequiresImmediateRenegotiation {
+		if err := answerRenegotiation(ctx, client, pc, sessionId, response.SessionDescription); err != nil {
+			return nil, err
+		}
+	}
+
+	return mids, tracksErr
+}
+
+// trackErrors removes the tracks which failed on the SFU from mids and
+// returns their errors.
+func trackErrors(response *calls.NewTracksResponse, mids map[string]string) error {
+	var errs []error
+	for _, track := range response.Tracks {
+		if err := track.Err(); err != nil {
+			delete(mids, track.TrackName)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// closeTracks closes the tracks with the given mids on the SFU. Their
+// transceivers get stopped, and the resulting offer is sent along with the
+// tracks/close request. The answer of the SFU completes the renegotiation.
+func closeTracks(ctx context.Context, client *calls.Client, pc *webrtc.PeerConnection, sessionId string, mids ...string) error {
+	request := calls.CloseTracksRequest{}
+	for _, mid := range mids {
+		transceiver := transceiverByMid(pc, mid)
+		if transceiver == nil {
+			return fmt.Errorf("no transceiver with mid %q", mid)
+		}
+		if err := transceiver.Stop(); err != nil {
+			return fmt.Errorf("error stopping transceiver with mid %q: %w", mid, err)
+		}
+		request.Tracks = append(request.Tracks, calls.CloseTrackObject{Mid: mid})
+	}
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return fmt.Errorf("error creating offer: %w", err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("error setting local description: %w", err)
+	}
+	if err := waitGathering(ctx, gatherComplete); err != nil {
+		return rollbackOffer(pc, err)
+	}
+	request.SessionDescription = &calls.SessionDescription{
+		Type: "offer",
+		Sdp:  pc.LocalDescription().SDP,
+	}
+
+	response, err := client.CloseTracks(ctx, sessionId, request)
+	if err != nil {
+		return rollbackOffer(pc, err)
+	}
+	if err := response.Err(); err != nil {
+		return rollbackOffer(pc, err)
+	}
+	if response.SessionDescription == nil {
+		return rollbackOffer(pc, fmt.Errorf("close tracks response did not contain an answer"))
+	}
+
+	err = pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  response.SessionDescription.Sdp,
+	})
+	if err != nil {
+		return fmt.Errorf("error setting remote description: %w", err)
+	}
+	return nil
+}
+
+// transceiverByMid returns the transceiver of the PeerConnection with the
+// given mid, or nil if there is none.
+func transceiverByMid(pc *webrtc.PeerConnection, mid string) *webrtc.RTPTransceiver {
+	for _, transceiver := range pc.GetTransceivers() {
+		if transceiver.Mid() == mid {
+			return transceiver
+		}
+	}
+	return nil
+}
+
+// answerRenegotiation applies an offer from the SFU as remote description,
+// answers it and sends the answer back to the SFU.
+func answerRenegotiation(ctx context.Context, client *calls.Client, pc *webrtc.PeerConnection, sessionId string, offer *calls.SessionDescription) error {
+	if offer == nil {
+		return fmt.Errorf("renegotiation required but no offer received from the SFU")
+	}
+
+	err := pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offer.Sdp,
+	})
+	if err != nil {
+		return fmt.Errorf("error setting remote description: %w", err)
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return fmt.Errorf("error creating answer: %w", err)
+	}
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return fmt.Errorf("error setting local description: %w", err)
+	}
+
+	response, err := client.Renegotiate(ctx, sessionId, calls.SessionDescription{
+		Type: "answer",
+		Sdp:  answer.SDP,
+	})
+	if err != nil {
+		return err
+	}
+	return response.Err()
+}
+
+// offerRenegotiation sends a new offer for the session and applies the
+// answer of the SFU. The offer contains all ICE candidates gathered so far,
+// for an ICE restart requested by options it waits for the new candidates
+// to be gathered. If the SFU doesn't answer, the offer is rolled back so
+// that later negotiations start from a stable state again.
+//
+// The offer is sent with a tracks/new request without tracks, which is
+// where the API takes offers of the client. Renegotiate requests only
+// carry answers to offers of the SFU.
+func offerRenegotiation(ctx context.Context, client *calls.Client, pc *webrtc.PeerConnection, sessionId string, options *webrtc.OfferOptions) error {
+	offer, err := pc.CreateOffer(options)
+	if err != nil {
+		return fmt.Errorf("error creating offer: %w", err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("error setting local description: %w", err)
+	}
+
+	var response *calls.NewTracksResponse
+	if options != nil && options.ICERestart {
+		err = waitGathering(ctx, gatherComplete)
+	}
+	if err == nil {
+		response, err = client.NewTracks(ctx, sessionId, calls.NewTracksRequest{
+			SessionDescription: &calls.SessionDescription{
+				Type: "offer",
+				Sdp:  pc.LocalDescription().SDP,
+			},
+			Tracks: []calls.TrackLocator{},
+		})
+	}
+	if err == nil {
+		err = response.Err()
+	}
+	if err == nil && response.SessionDescription == nil {
+		err = errors.New("no answer received from the SFU")
+	}
+	if err != nil {
+		return rollbackOffer(pc, err)
+	}
+
+	err = pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  response.SessionDescription.Sdp,
+	})
+	if err != nil {
+		return fmt.Errorf("error setting remote description: %w", err)
+	}
+	return nil
+}
+
+// waitGathering waits until ICE gathering is complete or ctx is done.
+func waitGathering(ctx context.Context, gatherComplete <-chan struct{}) error {
+	select {
+	case <-gatherComplete:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("error waiting for ICE gathering: %w", ctx.Err())
+	}
+}
+
+// rollbackOffer rolls back the pending local offer after the negotiation
+// failed with err, so that later negotiations start from a stable state
+// again. Pion doesn't implement rollbacks, so the offer gets completed with
+// the last answer of the SFU instead, which keeps the media sections and
+// ICE credentials the SFU knows about.
+func rollbackOffer(pc *webrtc.PeerConnection, err error) error {
+	answer := pc.CurrentRemoteDescription()
+	if answer == nil {
+		return errors.Join(err, errors.New("error rolling back offer: no previous answer"))
+	}
+	if rollbackErr := pc.SetRemoteDescription(*answer); rollbackErr != nil {
+		return errors.Join(err, fmt.Errorf("error rolling back offer: %w", rollbackErr))
+	}
+	return err
+}
+
+// opusSilence is a single Opus frame containing 20ms of silence.
+var opusSilence = []byte{0xf8, 0xff, 0xfe}
+
+// writeOpusSilence keeps writing silent Opus frames to the track until ctx
+// is done, so that there is some media flowing through the SFU.
+func writeOpusSilence(ctx context.Context, track *webrtc.TrackLocalStaticSample) error {
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := track.WriteSample(media.Sample{Data: opusSilence, Duration: 20 * time.Millisecond}); err != nil {
+				return fmt.Errorf("error writing sample: %w", err)
+			}
+		}
+	}
+}
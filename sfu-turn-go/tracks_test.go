@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/calls-examples/sfu-turn-go/calls"
+	"github.com/cloudflare/calls-examples/sfu-turn-go/calls/callstest"
+	"github.com/pion/webrtc/v3"
+)
+
+// connectSession creates a PeerConnection, establishes a new session for it
+// on the SFU and waits until it is connected.
+func connectSession(t *testing.T, ctx context.Context, api *webrtc.API, client *calls.Client) (*webrtc.PeerConnection, string) {
+	t.Helper()
+	pc, sessionId, _ := connectSessionWithEvents(t, ctx, api, client)
+	return pc, sessionId
+}
+
+// connectSessionWithEvents is like connectSession, but also returns the
+// server-events data channel.
+func connectSessionWithEvents(t *testing.T, ctx context.Context, api *webrtc.API, client *calls.Client) (*webrtc.PeerConnection, string, *webrtc.DataChannel) {
+	t.Helper()
+
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("error creating PeerConnection: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	connected := make(chan struct{})
+	pc.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
+		if pcs == webrtc.PeerConnectionStateConnected {
+			close(connected)
+		}
+	})
+
+	// Like in main the server-events channel makes sure the offer contains
+	// an application section for the data channels.
+	serverEvents, err := pc.CreateDataChannel(calls.ServerEventsLabel, nil)
+	if err != nil {
+		t.Fatalf("error creating data channel: %v", err)
+	}
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("error creating offer: %v", err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatalf("error setting local description: %v", err)
+	}
+	<-gatherComplete
+
+	session, err := client.NewSession(ctx, &calls.SessionDescription{Type: "offer", Sdp: pc.LocalDescription().SDP})
+	if err != nil {
+		t.Fatalf("error creating session: %v", err)
+	}
+	err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: session.Description.Sdp})
+	if err != nil {
+		t.Fatalf("error setting remote description: %v", err)
+	}
+
+	select {
+	case <-connected:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the PeerConnection to connect")
+	}
+	return pc, session.SessionId, serverEvents
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	sfu := callstest.NewServer()
+	defer sfu.Close()
+	client := sfu.Client()
+	api := callstest.NewAPI()
+
+	publisher, publisherSession := connectSession(t, ctx, api, client)
+	subscriber, subscriberSession := connectSession(t, ctx, api, client)
+
+	// Publish a data channel and an audio track.
+	negotiated := true
+	published, err := client.PublishDataChannels(ctx, publisherSession, "channel-one")
+	if err != nil || published[0].Err != nil {
+		t.Fatalf("error publishing data channel: %v %v", err, published)
+	}
+	publisherId := published[0].Id
+	publisherChannel, err := publisher.CreateDataChannel("channel-one", &webrtc.DataChannelInit{
+		Negotiated: &negotiated,
+		ID:         &publisherId,
+	})
+	if err != nil {
+		t.Fatalf("error creating publisher data channel: %v", err)
+	}
+
+	audioTrack, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio-one", "publisher")
+	if err != nil {
+		t.Fatalf("error creating audio track: %v", err)
+	}
+	mids, err := publishTracks(ctx, client, publisher, publisherSession, audioTrack)
+	if err != nil {
+		t.Fatalf("error publishing tracks: %v", err)
+	}
+	if mids["audio-one"] == "" {
+		t.Fatalf("no mid returned for the published track: %v", mids)
+	}
+	go writeOpusSilence(ctx, audioTrack)
+
+	// Subscribe to both of them. Subscribing to a channel which doesn't
+	// exist must only fail that channel.
+	subscribed, err := client.SubscribeDataChannels(ctx, subscriberSession,
+		calls.RemoteDataChannel{SessionId: publisherSession, Name: "channel-one"},
+		calls.RemoteDataChannel{SessionId: publisherSession, Name: "missing"})
+	if err != nil {
+		t.Fatalf("error subscribing data channels: %v", err)
+	}
+	if len(subscribed) != 2 || subscribed[0].Err != nil || subscribed[1].Err == nil {
+		t.Fatalf("expected only the missing channel to fail: %+v", subscribed)
+	}
+	subscriberId := subscribed[0].Id
+	subscriberChannel, err := subscriber.CreateDataChannel("channel-one-subscribed", &webrtc.DataChannelInit{
+		Negotiated: &negotiated,
+		ID:         &subscriberId,
+	})
+	if err != nil {
+		t.Fatalf("error creating subscriber data channel: %v", err)
+	}
+	messages := make(chan string, 100)
+	subscriberChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		messages <- string(msg.Data)
+	})
+
+	packets := make(chan string, 1)
+	subscriber.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		if _, _, err := track.ReadRTP(); err == nil {
+			packets <- track.ID()
+		}
+	})
+	subscribedMids, err := subscribeTracks(ctx, client, subscriber, subscriberSession, publisherSession, "audio-one", "missing")
+	if err == nil || !strings.Contains(err.Error(), `"missing"`) {
+		t.Fatalf("expected an error for the missing track, got %v", err)
+	}
+	if _, ok := subscribedMids["missing"]; ok || subscribedMids["audio-one"] == "" {
+		t.Fatalf("expected only a mid for audio-one: %v", subscribedMids)
+	}
+
+	select {
+	case id := <-packets:
+		if id != "audio-one" {
+			t.Fatalf("received track %q, want audio-one", id)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for RTP from the subscribed track")
+	}
+
+	// The SFU drops messages while the subscriber channel isn't open yet,
+	// so keep sending until the first one makes it through.
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case msg := <-messages:
+			if msg != "hello" {
+				t.Fatalf("received %q, want hello", msg)
+			}
+			return
+		case <-ticker.C:
+			if publisherChannel.ReadyState() == webrtc.DataChannelStateOpen {
+				if err := publisherChannel.SendText("hello"); err != nil {
+					t.Fatalf("error sending message: %v", err)
+				}
+			}
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for the data channel message")
+		}
+	}
+}
+
+func TestPublishTracksRollback(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	sfu := callstest.NewServer()
+	defer sfu.Close()
+	client := sfu.Client()
+	pc, sessionId := connectSession(t, ctx, callstest.NewAPI(), client)
+
+	audioTrack, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio-one", "publisher")
+	if err != nil {
+		t.Fatalf("error creating audio track: %v", err)
+	}
+	if _, err := publishTracks(ctx, client, pc, "missing-session", audioTrack); err == nil {
+		t.Fatal("expected publishing to an unknown session to fail")
+	}
+	if state := pc.SignalingState(); state != webrtc.SignalingStateStable {
+		t.Errorf("signaling state is %s after the failed publish", state)
+	}
+	for _, transceiver := range pc.GetTransceivers() {
+		if transceiver.Sender() != nil && transceiver.Sender().Track() != nil {
+			t.Errorf("track %s is still sent after the failed publish", transceiver.Sender().Track().ID())
+		}
+	}
+
+	// The session can still publish the track afterwards.
+	if _, err := publishTracks(ctx, client, pc, sessionId, audioTrack); err != nil {
+		t.Fatalf("error publishing after the failed publish: %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cloudflare/calls-examples/sfu-turn-go/calls"
+)
+
+func TestTurnURLTransport(t *testing.T) {
+	for url, want := range map[string]string{
+		"turn:turn.example.com:3478?transport=udp": "udp",
+		"turn:turn.example.com:3478":               "udp",
+		"turn:turn.example.com:80?transport=tcp":   "tcp",
+		"turns:turn.example.com:443?transport=tcp": "tls",
+		"TURNS:turn.example.com:5349":              "tls",
+		"stun:stun.example.com:3478":               "",
+	} {
+		if got := turnURLTransport(url); got != want {
+			t.Errorf("transport of %s is %q, want %q", url, got, want)
+		}
+	}
+}
+
+func TestFilterTurnTransport(t *testing.T) {
+	servers := []calls.ICEServer{
+		{URLs: []string{"stun:stun.example.com:3478"}},
+		{
+			URLs: []string{
+				"turn:turn.example.com:3478?transport=udp",
+				"turn:turn.example.com:3478?transport=tcp",
+				"turns:turn.example.com:443?transport=tcp",
+			},
+			Username:   "user",
+			Credential: "secret",
+		},
+	}
+
+	if all, err := filterTurnTransport(servers, ""); err != nil || !reflect.DeepEqual(all, servers) {
+		t.Errorf("filtering without a transport returned %v, %v", all, err)
+	}
+	tls, err := filterTurnTransport(servers, turnTransportTLS)
+	if err != nil {
+		t.Fatalf("error filtering: %v", err)
+	}
+	want := []calls.ICEServer{{URLs: []string{"turns:turn.example.com:443?transport=tcp"}, Username: "user", Credential: "secret"}}
+	if !reflect.DeepEqual(tls, want) {
+		t.Errorf("filtered %v, want %v", tls, want)
+	}
+	if len(servers[1].URLs) != 3 {
+		t.Error("filtering modified the ICE servers")
+	}
+
+	if _, err := filterTurnTransport(servers[:1], turnTransportUDP); err == nil {
+		t.Error("expected an error without any TURN URLs left")
+	}
+}
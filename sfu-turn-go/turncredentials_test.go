@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/calls-examples/sfu-turn-go/calls"
+)
+
+type fakeTimer struct {
+	d  time.Duration
+	ch chan time.Time
+}
+
+// fakeClock only advances when a test fires one of the pending timers.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers chan fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		timers: make(chan fakeTimer, 1),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.timers <- fakeTimer{d: d, ch: ch}
+	return ch
+}
+
+// next waits for the next pending timer.
+func (c *fakeClock) next(t *testing.T) fakeTimer {
+	t.Helper()
+	select {
+	case timer := <-c.timers:
+		return timer
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a timer")
+		return fakeTimer{}
+	}
+}
+
+// fire advances the clock past the given timer and fires it.
+func (c *fakeClock) fire(timer fakeTimer) time.Duration {
+	c.mu.Lock()
+	c.now = c.now.Add(timer.d)
+	now := c.now
+	c.mu.Unlock()
+	timer.ch <- now
+	return timer.d
+}
+
+func TestTurnCredentialProviderRefresh(t *testing.T) {
+	clock := newFakeClock()
+	fetches := make(chan time.Duration, 10)
+	var count int
+	fetch := func(ctx context.Context, ttl time.Duration) ([]calls.ICEServer, error) {
+		count++
+		fetches <- ttl
+		return []calls.ICEServer{
+			{URLs: []string{"stun:stun.cloudflare.com:3478"}},
+			{
+				URLs:       []string{"turn:turn.cloudflare.com:3478?transport=udp"},
+				Username:   fmt.Sprintf("user-%d", count),
+				Credential: "secret",
+			},
+		}, nil
+	}
+
+	ttl := 100 * time.Second
+	provider := NewTurnCredentialProvider(fetch, ttl)
+	provider.Clock = clock
+	provider.RefreshFraction = 0.5
+	renewals := make(chan time.Time, 10)
+	provider.OnRenew = func(expiry time.Time) { renewals <- expiry }
+
+	start := clock.Now()
+	servers, err := provider.ICEServers(context.Background())
+	if err != nil {
+		t.Fatalf("ICEServers failed: %v", err)
+	}
+	if len(servers) != 2 || servers[0].Username != "" || servers[1].Username != "user-1" {
+		t.Fatalf("unexpected ICE servers: %+v", servers)
+	}
+	if got := <-fetches; got != ttl {
+		t.Fatalf("requested TTL %v, want %v", got, ttl)
+	}
+	if got, want := provider.Expiry(), start.Add(ttl); !got.Equal(want) {
+		t.Fatalf("expiry %v, want %v", got, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go provider.Run(ctx)
+
+	if d := clock.fire(clock.next(t)); d != 50*time.Second {
+		t.Fatalf("refresh scheduled after %v, want 50s", d)
+	}
+	select {
+	case <-fetches:
+	case <-time.After(5 * time.Second):
+		t.Fatal("credentials were not refreshed")
+	}
+	select {
+	case expiry := <-renewals:
+		if want := start.Add(50*time.Second + ttl); !expiry.Equal(want) {
+			t.Errorf("renewed credentials expire at %v, want %v", expiry, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("refreshed credentials were not passed to OnRenew")
+	}
+
+	// The next timer only gets requested once the refresh has completed.
+	if d := clock.fire(clock.next(t)); d != 50*time.Second {
+		t.Fatalf("second refresh scheduled after %v, want 50s", d)
+	}
+	<-fetches
+	// Once the next refresh got scheduled the previous one is complete.
+	clock.next(t)
+	if got, want := provider.Expiry(), start.Add(200*time.Second); !got.Equal(want) {
+		t.Fatalf("expiry %v, want %v", got, want)
+	}
+	servers, err = provider.ICEServers(context.Background())
+	if err != nil || servers[1].Username != "user-3" {
+		t.Fatalf("ICEServers returned %+v, %v, want the refreshed credentials", servers, err)
+	}
+}
+
+func TestTurnCredentialProviderRetry(t *testing.T) {
+	clock := newFakeClock()
+	fetches := make(chan struct{}, 10)
+	fetch := func(ctx context.Context, ttl time.Duration) ([]calls.ICEServer, error) {
+		fetches <- struct{}{}
+		return nil, fmt.Errorf("unavailable")
+	}
+
+	provider := NewTurnCredentialProvider(fetch, time.Hour)
+	provider.Clock = clock
+	provider.RetryInterval = 7 * time.Second
+	provider.OnRenew = func(time.Time) { t.Error("OnRenew called without credentials") }
+
+	if _, err := provider.ICEServers(context.Background()); err == nil {
+		t.Fatal("expected an error from ICEServers")
+	}
+	<-fetches
+	if !provider.Expiry().IsZero() {
+		t.Fatalf("expiry set without credentials: %v", provider.Expiry())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go provider.Run(ctx)
+
+	// Without any credentials the first refresh happens right away.
+	if d := clock.fire(clock.next(t)); d != 0 {
+		t.Fatalf("first refresh scheduled after %v, want 0", d)
+	}
+	<-fetches
+	if d := clock.fire(clock.next(t)); d != 7*time.Second {
+		t.Fatalf("retry scheduled after %v, want 7s", d)
+	}
+}
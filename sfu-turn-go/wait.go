@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+var (
+	// ErrPeerConnectionFailed is returned when waiting for a PeerConnection
+	// which failed to connect.
+	ErrPeerConnectionFailed = errors.New("PeerConnection failed")
+	// ErrPeerConnectionClosed is returned when waiting for a PeerConnection
+	// which was closed.
+	ErrPeerConnectionClosed = errors.New("PeerConnection closed")
+)
+
+// connectionWatcher follows the connection state of a PeerConnection, so
+// that waits for the PeerConnection end as soon as it fails or is closed.
+// Its Update method has to be called from the OnConnectionStateChange
+// handler of the PeerConnection.
+type connectionWatcher struct {
+	connected     chan struct{}
+	connectedOnce sync.Once
+
+	// ctx is canceled with ErrPeerConnectionFailed or
+	// ErrPeerConnectionClosed.
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+func newConnectionWatcher() *connectionWatcher {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	return &connectionWatcher{connected: make(chan struct{}), ctx: ctx, cancel: cancel}
+}
+
+// Update records a new connection state.
+func (w *connectionWatcher) Update(state webrtc.PeerConnectionState) {
+	switch state {
+	case webrtc.PeerConnectionStateConnected:
+		w.connectedOnce.Do(func() { close(w.connected) })
+	case webrtc.PeerConnectionStateFailed:
+		w.cancel(ErrPeerConnectionFailed)
+	case webrtc.PeerConnectionStateClosed:
+		w.cancel(ErrPeerConnectionClosed)
+	}
+}
+
+// Done is closed once the PeerConnection failed or was closed.
+func (w *connectionWatcher) Done() <-chan struct{} {
+	return w.ctx.Done()
+}
+
+// Err returns ErrPeerConnectionFailed or ErrPeerConnectionClosed once Done
+// is closed, nil before.
+func (w *connectionWatcher) Err() error {
+	return context.Cause(w.ctx)
+}
+
+// WaitConnected waits until the PeerConnection is connected, at most for
+// the timeout.
+func (w *connectionWatcher) WaitConnected(ctx context.Context, timeout time.Duration, what string) error {
+	return w.Wait(ctx, timeout, w.connected, what)
+}
+
+// Wait waits until ch is closed, at most for the timeout. It returns an
+// error if ctx is done or the PeerConnection fails or is closed first.
+func (w *connectionWatcher) Wait(ctx context.Context, timeout time.Duration, ch <-chan struct{}, what string) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	select {
+	case <-ch:
+		return nil
+	case <-w.Done():
+		return fmt.Errorf("error waiting for %s: %w", what, w.Err())
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("timed out after %v waiting for %s: %w", timeout, what, ctx.Err())
+		}
+		return fmt.Errorf("stopped waiting for %s: %w", what, ctx.Err())
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestConnectionWatcher(t *testing.T) {
+	watcher := newConnectionWatcher()
+	watcher.Update(webrtc.PeerConnectionStateConnecting)
+	watcher.Update(webrtc.PeerConnectionStateConnected)
+	if err := watcher.WaitConnected(context.Background(), time.Second, "connecting"); err != nil {
+		t.Fatalf("WaitConnected failed: %v", err)
+	}
+	if watcher.Err() != nil {
+		t.Fatalf("unexpected error %v", watcher.Err())
+	}
+
+	for _, tc := range []struct {
+		state webrtc.PeerConnectionState
+		want  error
+	}{
+		{webrtc.PeerConnectionStateFailed, ErrPeerConnectionFailed},
+		{webrtc.PeerConnectionStateClosed, ErrPeerConnectionClosed},
+	} {
+		watcher := newConnectionWatcher()
+		go watcher.Update(tc.state)
+		if err := watcher.WaitConnected(context.Background(), 5*time.Second, "connecting"); !errors.Is(err, tc.want) {
+			t.Errorf("WaitConnected after %s returned %v, want %v", tc.state, err, tc.want)
+		}
+		// Any other wait ends as well, and the first state sticks.
+		watcher.Update(webrtc.PeerConnectionStateClosed)
+		if err := watcher.Wait(context.Background(), 5*time.Second, make(chan struct{}), "the data channel"); !errors.Is(err, tc.want) {
+			t.Errorf("Wait after %s returned %v, want %v", tc.state, err, tc.want)
+		}
+	}
+}
+
+func TestConnectionWatcherTimeout(t *testing.T) {
+	watcher := newConnectionWatcher()
+	err := watcher.WaitConnected(context.Background(), 10*time.Millisecond, "connecting")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WaitConnected returned %v, want a deadline error", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = watcher.WaitConnected(ctx, time.Minute, "connecting")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("WaitConnected returned %v, want a canceled error", err)
+	}
+}
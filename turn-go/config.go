@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// config holds all settings of the example. The API token is only read from
+// the environment or a file, so that it doesn't end up in the shell history.
+type config struct {
+	TurnKeyID           string
+	TurnAPIToken        string
+	Local               bool
+	BaseURL             string
+	CABundle            string
+	TurnTTL             time.Duration
+	ChannelName         string
+	TransportPolicy     webrtc.ICETransportPolicy
+	TurnTransport       string
+	APITimeout          time.Duration
+	APIAttempts         int
+	GatherTimeout       time.Duration
+	ConnectTimeout      time.Duration
+	TrickleICE          bool // off by default like in sfu-turn-go, so that every description carries all candidates
+	ReconnectAttempts   int
+	ReconnectMaxBackoff time.Duration
+	Role                string
+	SignalURL           string
+	SignalListen        string
+	SignalToken         string
+	StatsInterval       time.Duration
+	StatsJSON           bool
+	MetricsAddr         string
+	Debug               bool
+}
+
+// parseConfig parses the command line flags, falling back to environment
+// variables for everything which isn't set on the command line.
+func parseConfig(args []string, output io.Writer) (*config, error) {
+	var cfg config
+	var tokenFile, signalTokenFile, transportPolicy string
+
+	fs := flag.NewFlagSet("turn-go", flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.StringVar(&cfg.TurnKeyID, "turn-key-id", os.Getenv("CLOUDFLARE_TURN_KEY_ID"),
+		"TURN key ID (env CLOUDFLARE_TURN_KEY_ID)")
+	fs.StringVar(&tokenFile, "turn-api-token-file", os.Getenv("CLOUDFLARE_TURN_API_TOKEN_FILE"),
+		"file containing the TURN API token, otherwise read from env CLOUDFLARE_TURN_API_TOKEN (env CLOUDFLARE_TURN_API_TOKEN_FILE)")
+	fs.BoolVar(&cfg.Local, "local", false,
+		"use a TURN server on the loopback interface instead of Cloudflare")
+	fs.StringVar(&cfg.BaseURL, "base-url", envOrDefault("CLOUDFLARE_API_BASE_URL", cloudflareAPIBaseURL),
+		"base URL of the TURN API (env CLOUDFLARE_API_BASE_URL)")
+	fs.StringVar(&cfg.CABundle, "ca-bundle", os.Getenv("CLOUDFLARE_CA_BUNDLE"),
+		"PEM file with additional CA certificates to trust (env CLOUDFLARE_CA_BUNDLE)")
+	fs.DurationVar(&cfg.TurnTTL, "turn-ttl", 24*time.Hour,
+		"lifetime of the requested TURN credentials")
+	fs.StringVar(&cfg.ChannelName, "channel", "dataChannel1",
+		"label of the data channel between the peers")
+	fs.StringVar(&transportPolicy, "ice-transport-policy", "relay",
+		"ICE transport policy: relay to only connect through TURN, turn-udp, turn-tcp or turns to only connect through TURN over UDP, TCP or TLS, or all to allow every candidate")
+	fs.DurationVar(&cfg.APITimeout, "api-timeout", 10*time.Second,
+		"timeout of a single API request")
+	fs.IntVar(&cfg.APIAttempts, "api-attempts", DefaultRetryPolicy.MaxAttempts,
+		"maximum number of attempts of a TURN API request, 1 disables retries")
+	fs.DurationVar(&cfg.GatherTimeout, "gather-timeout", 15*time.Second,
+		"how long to wait for ICE gathering to finish when not trickling candidates")
+	fs.DurationVar(&cfg.ConnectTimeout, "connect-timeout", 30*time.Second,
+		"how long to wait for connecting and the data channel to open")
+	fs.BoolVar(&cfg.TrickleICE, "trickle-ice", false,
+		"send ICE candidates to the remote peer as they are gathered, otherwise they are part of the offer and answer")
+	fs.IntVar(&cfg.ReconnectAttempts, "reconnect-attempts", 5,
+		"how often to restart ICE after the connection between the peers was lost, 0 disables reconnecting")
+	fs.DurationVar(&cfg.ReconnectMaxBackoff, "reconnect-max-backoff", 30*time.Second,
+		"maximum wait between two reconnect attempts")
+	fs.StringVar(&cfg.Role, "role", "",
+		"run only one peer, offerer or answerer, which connects to the other peer through a signaling server; both peers run in this process if empty")
+	fs.StringVar(&cfg.SignalURL, "signal-url", "",
+		"base URL of the signaling server used with -role, defaults to the server started with -signal-listen")
+	fs.StringVar(&cfg.SignalListen, "signal-listen", "",
+		"address to serve the signaling server on with -role, e.g. :8080")
+	fs.StringVar(&signalTokenFile, "signal-token-file", os.Getenv("TURN_GO_SIGNAL_TOKEN_FILE"),
+		"file containing the token shared by the peers for the signaling server, otherwise read from env TURN_GO_SIGNAL_TOKEN (env TURN_GO_SIGNAL_TOKEN_FILE)")
+	fs.DurationVar(&cfg.StatsInterval, "stats-interval", 0,
+		"how often to print a connection-quality report, 0 prints one only after connecting")
+	fs.BoolVar(&cfg.StatsJSON, "stats-json", false,
+		"print the connection-quality reports as JSON")
+	fs.StringVar(&cfg.MetricsAddr, "metrics-addr", "",
+		"address to serve Prometheus metrics on at /metrics, e.g. :9090; disabled if empty")
+	fs.BoolVar(&cfg.Debug, "debug", false,
+		"log credentials and tokens instead of masking them")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: turn-go [flags]")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "The TURN API token is read from the environment variable")
+		fmt.Fprintln(fs.Output(), "CLOUDFLARE_TURN_API_TOKEN, or from the file given with -turn-api-token-file.")
+		fmt.Fprintln(fs.Output(), "Neither the token nor the key ID are needed with -local.")
+		fmt.Fprintln(fs.Output(), "With -role both peers need the same signaling token, which is read from")
+		fmt.Fprintln(fs.Output(), "TURN_GO_SIGNAL_TOKEN or from the file given with -signal-token-file.")
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v, the token has to be passed through the environment or a file", fs.Args())
+	}
+
+	var errs []error
+	var err error
+	if !cfg.Local {
+		if cfg.TurnKeyID == "" {
+			errs = append(errs, errors.New("missing TURN key ID, set -turn-key-id or CLOUDFLARE_TURN_KEY_ID"))
+		}
+		if cfg.TurnAPIToken, err = readSecret("CLOUDFLARE_TURN_API_TOKEN", tokenFile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if cfg.TurnTTL < time.Minute {
+		errs = append(errs, fmt.Errorf("-turn-ttl %v is too short, it must be at least 1m", cfg.TurnTTL))
+	}
+	if cfg.ChannelName == "" {
+		errs = append(errs, errors.New("-channel must not be empty"))
+	}
+	if cfg.TransportPolicy, cfg.TurnTransport, err = parseTransportPolicy(transportPolicy); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.APITimeout <= 0 || cfg.GatherTimeout <= 0 || cfg.ConnectTimeout <= 0 {
+		errs = append(errs, errors.New("timeouts must be positive"))
+	}
+	if cfg.APIAttempts < 1 {
+		errs = append(errs, errors.New("-api-attempts must be at least 1"))
+	}
+	if cfg.StatsInterval < 0 {
+		errs = append(errs, errors.New("-stats-interval must not be negative"))
+	}
+	if cfg.ReconnectAttempts < 0 {
+		errs = append(errs, errors.New("-reconnect-attempts must not be negative"))
+	}
+	if cfg.ReconnectMaxBackoff < reconnectInitialBackoff {
+		errs = append(errs, fmt.Errorf("-reconnect-max-backoff must be at least %v", reconnectInitialBackoff))
+	}
+	switch cfg.Role {
+	case "":
+		if cfg.SignalURL != "" || cfg.SignalListen != "" {
+			errs = append(errs, errors.New("-signal-url and -signal-listen require -role"))
+		}
+	case roleOfferer, roleAnswerer:
+		if cfg.SignalURL == "" && cfg.SignalListen != "" {
+			cfg.SignalURL = listenURL(cfg.SignalListen)
+		}
+		if cfg.SignalURL == "" {
+			errs = append(errs, errors.New("-role requires -signal-url or -signal-listen"))
+		}
+		if cfg.SignalToken, err = readSecret("TURN_GO_SIGNAL_TOKEN", signalTokenFile); err != nil {
+			errs = append(errs, err)
+		}
+	default:
+		errs = append(errs, fmt.Errorf("invalid role %q, must be offerer or answerer", cfg.Role))
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return &cfg, nil
+}
+
+// readSecret reads a secret from the given file, or from the environment
+// variable key if no file is given.
+func readSecret(key, file string) (string, error) {
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("error reading %s: %w", key, err)
+		}
+		secret := strings.TrimSpace(string(data))
+		if secret == "" {
+			return "", fmt.Errorf("file %s for %s is empty", file, key)
+		}
+		return secret, nil
+	}
+
+	secret := os.Getenv(key)
+	if secret == "" {
+		return "", fmt.Errorf("missing %s, set it in the environment or pass a token file", key)
+	}
+	return secret, nil
+}
+
+// parseTransportPolicy parses the value of the -ice-transport-policy flag
+// into the policy of the PeerConnections and the transport the TURN URLs
+// are restricted to.
+func parseTransportPolicy(policy string) (webrtc.ICETransportPolicy, string, error) {
+	switch policy {
+	case "relay":
+		return webrtc.ICETransportPolicyRelay, "", nil
+	case "turn-udp":
+		return webrtc.ICETransportPolicyRelay, turnTransportUDP, nil
+	case "turn-tcp":
+		return webrtc.ICETransportPolicyRelay, turnTransportTCP, nil
+	case "turns":
+		return webrtc.ICETransportPolicyRelay, turnTransportTLS, nil
+	case "all":
+		return webrtc.ICETransportPolicyAll, "", nil
+	default:
+		return webrtc.ICETransportPolicyAll, "", fmt.Errorf("invalid ICE transport policy %q, must be relay, turn-udp, turn-tcp, turns or all", policy)
+	}
+}
+
+// listenURL returns the URL to reach a server listening on addr from the
+// same host.
+func listenURL(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "http://" + addr
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// clearConfigEnv makes sure the tests don't pick up any configuration from
+// the environment they are running in.
+func clearConfigEnv(t *testing.T) {
+	for _, key := range []string{
+		"CLOUDFLARE_TURN_KEY_ID", "CLOUDFLARE_TURN_API_TOKEN", "CLOUDFLARE_TURN_API_TOKEN_FILE",
+		"CLOUDFLARE_API_BASE_URL", "CLOUDFLARE_CA_BUNDLE",
+		"TURN_GO_SIGNAL_TOKEN", "TURN_GO_SIGNAL_TOKEN_FILE",
+	} {
+		t.Setenv(key, "")
+	}
+}
+
+// writeSecret writes a secret file and returns its path.
+func writeSecret(t *testing.T, name, secret string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(secret), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestParseConfig(t *testing.T) {
+	clearConfigEnv(t)
+	t.Setenv("CLOUDFLARE_TURN_KEY_ID", "turn-key")
+	t.Setenv("CLOUDFLARE_API_BASE_URL", "http://localhost:8080/v1")
+	tokenFile := writeSecret(t, "token", "turn-token\n")
+	signalTokenFile := writeSecret(t, "signal-token", "signal-token\n")
+
+	cfg, err := parseConfig([]string{
+		"-turn-api-token-file", tokenFile,
+		"-turn-ttl", "1h",
+		"-ice-transport-policy", "turns",
+		"-role", "answerer",
+		"-signal-listen", ":8080",
+		"-signal-token-file", signalTokenFile,
+	}, io.Discard)
+	if err != nil {
+		t.Fatalf("parseConfig failed: %v", err)
+	}
+
+	if cfg.TurnKeyID != "turn-key" || cfg.TurnAPIToken != "turn-token" {
+		t.Errorf("unexpected TURN settings: %q %q", cfg.TurnKeyID, cfg.TurnAPIToken)
+	}
+	if cfg.BaseURL != "http://localhost:8080/v1" {
+		t.Errorf("base URL %q is not taken from the environment", cfg.BaseURL)
+	}
+	if cfg.TurnTTL != time.Hour || cfg.TransportPolicy != webrtc.ICETransportPolicyRelay || cfg.TurnTransport != turnTransportTLS {
+		t.Errorf("unexpected TTL %v, policy %v or transport %q", cfg.TurnTTL, cfg.TransportPolicy, cfg.TurnTransport)
+	}
+	if cfg.Role != roleAnswerer || cfg.SignalURL != "http://localhost:8080" || cfg.SignalToken != "signal-token" {
+		t.Errorf("unexpected signaling settings: %q %q %q", cfg.Role, cfg.SignalURL, cfg.SignalToken)
+	}
+	if cfg.ChannelName != "dataChannel1" || cfg.TrickleICE {
+		t.Errorf("unexpected default channel name %q or trickle ICE %v", cfg.ChannelName, cfg.TrickleICE)
+	}
+}
+
+func TestParseConfigValidation(t *testing.T) {
+	emptyFile := writeSecret(t, "empty", "\n")
+
+	for _, tc := range []struct {
+		name string
+		env  map[string]string
+		args []string
+		// want are the parts of the error, nil if parsing succeeds.
+		want []string
+	}{
+		{
+			name: "missing secrets",
+			want: []string{"missing TURN key ID", "missing CLOUDFLARE_TURN_API_TOKEN"},
+		},
+		{
+			name: "empty token file",
+			env:  map[string]string{"CLOUDFLARE_TURN_KEY_ID": "turn-key"},
+			args: []string{"-turn-api-token-file", emptyFile},
+			want: []string{"is empty"},
+		},
+		{
+			name: "missing token file",
+			env:  map[string]string{"CLOUDFLARE_TURN_KEY_ID": "turn-key"},
+			args: []string{"-turn-api-token-file", filepath.Join(t.TempDir(), "missing")},
+			want: []string{"error reading CLOUDFLARE_TURN_API_TOKEN"},
+		},
+		{
+			name: "local without secrets",
+			args: []string{"-local"},
+		},
+		{
+			name: "invalid role",
+			args: []string{"-local", "-role", "caller"},
+			want: []string{`invalid role "caller"`},
+		},
+		{
+			name: "role without signaling server",
+			env:  map[string]string{"TURN_GO_SIGNAL_TOKEN": "signal-token"},
+			args: []string{"-local", "-role", "offerer"},
+			want: []string{"-role requires -signal-url or -signal-listen"},
+		},
+		{
+			name: "role without signaling token",
+			args: []string{"-local", "-role", "offerer", "-signal-url", "http://signal.example.com"},
+			want: []string{"missing TURN_GO_SIGNAL_TOKEN"},
+		},
+		{
+			name: "signaling without role",
+			args: []string{"-local", "-signal-url", "http://signal.example.com"},
+			want: []string{"require -role"},
+		},
+		{
+			name: "bad transport policy",
+			args: []string{"-local", "-ice-transport-policy", "host"},
+			want: []string{`invalid ICE transport policy "host"`},
+		},
+		{
+			name: "bad timeouts and limits",
+			args: []string{"-local", "-turn-ttl", "10s", "-connect-timeout", "0", "-api-attempts", "0", "-reconnect-attempts", "-1", "-reconnect-max-backoff", "1ms"},
+			want: []string{"-turn-ttl", "timeouts must be positive", "-api-attempts", "-reconnect-attempts", "-reconnect-max-backoff"},
+		},
+		{
+			name: "positional token",
+			args: []string{"-local", "token"},
+			want: []string{"unexpected arguments"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clearConfigEnv(t)
+			for key, value := range tc.env {
+				t.Setenv(key, value)
+			}
+
+			_, err := parseConfig(tc.args, io.Discard)
+			if tc.want == nil {
+				if err != nil {
+					t.Fatalf("parseConfig failed: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseTransportPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy    string
+		want      webrtc.ICETransportPolicy
+		transport string
+	}{
+		{"relay", webrtc.ICETransportPolicyRelay, ""},
+		{"turn-udp", webrtc.ICETransportPolicyRelay, turnTransportUDP},
+		{"turn-tcp", webrtc.ICETransportPolicyRelay, turnTransportTCP},
+		{"turns", webrtc.ICETransportPolicyRelay, turnTransportTLS},
+		{"all", webrtc.ICETransportPolicyAll, ""},
+	} {
+		policy, transport, err := parseTransportPolicy(tc.policy)
+		if err != nil || policy != tc.want || transport != tc.transport {
+			t.Errorf("parseTransportPolicy(%q) = %v, %q, %v; want %v, %q", tc.policy, policy, transport, err, tc.want, tc.transport)
+		}
+	}
+	if _, _, err := parseTransportPolicy("turn"); err == nil {
+		t.Error("expected an error for an invalid policy")
+	}
+}
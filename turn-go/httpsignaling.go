@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	roleOfferer  = "offerer"
+	roleAnswerer = "answerer"
+)
+
+// signalPollTimeout is how long the signaling server holds a poll request
+// open when there is no message for the peer.
+const signalPollTimeout = 20 * time.Second
+
+// signalQueueSize is the number of messages the signaling server queues for
+// a peer until it acknowledges them.
+const signalQueueSize = 64
+
+// remoteRole returns the role of the other peer.
+func remoteRole(role string) string {
+	if role == roleOfferer {
+		return roleAnswerer
+	}
+	return roleOfferer
+}
+
+// signalingServer relays signaling messages between an offerer and an
+// answerer. Messages are posted to /signal/{role} of the receiving peer,
+// which long-polls the same URL with GET requests. It connects a single
+// pair of peers, which have to send their shared token as bearer token.
+//
+// The server numbers the messages of each peer, starting at 1, and returns
+// the number in the Signal-Sequence header. A poll acknowledges all messages
+// up to the number in its ack parameter, so that a message whose response
+// got lost is returned again by the next poll.
+type signalingServer struct {
+	token string
+
+	mu        sync.Mutex
+	mailboxes map[string]*mailbox
+}
+
+// mailbox holds the messages for a peer which it hasn't acknowledged yet.
+type mailbox struct {
+	messages []SignalMessage
+	// first is the sequence number of the first message.
+	first uint64
+	// posted gets closed and replaced whenever a message is posted.
+	posted chan struct{}
+}
+
+// signalSequenceHeader carries the sequence number of a polled message.
+const signalSequenceHeader = "Signal-Sequence"
+
+// newSignalingHandler returns the HTTP handler of a signalingServer which
+// only accepts requests with the given token.
+func newSignalingHandler(token string) http.Handler {
+	s := &signalingServer{token: token, mailboxes: make(map[string]*mailbox)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /signal/{role}", s.authenticate(s.handlePost))
+	mux.HandleFunc("GET /signal/{role}", s.authenticate(s.handlePoll))
+	return mux
+}
+
+func (s *signalingServer) authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// mailbox returns the mailbox of the peer with the given role, or nil if
+// the role is unknown. s.mu has to be held.
+func (s *signalingServer) mailbox(role string) *mailbox {
+	if role != roleOfferer && role != roleAnswerer {
+		return nil
+	}
+	box := s.mailboxes[role]
+	if box == nil {
+		box = &mailbox{first: 1, posted: make(chan struct{})}
+		s.mailboxes[role] = box
+	}
+	return box
+}
+
+func (s *signalingServer) handlePost(w http.ResponseWriter, r *http.Request) {
+	var msg SignalMessage
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, fmt.Sprintf("invalid signaling message: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	box := s.mailbox(r.PathValue("role"))
+	switch {
+	case box == nil:
+		http.NotFound(w, r)
+	case len(box.messages) >= signalQueueSize:
+		http.Error(w, "too many queued messages", http.StatusServiceUnavailable)
+	default:
+		box.messages = append(box.messages, msg)
+		close(box.posted)
+		box.posted = make(chan struct{})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *signalingServer) handlePoll(w http.ResponseWriter, r *http.Request) {
+	var ack uint64
+	if value := r.URL.Query().Get("ack"); value != "" {
+		var err error
+		if ack, err = strconv.ParseUint(value, 10, 64); err != nil {
+			http.Error(w, "invalid ack", http.StatusBadRequest)
+			return
+		}
+	}
+
+	timer := time.NewTimer(signalPollTimeout)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		box := s.mailbox(r.PathValue("role"))
+		if box == nil {
+			s.mu.Unlock()
+			http.NotFound(w, r)
+			return
+		}
+		for len(box.messages) > 0 && box.first <= ack {
+			box.messages = box.messages[1:]
+			box.first++
+		}
+		if len(box.messages) > 0 {
+			msg, seq := box.messages[0], box.first
+			s.mu.Unlock()
+			// The message stays queued until the next poll acknowledges
+			// it, so it doesn't get lost if the peer went away.
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set(signalSequenceHeader, strconv.FormatUint(seq, 10))
+			json.NewEncoder(w).Encode(msg)
+			return
+		}
+		posted := box.posted
+		s.mu.Unlock()
+
+		select {
+		case <-posted:
+		case <-timer.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// httpSignaler is a Signaler talking to a signalingServer, which allows the
+// peers to run on different machines.
+type httpSignaler struct {
+	client  *http.Client
+	baseURL string
+	role    string
+	token   string
+	// acked is the sequence number of the last received message.
+	acked uint64
+
+	closed context.Context
+	close  context.CancelFunc
+}
+
+// newHTTPSignaler returns a Signaler for the peer with the given role, which
+// uses the signaling server at baseURL with the shared token. The client
+// must not time out requests sooner than signalPollTimeout.
+func newHTTPSignaler(client *http.Client, baseURL, role, token string) *httpSignaler {
+	closed, cancel := context.WithCancel(context.Background())
+	return &httpSignaler{
+		client:  client,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		role:    role,
+		token:   token,
+		closed:  closed,
+		close:   cancel,
+	}
+}
+
+func (s *httpSignaler) Send(ctx context.Context, msg SignalMessage) error {
+	if s.closed.Err() != nil {
+		return ErrSignalerClosed
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("error marshalling signaling message: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url(remoteRole(s.role)), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating HTTP request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.token)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending signaling message: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("signaling server failed with status %s and body: %s", resp.Status, logSafe(string(body)))
+	}
+	return nil
+}
+
+func (s *httpSignaler) Receive(ctx context.Context) (SignalMessage, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(s.closed, cancel)
+	defer stop()
+
+	for {
+		msg, ok, err := s.poll(ctx)
+		if s.closed.Err() != nil {
+			return SignalMessage{}, ErrSignalerClosed
+		}
+		if err != nil {
+			return SignalMessage{}, err
+		}
+		if ok {
+			return msg, nil
+		}
+	}
+}
+
+// poll waits for the next message from the remote peer, acknowledging the
+// previous one. It returns false if the server didn't have a message before
+// the poll timed out. Receive is the only caller, so acked needs no lock.
+func (s *httpSignaler) poll(ctx context.Context) (SignalMessage, bool, error) {
+	url := s.url(s.role) + "?ack=" + strconv.FormatUint(s.acked, 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return SignalMessage{}, false, fmt.Errorf("error creating HTTP request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return SignalMessage{}, false, fmt.Errorf("error polling signaling server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		seq, err := strconv.ParseUint(resp.Header.Get(signalSequenceHeader), 10, 64)
+		if err != nil {
+			return SignalMessage{}, false, fmt.Errorf("invalid signaling message sequence number: %w", err)
+		}
+		var msg SignalMessage
+		if err := json.NewDecoder(resp.Body).Decode(&msg); err != nil {
+			return SignalMessage{}, false, fmt.Errorf("error decoding signaling message: %w", err)
+		}
+		s.acked = seq
+		return msg, true, nil
+	case http.StatusNoContent:
+		return SignalMessage{}, false, nil
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		return SignalMessage{}, false, fmt.Errorf("signaling server failed with status %s and body: %s", resp.Status, logSafe(string(body)))
+	}
+}
+
+func (s *httpSignaler) Close() error {
+	s.close()
+	return nil
+}
+
+func (s *httpSignaler) url(role string) string {
+	return s.baseURL + "/signal/" + role
+}
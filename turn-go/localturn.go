@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pion/turn/v2"
+)
+
+// localTurn is a TURN server listening on the loopback interface, together
+// with a fake generate-ice-servers endpoint which mints credentials for it.
+// It allows running the relay-only demo without access to Cloudflare.
+type localTurn struct {
+	// BaseURL, APIToken and KeyID are to be used instead of the Cloudflare
+	// API base URL, API token and TURN key ID.
+	BaseURL  string
+	APIToken string
+	KeyID    string
+
+	sharedSecret string
+	udpAddr      string
+	tcpAddr      string
+
+	server *turn.Server
+	api    *http.Server
+}
+
+// startLocalTurn starts the TURN server and the fake API on random loopback
+// ports.
+func startLocalTurn() (*localTurn, error) {
+	l := &localTurn{
+		APIToken:     randomHex(16),
+		KeyID:        randomHex(16),
+		sharedSecret: randomHex(32),
+	}
+
+	if err := l.listen("127.0.0.1:0", "127.0.0.1:0"); err != nil {
+		return nil, err
+	}
+
+	apiListener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		l.server.Close()
+		return nil, fmt.Errorf("error listening for the API: %w", err)
+	}
+	l.BaseURL = fmt.Sprintf("http://%s/v1", apiListener.Addr())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/turn/keys/{keyId}/credentials/generate-ice-servers", l.handleGenerateIceServers)
+	l.api = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := l.api.Serve(apiListener); err != nil && err != http.ErrServerClosed {
+			log.Printf("error serving local TURN API: %v", err)
+		}
+	}()
+
+	log.Printf("Local TURN server listening on udp/%s and tcp/%s", l.udpAddr, l.tcpAddr)
+	return l, nil
+}
+
+// listen starts the TURN server on the UDP and TCP addresses.
+func (l *localTurn) listen(udpAddr, tcpAddr string) error {
+	udpListener, err := net.ListenPacket("udp4", udpAddr)
+	if err != nil {
+		return fmt.Errorf("error listening on UDP: %w", err)
+	}
+	tcpListener, err := net.Listen("tcp4", tcpAddr)
+	if err != nil {
+		udpListener.Close()
+		return fmt.Errorf("error listening on TCP: %w", err)
+	}
+	l.udpAddr = udpListener.LocalAddr().String()
+	l.tcpAddr = tcpListener.Addr().String()
+
+	relayAddressGenerator := &turn.RelayAddressGeneratorStatic{
+		RelayAddress: net.ParseIP("127.0.0.1"),
+		Address:      "127.0.0.1",
+	}
+	l.server, err = turn.NewServer(turn.ServerConfig{
+		Realm: "localhost",
+		// Credentials follow the TURN REST API scheme: the username is the
+		// expiry timestamp and the credential is derived from it with the
+		// shared secret.
+		AuthHandler: turn.NewLongTermAuthHandler(l.sharedSecret, nil),
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{PacketConn: udpListener, RelayAddressGenerator: relayAddressGenerator},
+		},
+		ListenerConfigs: []turn.ListenerConfig{
+			{Listener: tcpListener, RelayAddressGenerator: relayAddressGenerator},
+		},
+	})
+	if err != nil {
+		udpListener.Close()
+		tcpListener.Close()
+		return fmt.Errorf("error starting TURN server: %w", err)
+	}
+	return nil
+}
+
+// Close stops the fake API and the TURN server.
+func (l *localTurn) Close() error {
+	return errors.Join(l.api.Close(), l.server.Close())
+}
+
+// handleGenerateIceServers mints credentials in the same JSON format as the
+// Cloudflare generate-ice-servers endpoint.
+func (l *localTurn) handleGenerateIceServers(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+l.APIToken || r.PathValue("keyId") != l.KeyID {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		TTL int `json:"ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.TTL <= 0 {
+		http.Error(w, "invalid ttl", http.StatusBadRequest)
+		return
+	}
+
+	username, credential, err := turn.GenerateLongTermCredentials(l.sharedSecret, time.Duration(request.TTL)*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := Response{
+		IceServers: []IceServer{
+			{
+				URLs: []string{fmt.Sprintf("stun:%s", l.udpAddr)},
+			},
+			{
+				URLs: []string{
+					fmt.Sprintf("turn:%s?transport=udp", l.udpAddr),
+					fmt.Sprintf("turn:%s?transport=tcp", l.tcpAddr),
+				},
+				Username:   username,
+				Credential: credential,
+			},
+		},
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("error writing local TURN API response: %v", err)
+	}
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// newLocalTurnClient returns a TurnClient fetching credentials from the
+// fake API of the local TURN server.
+func newLocalTurnClient(local *localTurn, token string) *TurnClient {
+	client := NewTurnClient(local.KeyID, token)
+	client.BaseURL = local.BaseURL
+	return client
+}
+
+// restart restarts the TURN server on the same addresses, which drops all
+// relay allocations. Unlike a running server, which keeps the allocations
+// until they time out, the restarted one rejects expired credentials right
+// away.
+func (l *localTurn) restart(t *testing.T) {
+	t.Helper()
+	if err := l.server.Close(); err != nil {
+		t.Fatalf("error stopping TURN server: %v", err)
+	}
+	if err := l.listen(l.udpAddr, l.tcpAddr); err != nil {
+		t.Fatalf("error restarting TURN server: %v", err)
+	}
+}
+
+func TestLocalTurnRelayOnly(t *testing.T) {
+	local, err := startLocalTurn()
+	if err != nil {
+		t.Fatalf("error starting local TURN server: %v", err)
+	}
+	defer local.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	_, err = newLocalTurnClient(local, "wrong-token").GenerateICEServers(ctx, time.Hour)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected an APIError for an invalid API token, got %v", err)
+	}
+
+	provider := NewTurnCredentialProvider(func(ctx context.Context, ttl time.Duration) ([]IceServer, error) {
+		return newLocalTurnClient(local, local.APIToken).GenerateICEServers(ctx, ttl)
+	}, time.Hour)
+
+	configuration, err := createNewWebrtcConfiguration(ctx, provider, webrtc.ICETransportPolicyRelay)
+	if err != nil {
+		t.Fatalf("error creating configuration: %v", err)
+	}
+	peer1, err := webrtc.NewPeerConnection(configuration)
+	if err != nil {
+		t.Fatalf("error creating peer1: %v", err)
+	}
+	defer peer1.Close()
+	peer2, err := webrtc.NewPeerConnection(configuration)
+	if err != nil {
+		t.Fatalf("error creating peer2: %v", err)
+	}
+	defer peer2.Close()
+
+	connected := make(chan struct{})
+	peer1.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
+		if pcs == webrtc.PeerConnectionStateConnected {
+			close(connected)
+		}
+	})
+	if _, err := peer1.CreateDataChannel("data", nil); err != nil {
+		t.Fatalf("error creating data channel: %v", err)
+	}
+
+	// Exchange complete descriptions instead of trickling candidates.
+	offer, err := peer1.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("error creating offer: %v", err)
+	}
+	gatherComplete1 := webrtc.GatheringCompletePromise(peer1)
+	if err := peer1.SetLocalDescription(offer); err != nil {
+		t.Fatalf("error setting local description: %v", err)
+	}
+	<-gatherComplete1
+	if err := peer2.SetRemoteDescription(*peer1.LocalDescription()); err != nil {
+		t.Fatalf("error setting remote description: %v", err)
+	}
+	answer, err := peer2.CreateAnswer(nil)
+	if err != nil {
+		t.Fatalf("error creating answer: %v", err)
+	}
+	gatherComplete2 := webrtc.GatheringCompletePromise(peer2)
+	if err := peer2.SetLocalDescription(answer); err != nil {
+		t.Fatalf("error setting local description: %v", err)
+	}
+	<-gatherComplete2
+	if err := peer1.SetRemoteDescription(*peer2.LocalDescription()); err != nil {
+		t.Fatalf("error setting remote description: %v", err)
+	}
+
+	select {
+	case <-connected:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the peers to connect through TURN")
+	}
+
+	// Only relay candidates may have been used.
+	stats := peer1.GetStats()
+	for _, s := range stats {
+		candidate, ok := s.(webrtc.ICECandidateStats)
+		if ok && candidate.CandidateType != webrtc.ICECandidateTypeRelay {
+			t.Errorf("unexpected %s candidate %s:%d", candidate.CandidateType, candidate.IP, candidate.Port)
+		}
+	}
+}
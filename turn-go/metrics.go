@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// apiLatencyBuckets are the upper bounds in seconds of the API call latency
+// histogram.
+var apiLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics collects the values served on the optional /metrics endpoint with
+// the Prometheus client. All methods may be called on a nil *Metrics, which
+// ignores the observations, so that callers don't need to check whether
+// metrics are enabled.
+//
+// Unlike in the sfu-turn-go example there are no Calls sessions, the peers
+// connect to each other directly through TURN. The metrics of a peer are
+// labeled with its name or role instead of a session ID.
+type Metrics struct {
+	registry         *prometheus.Registry
+	apiDuration      *prometheus.HistogramVec
+	apiErrors        *prometheus.CounterVec
+	turnRefreshes    *prometheus.CounterVec
+	peerTransitions  *prometheus.CounterVec
+	iceTransitions   *prometheus.CounterVec
+	channelBytesSent *prometheus.Desc
+	channelBytesRecv *prometheus.Desc
+	channelMsgsSent  *prometheus.Desc
+	channelMsgsRecv  *prometheus.Desc
+	transport        *prometheus.Desc
+
+	mu    sync.Mutex
+	peers map[string]*webrtc.PeerConnection
+}
+
+// NewMetrics returns an empty Metrics with its own registry.
+func NewMetrics() *Metrics {
+	channelLabels := []string{"peer", "label", "id"}
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		apiDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "calls_api_request_duration_seconds",
+			Help:    "Latency of API calls including retries.",
+			Buckets: apiLatencyBuckets,
+		}, []string{"endpoint", "method"}),
+		apiErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "calls_api_request_errors_total",
+			Help: "Number of failed API calls.",
+		}, []string{"endpoint", "method"}),
+		turnRefreshes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "turn_credential_refreshes_total",
+			Help: "Number of attempts to fetch TURN credentials.",
+		}, []string{"result"}),
+		peerTransitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "webrtc_peer_connection_state_transitions_total",
+			Help: "Number of transitions into each PeerConnection state.",
+		}, []string{"peer", "state"}),
+		iceTransitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "webrtc_ice_connection_state_transitions_total",
+			Help: "Number of transitions into each ICE connection state.",
+		}, []string{"peer", "state"}),
+		channelBytesSent: prometheus.NewDesc("webrtc_data_channel_bytes_sent_total", "Bytes sent on a data channel.", channelLabels, nil),
+		channelBytesRecv: prometheus.NewDesc("webrtc_data_channel_bytes_received_total", "Bytes received on a data channel.", channelLabels, nil),
+		channelMsgsSent:  prometheus.NewDesc("webrtc_data_channel_messages_sent_total", "Messages sent on a data channel.", channelLabels, nil),
+		channelMsgsRecv:  prometheus.NewDesc("webrtc_data_channel_messages_received_total", "Messages received on a data channel.", channelLabels, nil),
+		transport: prometheus.NewDesc("webrtc_selected_transport", "The transport of the selected candidate pair, e.g. TURN/TLS.",
+			[]string{"peer", "transport"}, nil),
+		peers: make(map[string]*webrtc.PeerConnection),
+	}
+	m.registry.MustRegister(m.apiDuration, m.apiErrors, m.turnRefreshes, m.peerTransitions, m.iceTransitions, peerCollector{m})
+	return m
+}
+
+// ObserveAPICall records the latency and outcome of an API call.
+func (m *Metrics) ObserveAPICall(endpoint, method string, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.apiDuration.WithLabelValues(endpoint, method).Observe(duration.Seconds())
+	// The error counter is exported for every endpoint, even without
+	// errors.
+	failures := m.apiErrors.WithLabelValues(endpoint, method)
+	if err != nil {
+		failures.Inc()
+	}
+}
+
+// TurnRefresh counts an attempt to fetch TURN credentials.
+func (m *Metrics) TurnRefresh(err error) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.turnRefreshes.WithLabelValues(result).Inc()
+}
+
+// PeerConnectionState counts a transition of the connection state of a
+// peer.
+func (m *Metrics) PeerConnectionState(peer string, state webrtc.PeerConnectionState) {
+	if m == nil {
+		return
+	}
+	m.peerTransitions.WithLabelValues(peer, state.String()).Inc()
+}
+
+// ICEConnectionState counts a transition of the ICE connection state of a
+// peer.
+func (m *Metrics) ICEConnectionState(peer string, state webrtc.ICEConnectionState) {
+	if m == nil {
+		return
+	}
+	m.iceTransitions.WithLabelValues(peer, state.String()).Inc()
+}
+
+// AddPeerConnection adds the data channels of the PeerConnection to the
+// metrics. Their byte and message counts are read from the stats when the
+// metrics are scraped.
+func (m *Metrics) AddPeerConnection(peer string, pc *webrtc.PeerConnection) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.peers[peer] = pc
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// peerCollector reads the data channel counters and the selected transports
+// from the stats of the PeerConnections when the metrics are scraped.
+type peerCollector struct {
+	m *Metrics
+}
+
+func (c peerCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{c.m.channelBytesSent, c.m.channelBytesRecv, c.m.channelMsgsSent, c.m.channelMsgsRecv, c.m.transport} {
+		ch <- desc
+	}
+}
+
+func (c peerCollector) Collect(ch chan<- prometheus.Metric) {
+	m := c.m
+	m.mu.Lock()
+	peers := make(map[string]*webrtc.PeerConnection, len(m.peers))
+	for peer, pc := range m.peers {
+		peers[peer] = pc
+	}
+	m.mu.Unlock()
+
+	for peer, pc := range peers {
+		stats := pc.GetStats()
+		if _, local, _, ok := selectedCandidatePair(stats); ok {
+			ch <- prometheus.MustNewConstMetric(m.transport, prometheus.GaugeValue, 1, peer, candidateTransport(local))
+		}
+		// A data channel reopened with the same label and ID is only
+		// reported once, as the registry rejects duplicate series.
+		seen := make(map[string]bool)
+		for _, s := range stats {
+			stats, ok := s.(webrtc.DataChannelStats)
+			id := fmt.Sprint(stats.DataChannelIdentifier)
+			if !ok || seen[stats.Label+"/"+id] {
+				continue
+			}
+			seen[stats.Label+"/"+id] = true
+			labels := []string{peer, stats.Label, id}
+			ch <- prometheus.MustNewConstMetric(m.channelBytesSent, prometheus.CounterValue, float64(stats.BytesSent), labels...)
+			ch <- prometheus.MustNewConstMetric(m.channelBytesRecv, prometheus.CounterValue, float64(stats.BytesReceived), labels...)
+			ch <- prometheus.MustNewConstMetric(m.channelMsgsSent, prometheus.CounterValue, float64(stats.MessagesSent), labels...)
+			ch <- prometheus.MustNewConstMetric(m.channelMsgsRecv, prometheus.CounterValue, float64(stats.MessagesReceived), labels...)
+		}
+	}
+}
+
+// serveMetrics serves the metrics on addr at /metrics in the background.
+func serveMetrics(addr string, m *Metrics) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening for metrics: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", m.Handler())
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("error serving metrics: %v", err)
+		}
+	}()
+	log.Printf("Serving metrics on http://%s/metrics", listener.Addr())
+	return server, nil
+}
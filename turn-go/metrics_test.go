@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	return rec.Body.String()
+}
+
+func TestMetricsTurnCredentials(t *testing.T) {
+	m := NewMetrics()
+
+	// Like in main every fetch of the provider is observed.
+	fetches := 0
+	provider := NewTurnCredentialProvider(func(ctx context.Context, ttl time.Duration) ([]IceServer, error) {
+		start := time.Now()
+		var err error
+		if fetches++; fetches == 1 {
+			err = errors.New("unavailable")
+		}
+		m.ObserveAPICall(turnCredentialsEndpoint, http.MethodPost, time.Since(start), err)
+		if err != nil {
+			return nil, err
+		}
+		return []IceServer{{URLs: []string{"turn:turn.example.com:3478"}, Username: "user", Credential: "secret"}}, nil
+	}, time.Hour)
+	provider.OnRefresh = m.TurnRefresh
+	if _, err := provider.ICEServers(context.Background()); err == nil {
+		t.Fatal("expected the first fetch to fail")
+	}
+	if _, err := provider.ICEServers(context.Background()); err != nil {
+		t.Fatalf("error fetching ICE servers: %v", err)
+	}
+	m.PeerConnectionState("peer1", webrtc.PeerConnectionStateConnected)
+
+	out := scrape(t, m)
+	for _, line := range []string{
+		`calls_api_request_duration_seconds_count{endpoint="` + turnCredentialsEndpoint + `",method="POST"} 2`,
+		`calls_api_request_errors_total{endpoint="` + turnCredentialsEndpoint + `",method="POST"} 1`,
+		`turn_credential_refreshes_total{result="error"} 1`,
+		`turn_credential_refreshes_total{result="success"} 1`,
+		`webrtc_peer_connection_state_transitions_total{peer="peer1",state="connected"} 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("metrics do not contain %q:\n%s", line, out)
+		}
+	}
+}
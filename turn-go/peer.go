@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Peer is one of the two peers, which connects to the peer with the other
+// role through a Signaler. The offerer creates the data channel and sends
+// the offer, the answerer waits for both.
+//
+// The offerer can replace its PeerConnection with Rebuild, e.g. after the
+// TURN credentials expired. Its offer carries the next generation, which
+// makes the answerer replace its PeerConnection as well.
+type Peer struct {
+	// Name identifies the peer in logs, metrics and reports.
+	Name string
+	// Role is roleOfferer or roleAnswerer.
+	Role string
+	// Metrics records the state transitions and data channels of the
+	// PeerConnections. It may be nil.
+	Metrics *Metrics
+	// Supervisor follows the connection state and the expiry of the TURN
+	// credentials of the current PeerConnection. It may be nil.
+	Supervisor *ReconnectSupervisor
+	// OnMessage is called for every message received on the data channel.
+	OnMessage func(webrtc.DataChannelMessage)
+
+	cfg      *config
+	provider *TurnCredentialProvider
+	signaler Signaler
+	// api creates the PeerConnections, the default API is used if nil.
+	api *webrtc.API
+
+	mu   sync.Mutex
+	conn *peerConnection
+}
+
+// peerConnection is one generation of the PeerConnection of a Peer.
+type peerConnection struct {
+	generation int
+	pc         *webrtc.PeerConnection
+	// signaler tags the messages with the generation.
+	signaler Signaler
+	watcher  *connectionWatcher
+	// channel is set once the data channel is open, before opened is
+	// closed. It is guarded by the mutex of the Peer.
+	channel *webrtc.DataChannel
+	opened  chan struct{}
+}
+
+// NewPeer returns a Peer with the given name and role. Its PeerConnections
+// use the TURN credentials of provider and the ICE transport policy and
+// timeouts of cfg.
+func NewPeer(name, role string, cfg *config, provider *TurnCredentialProvider, signaler Signaler) *Peer {
+	return &Peer{
+		Name:      name,
+		Role:      role,
+		OnMessage: func(webrtc.DataChannelMessage) {},
+		cfg:       cfg,
+		provider:  provider,
+		signaler:  signaler,
+	}
+}
+
+// Connect creates the PeerConnection and connects it to the remote peer.
+// It returns once the data channel is open, or with an error if that takes
+// longer than the timeouts of the configuration or the PeerConnection fails
+// or is closed first.
+//
+// Signaling keeps running in the background until the Signaler is closed,
+// so that late candidates, ICE restarts and rebuilt PeerConnections still
+// reach the peer.
+func (p *Peer) Connect(ctx context.Context) error {
+	c, err := p.replace(ctx, 0)
+	if err != nil {
+		return err
+	}
+
+	// Waiting for the data channel ends if signaling fails.
+	signalCtx, signalFailed := context.WithCancelCause(ctx)
+	defer signalFailed(nil)
+	go func() {
+		err := p.receiveSignals(context.Background())
+		signalFailed(fmt.Errorf("error signaling: %w", err))
+	}()
+
+	if p.Role == roleOfferer {
+		if err := p.offer(signalCtx, c); err != nil {
+			c.pc.Close()
+			return err
+		}
+	}
+
+	if err := c.watcher.Wait(signalCtx, p.cfg.ConnectTimeout, c.opened, "the data channel to open"); err != nil {
+		if signalCtx.Err() != nil && ctx.Err() == nil {
+			err = context.Cause(signalCtx)
+		}
+		c.pc.Close()
+		return err
+	}
+	return nil
+}
+
+// RestartICE restarts ICE of the current PeerConnection, see restartICE.
+func (p *Peer) RestartICE(ctx context.Context) error {
+	c := p.connection()
+	return restartICE(ctx, c.pc, c.signaler)
+}
+
+// Rebuild replaces the PeerConnection of the offerer with a new one, which
+// gets the current TURN credentials of the provider, and sends its offer
+// with the next generation, so that the answerer replaces its
+// PeerConnection as well. It returns once the new data channel is open.
+func (p *Peer) Rebuild(ctx context.Context) error {
+	if p.Role != roleOfferer {
+		return fmt.Errorf("the %s can't rebuild the connection, only the offerer can", p.Role)
+	}
+	c, err := p.replace(ctx, p.connection().generation+1)
+	if err != nil {
+		return err
+	}
+	if err := p.offer(ctx, c); err != nil {
+		return err
+	}
+	return c.watcher.Wait(ctx, p.cfg.ConnectTimeout, c.opened, "the data channel to open")
+}
+
+// PeerConnection returns the current PeerConnection.
+func (p *Peer) PeerConnection() *webrtc.PeerConnection {
+	return p.connection().pc
+}
+
+// DataChannel returns the data channel of the current PeerConnection, or nil
+// if it isn't open yet.
+func (p *Peer) DataChannel() *webrtc.DataChannel {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conn.channel
+}
+
+// GetStats returns the stats of the current PeerConnection, so that the
+// reports follow rebuilt PeerConnections.
+func (p *Peer) GetStats() webrtc.StatsReport {
+	return p.PeerConnection().GetStats()
+}
+
+// Close closes the current PeerConnection.
+func (p *Peer) Close() error {
+	return p.PeerConnection().Close()
+}
+
+func (p *Peer) connection() *peerConnection {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conn
+}
+
+// replace creates a PeerConnection of the given generation, makes it the
+// current one and closes the one it replaces.
+func (p *Peer) replace(ctx context.Context, generation int) (*peerConnection, error) {
+	c, err := p.newConnection(ctx, generation)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	old := p.conn
+	p.conn = c
+	p.mu.Unlock()
+
+	if old != nil {
+		if err := old.pc.Close(); err != nil {
+			log.Printf("error closing replaced PeerConnection of %s: %v", p.Name, err)
+		}
+	}
+	return c, nil
+}
+
+// newConnection creates a PeerConnection with the current TURN credentials
+// of the provider. The offerer creates the data channel right away, the
+// answerer gets it from the offer.
+func (p *Peer) newConnection(ctx context.Context, generation int) (*peerConnection, error) {
+	configuration, err := createNewWebrtcConfiguration(ctx, p.provider, p.cfg.TransportPolicy)
+	if err != nil {
+		return nil, err
+	}
+	expiry := p.provider.Expiry()
+
+	api := p.api
+	if api == nil {
+		api = webrtc.NewAPI()
+	}
+	pc, err := api.NewPeerConnection(configuration)
+	if err != nil {
+		return nil, fmt.Errorf("error creating PeerConnection: %w", err)
+	}
+	c := &peerConnection{
+		generation: generation,
+		pc:         pc,
+		signaler:   generationSignaler{Signaler: p.signaler, generation: generation},
+		watcher:    newConnectionWatcher(),
+		opened:     make(chan struct{}),
+	}
+
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			log.Printf("ICE gathering of %s has finished", p.Name)
+			return
+		}
+		if !p.cfg.TrickleICE {
+			return
+		}
+		candJson := candidate.ToJSON()
+		log.Printf("%s sending ICE candidate: %v", p.Name, candJson)
+		err := c.signaler.Send(context.Background(), SignalMessage{Candidate: &candJson})
+		if err != nil && !errors.Is(err, ErrSignalerClosed) {
+			log.Printf("error sending ICE candidate of %s: %v", p.Name, err)
+		}
+	})
+	pc.OnICEConnectionStateChange(func(is webrtc.ICEConnectionState) {
+		log.Printf("%s ICE connection state: %v", p.Name, is)
+		p.Metrics.ICEConnectionState(p.Name, is)
+	})
+	pc.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
+		log.Printf("%s connection state: %v", p.Name, pcs)
+		p.Metrics.PeerConnectionState(p.Name, pcs)
+		c.watcher.Update(pcs)
+		// Replaced PeerConnections getting closed don't concern the
+		// supervisor.
+		if p.connection() == c {
+			p.Supervisor.Update(pcs)
+		}
+	})
+
+	var openOnce sync.Once
+	setup := func(channel *webrtc.DataChannel) {
+		channel.OnMessage(p.OnMessage)
+		channel.OnOpen(func() {
+			log.Printf("Data channel on %s opened", p.Name)
+			openOnce.Do(func() {
+				p.mu.Lock()
+				c.channel = channel
+				p.mu.Unlock()
+				close(c.opened)
+			})
+		})
+	}
+	if p.Role == roleOfferer {
+		channel, err := pc.CreateDataChannel(p.cfg.ChannelName, nil)
+		if err != nil {
+			pc.Close()
+			return nil, fmt.Errorf("error creating data channel: %w", err)
+		}
+		setup(channel)
+	} else {
+		pc.OnDataChannel(setup)
+	}
+
+	p.Supervisor.SetExpiry(expiry)
+	p.Metrics.AddPeerConnection(p.Name, pc)
+	return c, nil
+}
+
+// offer sends the offer of the PeerConnection to the answerer. Without
+// trickle ICE it waits for gathering first, at most for the gather timeout.
+func (p *Peer) offer(ctx context.Context, c *peerConnection) error {
+	offer, err := c.pc.CreateOffer(nil)
+	if err != nil {
+		return fmt.Errorf("error creating offer: %w", err)
+	}
+	if err := c.pc.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("error setting local description: %w", err)
+	}
+	gatherCtx, cancel := context.WithTimeout(ctx, p.cfg.GatherTimeout)
+	defer cancel()
+	return sendDescription(gatherCtx, c.pc, c.signaler, p.cfg.TrickleICE)
+}
+
+// receiveSignals applies the signals of the remote peer to the current
+// PeerConnection like receiveSignals, until the Signaler is closed or ctx
+// is done. Signals of replaced PeerConnections are dropped. An offer of a
+// new generation makes the answerer replace its PeerConnection, candidates
+// of that generation arriving before the offer are held back.
+func (p *Peer) receiveSignals(ctx context.Context) error {
+	pending := make(map[int][]webrtc.ICECandidateInit)
+	for {
+		msg, err := p.signaler.Receive(ctx)
+		if err != nil {
+			return err
+		}
+
+		c := p.connection()
+		if p.Role == roleAnswerer && msg.Generation > c.generation && msg.Description != nil && msg.Description.Type == webrtc.SDPTypeOffer {
+			log.Printf("%s received the offer of a rebuilt PeerConnection, replacing its own", p.Name)
+			replaced, err := p.replace(ctx, msg.Generation)
+			if err != nil {
+				// The offerer sends a new offer on its next attempt.
+				log.Printf("error replacing the PeerConnection of %s: %v", p.Name, err)
+				continue
+			}
+			c = replaced
+			for generation := range pending {
+				if generation < c.generation {
+					delete(pending, generation)
+				}
+			}
+		}
+
+		switch {
+		case msg.Generation < c.generation:
+			continue
+		case msg.Generation > c.generation:
+			if msg.Candidate != nil {
+				pending[msg.Generation] = append(pending[msg.Generation], *msg.Candidate)
+			}
+			continue
+		}
+		candidates := pending[c.generation]
+		if err := applySignal(ctx, c.pc, c.signaler, p.cfg.TrickleICE, msg, &candidates); err != nil {
+			return err
+		}
+		pending[c.generation] = candidates
+	}
+}
+
+// supervisePeer reconnects the offerer in the background whenever the
+// connection is lost, with an ICE restart or, once the TURN credentials
+// expired, by rebuilding the PeerConnections of both peers.
+func supervisePeer(ctx context.Context, p *Peer) {
+	p.Supervisor.Restart = p.RestartICE
+	p.Supervisor.Rebuild = p.Rebuild
+	go func() {
+		if err := p.Supervisor.Run(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("%v", err)
+		}
+	}()
+}
+
+// runWithRole runs one of the two peers, which connects to the other peer
+// through the HTTP signaling server. Messages entered on the console are
+// sent to the other peer.
+func runWithRole(ctx context.Context, cfg *config, turnProvider *TurnCredentialProvider, metrics *Metrics) {
+	if cfg.SignalListen != "" {
+		listener, err := net.Listen("tcp", cfg.SignalListen)
+		if err != nil {
+			log.Fatalf("error listening for signaling: %v", err)
+		}
+		server := &http.Server{Handler: newSignalingHandler(cfg.SignalToken), ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				log.Printf("error serving signaling: %v", err)
+			}
+		}()
+		defer server.Close()
+		log.Printf("Signaling server listening on %s", listener.Addr())
+	}
+
+	// Polls are held open by the signaling server, so the client must not
+	// use the API timeout.
+	signalClient, err := newHTTPClient(cfg.CABundle, 0)
+	if err != nil {
+		log.Fatalf("error creating HTTP client: %v", err)
+	}
+	signaler := newHTTPSignaler(signalClient, cfg.SignalURL, cfg.Role, cfg.SignalToken)
+	defer signaler.Close()
+
+	log.Printf("Connecting to the %s through %s", remoteRole(cfg.Role), cfg.SignalURL)
+	p := NewPeer(cfg.Role, cfg.Role, cfg, turnProvider, signaler)
+	p.Metrics = metrics
+	p.OnMessage = func(msg webrtc.DataChannelMessage) {
+		log.Printf("%s received: %s\n", cfg.Role, string(msg.Data))
+	}
+	// Only the offerer restarts ICE or rebuilds the PeerConnections when
+	// the connection is lost, the answerer answers the new offer.
+	if cfg.Role == roleOfferer {
+		p.Supervisor = NewReconnectSupervisor(cfg.Role, reconnectPolicy(cfg))
+	}
+	if err := p.Connect(ctx); err != nil {
+		log.Fatalf("error connecting the %s: %v", cfg.Role, err)
+	}
+	defer p.Close()
+	if p.Supervisor != nil {
+		supervisePeer(ctx, p)
+	}
+	// The answerer keeps its credentials fresh as well, for when the
+	// offerer rebuilds the connection.
+	turnProvider.OnRenew = p.Supervisor.Renew
+	go turnProvider.Run(ctx)
+
+	reporter := NewStatsReporter(os.Stdout, cfg.StatsJSON)
+	reporter.Add(cfg.Role, p)
+	startStatsReporter(ctx, cfg, reporter)
+
+	if err := p.DataChannel().SendText(fmt.Sprintf("Hello from the %s!", cfg.Role)); err != nil {
+		log.Printf("error sending message: %v", err)
+	}
+	sendConsoleMessages(p)
+}
+
+// sendConsoleMessages reads lines from the console and sends them on the
+// data channel of the peer, until "exit" is entered.
+func sendConsoleMessages(p *Peer) {
+	peer := p.Name
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Printf("Enter message to send from %s (\"exit\" to quit): ", peer)
+		msg, err := reader.ReadString('\n')
+		msg = strings.TrimSpace(msg)
+
+		if msg == "exit" || (err != nil && msg == "") {
+			log.Println("Exiting...")
+			return
+		}
+
+		if channel := p.DataChannel(); channel != nil && channel.ReadyState() == webrtc.DataChannelStateOpen {
+			if err := channel.SendText(msg); err != nil {
+				log.Printf("error sending message from %s: %v", peer, err)
+			}
+		} else {
+			log.Println("Data channel is not open.  Cannot send message.")
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestPeerRoles(t *testing.T) {
+	local, err := startLocalTurn()
+	if err != nil {
+		t.Fatalf("error starting local TURN server: %v", err)
+	}
+	defer local.Close()
+	signaling := httptest.NewServer(newSignalingHandler("signal-token"))
+	defer signaling.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Like with -ice-transport-policy=turn-tcp only TURN over TCP is used.
+	provider := NewTurnCredentialProvider(func(ctx context.Context, ttl time.Duration) ([]IceServer, error) {
+		servers, err := newLocalTurnClient(local, local.APIToken).GenerateICEServers(ctx, ttl)
+		if err != nil {
+			return nil, err
+		}
+		return filterTurnTransport(servers, turnTransportTCP)
+	}, time.Hour)
+
+	metrics := NewMetrics()
+
+	received := make(map[string]chan string)
+	errs := make(map[string]chan error)
+	peers := make(map[string]*Peer)
+	for _, role := range []string{roleOfferer, roleAnswerer} {
+		messages, connected := make(chan string, 1), make(chan error, 1)
+		received[role], errs[role] = messages, connected
+
+		// Both peers talk to the signaling server over the loopback
+		// interface, like two processes would.
+		signaler := newHTTPSignaler(signaling.Client(), signaling.URL, role, "signal-token")
+		defer signaler.Close()
+		cfg := &config{Role: role, ChannelName: "data", TrickleICE: true, TransportPolicy: webrtc.ICETransportPolicyRelay, GatherTimeout: 10 * time.Second, ConnectTimeout: 20 * time.Second}
+		p := NewPeer(role, role, cfg, provider, signaler)
+		p.Metrics = metrics
+		p.OnMessage = func(msg webrtc.DataChannelMessage) {
+			messages <- string(msg.Data)
+		}
+		peers[role] = p
+		go func() { connected <- p.Connect(ctx) }()
+	}
+
+	for role, ch := range errs {
+		if err := <-ch; err != nil {
+			t.Fatalf("error connecting the %s: %v", role, err)
+		}
+		defer peers[role].Close()
+	}
+
+	for role, p := range peers {
+		if err := p.DataChannel().SendText("hello from the " + role); err != nil {
+			t.Fatalf("error sending from the %s: %v", role, err)
+		}
+	}
+	for role, ch := range received {
+		select {
+		case msg := <-ch:
+			if want := "hello from the " + remoteRole(role); msg != want {
+				t.Errorf("%s received %q, want %q", role, msg, want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for a message on the %s", role)
+		}
+	}
+
+	// The connection-quality reports show the connection over TURN/TCP.
+	var reports bytes.Buffer
+	reporter := NewStatsReporter(&reports, true)
+	reporter.Add(roleOfferer, peers[roleOfferer])
+	reporter.Add(roleAnswerer, peers[roleAnswerer])
+	if err := reporter.Report(); err != nil {
+		t.Fatalf("error reporting stats: %v", err)
+	}
+	decoder := json.NewDecoder(&reports)
+	for range peers {
+		var report ConnectionReport
+		if err := decoder.Decode(&report); err != nil {
+			t.Fatalf("error decoding report: %v", err)
+		}
+		if report.Local == nil || report.Local.Type != "relay" || report.Transport != "TURN/TCP" {
+			t.Errorf("%s is not connected through TURN over TCP: %v", report.Peer, report)
+		}
+	}
+
+	out := scrape(t, metrics)
+	for _, role := range []string{roleOfferer, roleAnswerer} {
+		id := fmt.Sprint(*peers[role].DataChannel().ID())
+		for _, prefix := range []string{
+			`webrtc_peer_connection_state_transitions_total{peer="` + role + `",state="connected"} `,
+			`webrtc_data_channel_messages_received_total{id="` + id + `",label="data",peer="` + role + `"} `,
+			`webrtc_selected_transport{peer="` + role + `",transport="TURN/TCP"} 1`,
+		} {
+			if !strings.Contains(out, prefix) {
+				t.Errorf("metrics do not contain %q:\n%s", prefix, out)
+			}
+		}
+	}
+}
+
+func TestPeerConnectFailures(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// closeSignaler closes the signaler of the other peer right away.
+		closeSignaler bool
+		want          error
+	}{
+		{name: "timeout", want: context.DeadlineExceeded},
+		{name: "signaler closed", closeSignaler: true, want: ErrSignalerClosed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+
+			// The answerer waits for an offer which never arrives.
+			signaler, other := newMemorySignalers()
+			defer signaler.Close()
+			if tc.closeSignaler {
+				other.Close()
+			}
+			cfg := &config{Role: roleAnswerer, ChannelName: "data", GatherTimeout: time.Second, ConnectTimeout: 200 * time.Millisecond}
+			// Without ICE servers only host candidates are gathered.
+			provider := NewTurnCredentialProvider(func(context.Context, time.Duration) ([]IceServer, error) {
+				return []IceServer{}, nil
+			}, time.Hour)
+			p := NewPeer(roleAnswerer, roleAnswerer, cfg, provider, signaler)
+			err := p.Connect(ctx)
+			if err == nil {
+				p.Close()
+				t.Fatal("connected without a remote peer")
+			}
+			if !errors.Is(err, tc.want) {
+				t.Errorf("got error %v, want %v", err, tc.want)
+			}
+			if ctx.Err() != nil {
+				t.Errorf("Connect returned only after the test timed out: %v", err)
+			}
+		})
+	}
+}
+
+func TestPeerRebuildsExpiredConnection(t *testing.T) {
+	local, err := startLocalTurn()
+	if err != nil {
+		t.Fatalf("error starting local TURN server: %v", err)
+	}
+	defer local.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Both peers are only connected through TURN over UDP with credentials
+	// which expire after two seconds.
+	provider := NewTurnCredentialProvider(func(ctx context.Context, ttl time.Duration) ([]IceServer, error) {
+		servers, err := newLocalTurnClient(local, local.APIToken).GenerateICEServers(ctx, ttl)
+		if err != nil {
+			return nil, err
+		}
+		return filterTurnTransport(servers, turnTransportUDP)
+	}, 2*time.Second)
+	var settings webrtc.SettingEngine
+	settings.SetICETimeouts(time.Second, 2*time.Second, 200*time.Millisecond)
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(settings))
+
+	signaler1, signaler2 := newMemorySignalers()
+	defer signaler1.Close()
+	received := make(map[string]chan string)
+	peers := make(map[string]*Peer)
+	for role, signaler := range map[string]Signaler{roleOfferer: signaler1, roleAnswerer: signaler2} {
+		messages := make(chan string, 16)
+		received[role] = messages
+		cfg := &config{Role: role, ChannelName: "data", TrickleICE: true, TransportPolicy: webrtc.ICETransportPolicyRelay, GatherTimeout: 10 * time.Second, ConnectTimeout: 10 * time.Second}
+		p := NewPeer(role, role, cfg, provider, signaler)
+		p.api = api
+		p.OnMessage = func(msg webrtc.DataChannelMessage) {
+			messages <- string(msg.Data)
+		}
+		peers[role] = p
+	}
+	offerer := peers[roleOfferer]
+	offerer.Supervisor = NewReconnectSupervisor(roleOfferer, ReconnectPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     100 * time.Millisecond,
+		Timeout:        10 * time.Second,
+	})
+
+	errs := make(chan error, 2)
+	for _, p := range peers {
+		go func() { errs <- p.Connect(ctx) }()
+	}
+	for range peers {
+		if err := <-errs; err != nil {
+			t.Fatalf("error connecting: %v", err)
+		}
+	}
+	for _, p := range peers {
+		defer p.Close()
+	}
+
+	exchange := func(what string) {
+		t.Helper()
+		for role, p := range peers {
+			if err := p.DataChannel().SendText(what + " from the " + role); err != nil {
+				t.Fatalf("error sending from the %s: %v", role, err)
+			}
+		}
+		for role, ch := range received {
+			select {
+			case msg := <-ch:
+				if want := what + " from the " + remoteRole(role); msg != want {
+					t.Errorf("%s received %q, want %q", role, msg, want)
+				}
+			case <-ctx.Done():
+				t.Fatalf("timed out waiting for a message on the %s", role)
+			}
+		}
+	}
+	exchange("before")
+
+	old := make(map[string]*webrtc.PeerConnection)
+	for role, p := range peers {
+		old[role] = p.PeerConnection()
+	}
+	rebuilt := make(chan struct{})
+	offerer.Supervisor.Restart = offerer.RestartICE
+	offerer.Supervisor.Rebuild = func(ctx context.Context) error {
+		if err := offerer.Rebuild(ctx); err != nil {
+			return err
+		}
+		close(rebuilt)
+		return nil
+	}
+	done := make(chan error, 1)
+	go func() { done <- offerer.Supervisor.Run(ctx) }()
+
+	// Once the credentials expired, the restarted TURN server doesn't let
+	// the peers allocate relays with them anymore.
+	time.Sleep(time.Until(provider.Expiry()) + time.Second)
+	local.restart(t)
+
+	select {
+	case <-rebuilt:
+	case err := <-done:
+		t.Fatalf("supervisor stopped: %v", err)
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the offerer to be rebuilt")
+	}
+	for role, p := range peers {
+		if p.PeerConnection() == old[role] {
+			t.Errorf("the %s still uses its old PeerConnection", role)
+		}
+		if state := p.PeerConnection().ConnectionState(); state != webrtc.PeerConnectionStateConnected {
+			t.Errorf("rebuilt PeerConnection of the %s is %s", role, state)
+		}
+		if state := old[role].ConnectionState(); state != webrtc.PeerConnectionStateClosed {
+			t.Errorf("replaced PeerConnection of the %s is %s", role, state)
+		}
+	}
+	exchange("after")
+}
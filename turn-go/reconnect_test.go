@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestReconnectSupervisor(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	s := NewReconnectSupervisor("offerer", reconnectPolicy(&config{
+		ReconnectAttempts:   2,
+		ReconnectMaxBackoff: time.Second,
+		ConnectTimeout:      5 * time.Second,
+	}))
+	var sleeps []time.Duration
+	s.sleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		return nil
+	}
+	// The first offer doesn't reach the answerer, the second one gets the
+	// peers connected again.
+	restarts := 0
+	reconnected := make(chan struct{})
+	s.Restart = func(ctx context.Context) error {
+		if restarts++; restarts == 1 {
+			return errors.New("error sending offer")
+		}
+		s.Update(webrtc.PeerConnectionStateConnected)
+		close(reconnected)
+		return nil
+	}
+
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() { done <- s.Run(runCtx) }()
+	s.Update(webrtc.PeerConnectionStateFailed)
+	select {
+	case <-reconnected:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the reconnect")
+	}
+
+	// Once reconnected, Run keeps supervising until it is stopped.
+	stop()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Run returned %v, want context.Canceled", err)
+	}
+	if restarts != 2 || len(sleeps) != 1 || sleeps[0] != reconnectInitialBackoff {
+		t.Errorf("restarted %d times with sleeps %v, want 2 restarts and one backoff", restarts, sleeps)
+	}
+}
+
+func TestReconnectSupervisorRebuild(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, tc := range []struct {
+		name    string
+		expired bool
+		// restartErr fails the ICE restart, if set.
+		restartErr error
+		want       []string
+	}{
+		{name: "valid credentials", want: []string{"restart"}},
+		{name: "expired credentials", expired: true, want: []string{"rebuild"}},
+		{name: "failed restart", restartErr: errors.New("error sending offer"), want: []string{"restart", "rebuild"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewReconnectSupervisor("offerer", reconnectPolicy(&config{
+				ReconnectAttempts:   3,
+				ReconnectMaxBackoff: time.Second,
+				ConnectTimeout:      5 * time.Second,
+			}))
+			s.sleep = func(ctx context.Context, d time.Duration) error { return nil }
+			now := time.Unix(1000, 0)
+			s.now = func() time.Time { return now }
+			s.SetExpiry(now.Add(time.Minute))
+			if tc.expired {
+				now = now.Add(time.Minute)
+			}
+
+			var calls []string
+			s.Restart = func(ctx context.Context) error {
+				calls = append(calls, "restart")
+				if tc.restartErr != nil {
+					return tc.restartErr
+				}
+				s.Update(webrtc.PeerConnectionStateConnected)
+				return nil
+			}
+			s.Rebuild = func(ctx context.Context) error {
+				calls = append(calls, "rebuild")
+				s.Update(webrtc.PeerConnectionStateConnected)
+				return nil
+			}
+
+			s.Update(webrtc.PeerConnectionStateFailed)
+			if err := s.reconnect(ctx); err != nil {
+				t.Fatalf("error reconnecting: %v", err)
+			}
+			if !reflect.DeepEqual(calls, tc.want) {
+				t.Errorf("got calls %v, want %v", calls, tc.want)
+			}
+		})
+	}
+}
+
+func TestReconnectSupervisorRenew(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	s := NewReconnectSupervisor("offerer", reconnectPolicy(&config{
+		ReconnectAttempts:   3,
+		ReconnectMaxBackoff: time.Second,
+		ConnectTimeout:      5 * time.Second,
+	}))
+	expiry := time.Now().Add(time.Hour)
+	s.SetExpiry(expiry)
+	s.Restart = func(ctx context.Context) error {
+		return errors.New("unexpected ICE restart")
+	}
+	rebuilt := make(chan time.Time, 2)
+	var renewed time.Time
+	s.Rebuild = func(ctx context.Context) error {
+		// The rebuilt PeerConnection gets the renewed credentials.
+		s.SetExpiry(renewed)
+		s.Update(webrtc.PeerConnectionStateConnected)
+		rebuilt <- renewed
+		return nil
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	s.Update(webrtc.PeerConnectionStateConnected)
+
+	// Credentials which don't expire later don't help the PeerConnection.
+	s.Renew(expiry)
+	renewed = expiry.Add(time.Hour)
+	s.Renew(renewed)
+	select {
+	case got := <-rebuilt:
+		if !got.Equal(renewed) {
+			t.Errorf("rebuilt with credentials expiring at %v, want %v", got, renewed)
+		}
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for the PeerConnection to be rebuilt")
+	}
+
+	s.Update(webrtc.PeerConnectionStateClosed)
+	if err := <-done; err != nil {
+		t.Errorf("Run returned %v after the PeerConnection was closed", err)
+	}
+	if len(rebuilt) != 0 {
+		t.Errorf("rebuilt the PeerConnection %d more times", len(rebuilt))
+	}
+}
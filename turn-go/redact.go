@@ -0,0 +1,38 @@
+package main
+
+import "regexp"
+
+// redacted replaces secrets in logs and errors.
+const redacted = "[REDACTED]"
+
+// debug disables the redaction of secrets in logs and errors.
+var debug bool
+
+var redactions = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// Bearer tokens, e.g. from an Authorization header.
+	{regexp.MustCompile(`(?i)(bearer\s+)[^\s"]+`), "${1}" + redacted},
+	// Secrets in JSON bodies, like the TURN credential.
+	{regexp.MustCompile(`("(?:credential|password|token)"\s*:\s*")[^"]*"`), "${1}" + redacted + `"`},
+}
+
+// logSafe masks TURN credentials and bearer tokens in s unless debugging.
+func logSafe(s string) string {
+	if debug {
+		return s
+	}
+	for _, r := range redactions {
+		s = r.re.ReplaceAllString(s, r.repl)
+	}
+	return s
+}
+
+// logSecret masks a secret completely unless debugging or it is empty.
+func logSecret(secret string) string {
+	if debug || secret == "" {
+		return secret
+	}
+	return redacted
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLogSafe(t *testing.T) {
+	body := `{"iceServers":[{"urls":["turn:turn.example.com"],"username":"user","credential":"s3cret"}],"token":"abc"}`
+	got := logSafe(body)
+	if strings.Contains(got, "s3cret") || strings.Contains(got, `"abc"`) {
+		t.Errorf("secrets not masked: %s", got)
+	}
+	if !strings.Contains(got, "turn:turn.example.com") {
+		t.Errorf("non-secret data masked: %s", got)
+	}
+	if got := logSafe("Authorization: Bearer abc.def"); got != "Authorization: Bearer "+redacted {
+		t.Errorf("bearer token not masked: %s", got)
+	}
+
+	debug = true
+	defer func() { debug = false }()
+	if got := logSafe(body); got != body {
+		t.Errorf("body redacted in debug mode: %s", got)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// ErrSignalerClosed is returned when using a closed Signaler.
+var ErrSignalerClosed = errors.New("signaler closed")
+
+// SignalMessage is a message exchanged between the peers while connecting.
+// Either the description or the candidate is set.
+type SignalMessage struct {
+	Description *webrtc.SessionDescription `json:"description,omitempty"`
+	Candidate   *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
+	// Generation counts the PeerConnections the offerer created for the
+	// connection, starting at 0. An offer with a new generation comes from
+	// a rebuilt PeerConnection, which the answerer answers with a new
+	// PeerConnection as well.
+	Generation int `json:"generation,omitempty"`
+}
+
+// Signaler carries the offer, the answer and the trickled ICE candidates
+// between the two peers.
+type Signaler interface {
+	// Send delivers a message to the remote peer.
+	Send(ctx context.Context, msg SignalMessage) error
+	// Receive blocks until the next message of the remote peer arrives.
+	Receive(ctx context.Context) (SignalMessage, error)
+	// Close stops the signaling, Receive returns ErrSignalerClosed
+	// afterwards.
+	Close() error
+}
+
+// memorySignalerBuffer is the number of messages a memorySignaler buffers
+// before Send blocks.
+const memorySignalerBuffer = 64
+
+// memorySignaler is a Signaler for two peers running in the same process.
+// Closing one end closes both.
+type memorySignaler struct {
+	send    chan<- SignalMessage
+	receive <-chan SignalMessage
+
+	closeOnce *sync.Once
+	done      chan struct{}
+}
+
+// newMemorySignalers returns the two connected ends of an in-memory
+// Signaler.
+func newMemorySignalers() (Signaler, Signaler) {
+	ch1 := make(chan SignalMessage, memorySignalerBuffer)
+	ch2 := make(chan SignalMessage, memorySignalerBuffer)
+	closeOnce := &sync.Once{}
+	done := make(chan struct{})
+	return &memorySignaler{send: ch1, receive: ch2, closeOnce: closeOnce, done: done},
+		&memorySignaler{send: ch2, receive: ch1, closeOnce: closeOnce, done: done}
+}
+
+func (s *memorySignaler) Send(ctx context.Context, msg SignalMessage) error {
+	select {
+	case <-s.done:
+		return ErrSignalerClosed
+	default:
+	}
+	select {
+	case s.send <- msg:
+		return nil
+	case <-s.done:
+		return ErrSignalerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *memorySignaler) Receive(ctx context.Context) (SignalMessage, error) {
+	select {
+	case msg := <-s.receive:
+		return msg, nil
+	case <-s.done:
+		return SignalMessage{}, ErrSignalerClosed
+	case <-ctx.Done():
+		return SignalMessage{}, ctx.Err()
+	}
+}
+
+func (s *memorySignaler) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	return nil
+}
+
+// sendDescription sends the local description of the PeerConnection to the
+// remote peer. Without trickle ICE it waits for gathering to complete first,
+// so that the description contains all candidates.
+func sendDescription(ctx context.Context, pc *webrtc.PeerConnection, signaler Signaler, trickle bool) error {
+	if !trickle {
+		select {
+		case <-webrtc.GatheringCompletePromise(pc):
+		case <-ctx.Done():
+			return fmt.Errorf("error waiting for ICE gathering: %w", ctx.Err())
+		}
+	}
+	if err := signaler.Send(ctx, SignalMessage{Description: pc.LocalDescription()}); err != nil {
+		return fmt.Errorf("error sending %s: %w", pc.LocalDescription().Type, err)
+	}
+	return nil
+}
+
+// generationSignaler sends the messages of one PeerConnection of a peer,
+// tagged with its generation.
+type generationSignaler struct {
+	Signaler
+	generation int
+}
+
+func (s generationSignaler) Send(ctx context.Context, msg SignalMessage) error {
+	msg.Generation = s.generation
+	return s.Signaler.Send(ctx, msg)
+}
+
+// receiveSignals applies the descriptions and candidates of the remote peer
+// to the PeerConnection until the Signaler is closed or ctx is done. Offers
+// get answered through the Signaler. Candidates arriving before the remote
+// description are held back until it is set.
+func receiveSignals(ctx context.Context, pc *webrtc.PeerConnection, signaler Signaler, trickle bool) error {
+	var pending []webrtc.ICECandidateInit
+	for {
+		msg, err := signaler.Receive(ctx)
+		if err != nil {
+			return err
+		}
+		if err := applySignal(ctx, pc, signaler, trickle, msg, &pending); err != nil {
+			return err
+		}
+	}
+}
+
+// applySignal applies a description or candidate of the remote peer to the
+// PeerConnection, and answers offers through the Signaler. Candidates
+// arriving before the remote description are added to pending, and added
+// to the PeerConnection together with the description.
+func applySignal(ctx context.Context, pc *webrtc.PeerConnection, signaler Signaler, trickle bool, msg SignalMessage, pending *[]webrtc.ICECandidateInit) error {
+	switch {
+	case msg.Description != nil:
+		if err := pc.SetRemoteDescription(*msg.Description); err != nil {
+			return fmt.Errorf("error setting remote description: %w", err)
+		}
+		for _, candidate := range *pending {
+			if err := pc.AddICECandidate(candidate); err != nil {
+				return fmt.Errorf("error adding ICE candidate: %w", err)
+			}
+		}
+		*pending = nil
+
+		if msg.Description.Type != webrtc.SDPTypeOffer {
+			return nil
+		}
+		answer, err := pc.CreateAnswer(nil)
+		if err != nil {
+			return fmt.Errorf("error creating answer: %w", err)
+		}
+		if err := pc.SetLocalDescription(answer); err != nil {
+			return fmt.Errorf("error setting local description: %w", err)
+		}
+		return sendDescription(ctx, pc, signaler, trickle)
+
+	case msg.Candidate != nil:
+		if pc.RemoteDescription() == nil {
+			*pending = append(*pending, *msg.Candidate)
+			return nil
+		}
+		if err := pc.AddICECandidate(*msg.Candidate); err != nil {
+			return fmt.Errorf("error adding ICE candidate: %w", err)
+		}
+	}
+	return nil
+}
+
+// restartICE restarts ICE of the PeerConnection with a new offer, which the
+// remote peer answers in receiveSignals. The offer is only sent once the new
+// candidates are gathered, so that candidates trickled for the old
+// credentials can't get mixed up with the new ones.
+//
+// Note that the ICE agent of Pion keeps using the TURN servers and
+// credentials the PeerConnection was created with, a configuration set
+// with SetConfiguration afterwards is not applied by the restart. Once
+// they expired the PeerConnection has to be rebuilt, see Peer.Rebuild.
+func restartICE(ctx context.Context, pc *webrtc.PeerConnection, signaler Signaler) error {
+	offer, err := pc.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+	if err != nil {
+		return fmt.Errorf("error creating offer: %w", err)
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("error setting local description: %w", err)
+	}
+	return sendDescription(ctx, pc, signaler, false)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// newLoopbackAPI returns a Pion API which only gathers host candidates on
+// the loopback interface, so that peers connect without network access.
+func newLoopbackAPI() *webrtc.API {
+	var se webrtc.SettingEngine
+	se.SetIncludeLoopbackCandidate(true)
+	se.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	se.SetIPFilter(func(ip net.IP) bool { return ip.IsLoopback() })
+	return webrtc.NewAPI(webrtc.WithSettingEngine(se))
+}
+
+func TestSignaling(t *testing.T) {
+	for _, trickle := range []bool{true, false} {
+		name := "complete descriptions"
+		if trickle {
+			name = "trickle ICE"
+		}
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+
+			api := newLoopbackAPI()
+			peer1, err := api.NewPeerConnection(webrtc.Configuration{})
+			if err != nil {
+				t.Fatalf("error creating peer1: %v", err)
+			}
+			defer peer1.Close()
+			peer2, err := api.NewPeerConnection(webrtc.Configuration{})
+			if err != nil {
+				t.Fatalf("error creating peer2: %v", err)
+			}
+			defer peer2.Close()
+
+			signaler1, signaler2 := newMemorySignalers()
+			defer signaler1.Close()
+
+			var sent atomic.Int32
+			peer1.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+				if candidate == nil || !trickle {
+					return
+				}
+				sent.Add(1)
+				candJson := candidate.ToJSON()
+				if err := signaler1.Send(ctx, SignalMessage{Candidate: &candJson}); err != nil && !errors.Is(err, ErrSignalerClosed) {
+					t.Errorf("error sending candidate: %v", err)
+				}
+			})
+			peer2.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+				if candidate == nil || !trickle {
+					return
+				}
+				candJson := candidate.ToJSON()
+				if err := signaler2.Send(ctx, SignalMessage{Candidate: &candJson}); err != nil && !errors.Is(err, ErrSignalerClosed) {
+					t.Errorf("error sending candidate: %v", err)
+				}
+			})
+
+			received := make(chan string, 1)
+			peer2.OnDataChannel(func(d *webrtc.DataChannel) {
+				d.OnMessage(func(msg webrtc.DataChannelMessage) {
+					received <- string(msg.Data)
+				})
+			})
+			channel, err := peer1.CreateDataChannel("data", nil)
+			if err != nil {
+				t.Fatalf("error creating data channel: %v", err)
+			}
+			channel.OnOpen(func() {
+				if err := channel.SendText("hello"); err != nil {
+					t.Errorf("error sending message: %v", err)
+				}
+			})
+
+			errs := make(chan error, 2)
+			go func() { errs <- receiveSignals(ctx, peer1, signaler1, trickle) }()
+			go func() { errs <- receiveSignals(ctx, peer2, signaler2, trickle) }()
+
+			offer, err := peer1.CreateOffer(nil)
+			if err != nil {
+				t.Fatalf("error creating offer: %v", err)
+			}
+			if err := peer1.SetLocalDescription(offer); err != nil {
+				t.Fatalf("error setting local description: %v", err)
+			}
+			if err := sendDescription(ctx, peer1, signaler1, trickle); err != nil {
+				t.Fatalf("error sending offer: %v", err)
+			}
+
+			select {
+			case msg := <-received:
+				if msg != "hello" {
+					t.Errorf("received %q, want hello", msg)
+				}
+			case err := <-errs:
+				t.Fatalf("signaling failed: %v", err)
+			case <-ctx.Done():
+				t.Fatal("timed out waiting for the message")
+			}
+			if trickle && sent.Load() == 0 {
+				t.Error("no candidates were trickled")
+			}
+
+			// Closing one end stops the signaling of both peers.
+			signaler2.Close()
+			for range 2 {
+				if err := <-errs; !errors.Is(err, ErrSignalerClosed) {
+					t.Errorf("unexpected signaling error %v", err)
+				}
+			}
+			if err := signaler1.Send(ctx, SignalMessage{}); !errors.Is(err, ErrSignalerClosed) {
+				t.Errorf("sending on a closed signaler returned %v", err)
+			}
+		})
+	}
+}
+
+func TestHTTPSignaler(t *testing.T) {
+	server := httptest.NewServer(newSignalingHandler("signal-token"))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	offerer := newHTTPSignaler(server.Client(), server.URL, roleOfferer, "signal-token")
+	answerer := newHTTPSignaler(server.Client(), server.URL+"/", roleAnswerer, "signal-token")
+
+	description := &webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "v=0"}
+	if err := offerer.Send(ctx, SignalMessage{Description: description}); err != nil {
+		t.Fatalf("error sending description: %v", err)
+	}
+	candidate := &webrtc.ICECandidateInit{Candidate: "candidate:1 1 udp 1 127.0.0.1 5000 typ host"}
+	if err := answerer.Send(ctx, SignalMessage{Candidate: candidate}); err != nil {
+		t.Fatalf("error sending candidate: %v", err)
+	}
+
+	// A message stays queued until the next poll acknowledges it, so it
+	// isn't lost if the response of a poll doesn't reach the peer.
+	for range 2 {
+		answerer.acked = 0
+		msg, err := answerer.Receive(ctx)
+		if err != nil {
+			t.Fatalf("error receiving on the answerer: %v", err)
+		}
+		if msg.Description == nil || *msg.Description != *description {
+			t.Errorf("answerer received %+v", msg)
+		}
+	}
+	if err := offerer.Send(ctx, SignalMessage{Candidate: candidate}); err != nil {
+		t.Fatalf("error sending candidate: %v", err)
+	}
+	if msg, err := answerer.Receive(ctx); err != nil || msg.Candidate == nil {
+		t.Errorf("answerer received %+v, %v after acknowledging the description", msg, err)
+	}
+	msg, err := offerer.Receive(ctx)
+	if err != nil {
+		t.Fatalf("error receiving on the offerer: %v", err)
+	}
+	if msg.Candidate == nil || msg.Candidate.Candidate != candidate.Candidate {
+		t.Errorf("offerer received %+v", msg)
+	}
+
+	// Closing the signaler ends a pending poll.
+	done := make(chan error, 1)
+	go func() {
+		_, err := offerer.Receive(ctx)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	offerer.Close()
+	if err := <-done; !errors.Is(err, ErrSignalerClosed) {
+		t.Errorf("Receive on a closed signaler returned %v", err)
+	}
+	if err := offerer.Send(ctx, SignalMessage{}); !errors.Is(err, ErrSignalerClosed) {
+		t.Errorf("Send on a closed signaler returned %v", err)
+	}
+
+	for url, want := range map[string]int{
+		server.URL + "/signal/observer": http.StatusNotFound,
+		server.URL + "/signal/answerer": http.StatusUnauthorized,
+	} {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		if want != http.StatusUnauthorized {
+			req.Header.Set("Authorization", "Bearer signal-token")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET %s returned status %s, want %d", url, resp.Status, want)
+		}
+	}
+}
+
+func TestRestartICE(t *testing.T) {
+	for _, trickle := range []bool{true, false} {
+		name := "complete descriptions"
+		if trickle {
+			name = "trickle ICE"
+		}
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+
+			api := newLoopbackAPI()
+			peer1, err := api.NewPeerConnection(webrtc.Configuration{})
+			if err != nil {
+				t.Fatalf("error creating peer1: %v", err)
+			}
+			defer peer1.Close()
+			peer2, err := api.NewPeerConnection(webrtc.Configuration{})
+			if err != nil {
+				t.Fatalf("error creating peer2: %v", err)
+			}
+			defer peer2.Close()
+
+			signaler1, signaler2 := newMemorySignalers()
+			defer signaler1.Close()
+			for _, peer := range []struct {
+				pc       *webrtc.PeerConnection
+				signaler Signaler
+			}{{peer1, signaler1}, {peer2, signaler2}} {
+				peer.pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+					if candidate == nil || !trickle {
+						return
+					}
+					candJson := candidate.ToJSON()
+					if err := peer.signaler.Send(ctx, SignalMessage{Candidate: &candJson}); err != nil && !errors.Is(err, ErrSignalerClosed) {
+						t.Errorf("error sending candidate: %v", err)
+					}
+				})
+				go receiveSignals(ctx, peer.pc, peer.signaler, trickle)
+			}
+			iceStates := make(chan webrtc.ICEConnectionState, 16)
+			peer2.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+				iceStates <- state
+			})
+
+			if _, err := peer1.CreateDataChannel("data", nil); err != nil {
+				t.Fatalf("error creating data channel: %v", err)
+			}
+			offer, err := peer1.CreateOffer(nil)
+			if err != nil {
+				t.Fatalf("error creating offer: %v", err)
+			}
+			if err := peer1.SetLocalDescription(offer); err != nil {
+				t.Fatalf("error setting local description: %v", err)
+			}
+			if err := sendDescription(ctx, peer1, signaler1, trickle); err != nil {
+				t.Fatalf("error sending offer: %v", err)
+			}
+			waitICEState(t, ctx, iceStates, webrtc.ICEConnectionStateConnected)
+			description := peer2.RemoteDescription().SDP
+
+			// peer2 answers the restart and goes through checking again
+			// before it is connected with the new credentials.
+			if err := restartICE(ctx, peer1, signaler1); err != nil {
+				t.Fatalf("error restarting ICE: %v", err)
+			}
+			waitICEState(t, ctx, iceStates, webrtc.ICEConnectionStateChecking)
+			waitICEState(t, ctx, iceStates, webrtc.ICEConnectionStateConnected)
+			if peer2.RemoteDescription().SDP == description {
+				t.Error("peer2 did not receive the restart offer")
+			}
+		})
+	}
+}
+
+// waitICEState waits until the state is received on states.
+func waitICEState(t *testing.T, ctx context.Context, states <-chan webrtc.ICEConnectionState, want webrtc.ICEConnectionState) {
+	t.Helper()
+	for {
+		select {
+		case state := <-states:
+			if state == want {
+				return
+			}
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for ICE connection state %s", want)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// StatsSource is anything providing WebRTC stats, usually a
+// *webrtc.PeerConnection.
+type StatsSource interface {
+	GetStats() webrtc.StatsReport
+}
+
+// CandidateReport describes one of the candidates of the selected candidate
+// pair.
+type CandidateReport struct {
+	// Type is host, srflx, prflx or relay.
+	Type string `json:"type"`
+	// Protocol is the transport of the candidate, udp or tcp.
+	Protocol string `json:"protocol"`
+	// RelayProtocol is the transport between a local relay candidate and
+	// its TURN server, udp, tcp or tls.
+	RelayProtocol string `json:"relayProtocol,omitempty"`
+	IP            string `json:"ip"`
+	Port          int32  `json:"port"`
+}
+
+func (c *CandidateReport) String() string {
+	s := fmt.Sprintf("%s/%s %s:%d", c.Type, c.Protocol, c.IP, c.Port)
+	if c.RelayProtocol != "" {
+		s += fmt.Sprintf(" (TURN over %s)", c.RelayProtocol)
+	}
+	return s
+}
+
+// ConnectionReport is a connection-quality report of a PeerConnection.
+type ConnectionReport struct {
+	Peer string    `json:"peer"`
+	Time time.Time `json:"time"`
+	// Local and Remote are nil as long as no candidate pair is selected.
+	Local  *CandidateReport `json:"local,omitempty"`
+	Remote *CandidateReport `json:"remote,omitempty"`
+	// Transport is how the selected pair connects: TURN/UDP, TURN/TCP or
+	// TURN/TLS when relayed through TURN, otherwise UDP or TCP.
+	Transport string `json:"transport,omitempty"`
+	// RTTMillis is the current round trip time of the selected pair.
+	RTTMillis     float64 `json:"rttMs"`
+	BytesSent     uint64  `json:"bytesSent"`
+	BytesReceived uint64  `json:"bytesReceived"`
+	// MessagesSent and MessagesReceived are summed up over all data
+	// channels.
+	MessagesSent     uint32 `json:"messagesSent"`
+	MessagesReceived uint32 `json:"messagesReceived"`
+}
+
+func (r ConnectionReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: ", r.Peer)
+	if r.Local != nil && r.Remote != nil {
+		fmt.Fprintf(&b, "%v -> %v over %s, rtt %.1fms", r.Local, r.Remote, r.Transport, r.RTTMillis)
+	} else {
+		b.WriteString("no selected candidate pair")
+	}
+	fmt.Fprintf(&b, ", sent %d bytes, received %d bytes, data channel messages sent %d, received %d",
+		r.BytesSent, r.BytesReceived, r.MessagesSent, r.MessagesReceived)
+	return b.String()
+}
+
+// newConnectionReport builds a ConnectionReport from the stats of a
+// PeerConnection.
+func newConnectionReport(peer string, stats webrtc.StatsReport) ConnectionReport {
+	report := ConnectionReport{Peer: peer, Time: time.Now()}
+	if pair, local, remote, ok := selectedCandidatePair(stats); ok {
+		report.Local = candidateReport(local)
+		report.Remote = candidateReport(remote)
+		report.Transport = candidateTransport(local)
+		report.RTTMillis = pair.CurrentRoundTripTime * 1000
+	}
+	for _, s := range stats {
+		switch stat := s.(type) {
+		case webrtc.TransportStats:
+			// Pion doesn't count the bytes of candidate pairs, only
+			// those of the ICE transport.
+			report.BytesSent += stat.BytesSent
+			report.BytesReceived += stat.BytesReceived
+		case webrtc.DataChannelStats:
+			report.MessagesSent += stat.MessagesSent
+			report.MessagesReceived += stat.MessagesReceived
+		}
+	}
+	return report
+}
+
+// selectedCandidatePair returns the nominated candidate pair which
+// succeeded, together with its local and remote candidate. Pion doesn't
+// fill the SelectedCandidatePairID of the transport stats, so the pair has
+// to be looked up by its state.
+func selectedCandidatePair(stats webrtc.StatsReport) (pair webrtc.ICECandidatePairStats, local, remote webrtc.ICECandidateStats, ok bool) {
+	for _, s := range stats {
+		p, isPair := s.(webrtc.ICECandidatePairStats)
+		if !isPair || p.State != webrtc.StatsICECandidatePairStateSucceeded || !p.Nominated {
+			continue
+		}
+		local, localOK := stats[p.LocalCandidateID].(webrtc.ICECandidateStats)
+		remote, remoteOK := stats[p.RemoteCandidateID].(webrtc.ICECandidateStats)
+		if localOK && remoteOK {
+			return p, local, remote, true
+		}
+	}
+	return webrtc.ICECandidatePairStats{}, webrtc.ICECandidateStats{}, webrtc.ICECandidateStats{}, false
+}
+
+func candidateReport(stats webrtc.ICECandidateStats) *CandidateReport {
+	return &CandidateReport{
+		Type:          stats.CandidateType.String(),
+		Protocol:      stats.Protocol,
+		RelayProtocol: stats.RelayProtocol,
+		IP:            stats.IP,
+		Port:          stats.Port,
+	}
+}
+
+// candidateTransport returns the transport of a local candidate, for relay
+// candidates the one to the TURN server.
+func candidateTransport(local webrtc.ICECandidateStats) string {
+	if local.CandidateType != webrtc.ICECandidateTypeRelay {
+		return strings.ToUpper(local.Protocol)
+	}
+	if local.RelayProtocol == "" {
+		return "TURN"
+	}
+	return "TURN/" + strings.ToUpper(local.RelayProtocol)
+}
+
+// StatsReporter writes connection reports of PeerConnections, either as
+// text lines or as JSON objects, one per line.
+type StatsReporter struct {
+	out    io.Writer
+	asJSON bool
+
+	mu      sync.Mutex
+	names   []string
+	sources map[string]StatsSource
+}
+
+// NewStatsReporter returns a StatsReporter writing to out.
+func NewStatsReporter(out io.Writer, asJSON bool) *StatsReporter {
+	return &StatsReporter{out: out, asJSON: asJSON, sources: make(map[string]StatsSource)}
+}
+
+// Add adds a PeerConnection to the reports, or replaces the one with the
+// same name.
+func (r *StatsReporter) Add(name string, source StatsSource) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.sources[name]; !ok {
+		r.names = append(r.names, name)
+	}
+	r.sources[name] = source
+}
+
+// Report writes a report for every PeerConnection.
+func (r *StatsReporter) Report() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, name := range r.names {
+		report := newConnectionReport(name, r.sources[name].GetStats())
+		var err error
+		if r.asJSON {
+			err = json.NewEncoder(r.out).Encode(report)
+		} else {
+			_, err = fmt.Fprintln(r.out, report)
+		}
+		if err != nil {
+			return fmt.Errorf("error writing stats report: %w", err)
+		}
+	}
+	return nil
+}
+
+// Run writes the reports every interval until ctx is done.
+func (r *StatsReporter) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.Report(); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// startStatsReporter writes the first reports right away and, if
+// configured, keeps writing them in the background.
+func startStatsReporter(ctx context.Context, cfg *config, reporter *StatsReporter) {
+	if err := reporter.Report(); err != nil {
+		log.Printf("%v", err)
+	}
+	if cfg.StatsInterval > 0 {
+		go func() {
+			if err := reporter.Run(ctx, cfg.StatsInterval); err != nil && ctx.Err() == nil {
+				log.Printf("%v", err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+type fakeStats webrtc.StatsReport
+
+func (f fakeStats) GetStats() webrtc.StatsReport {
+	return webrtc.StatsReport(f)
+}
+
+// testStats returns stats with a relay candidate connected to a host
+// candidate, and a second pair which was checked but not nominated.
+func testStats() webrtc.StatsReport {
+	return webrtc.StatsReport{
+		"local-relay": webrtc.ICECandidateStats{
+			Type: webrtc.StatsTypeLocalCandidate, ID: "local-relay", IP: "192.0.2.1", Port: 50000,
+			Protocol: "udp", CandidateType: webrtc.ICECandidateTypeRelay, RelayProtocol: "tls",
+		},
+		"local-host": webrtc.ICECandidateStats{
+			Type: webrtc.StatsTypeLocalCandidate, ID: "local-host", IP: "10.0.0.1", Port: 50001,
+			Protocol: "udp", CandidateType: webrtc.ICECandidateTypeHost,
+		},
+		"remote-host": webrtc.ICECandidateStats{
+			Type: webrtc.StatsTypeRemoteCandidate, ID: "remote-host", IP: "198.51.100.1", Port: 3478,
+			Protocol: "udp", CandidateType: webrtc.ICECandidateTypeHost,
+		},
+		"pair-host": webrtc.ICECandidatePairStats{
+			Type: webrtc.StatsTypeCandidatePair, ID: "pair-host", LocalCandidateID: "local-host", RemoteCandidateID: "remote-host",
+			State: webrtc.StatsICECandidatePairStateSucceeded,
+		},
+		"pair-relay": webrtc.ICECandidatePairStats{
+			Type: webrtc.StatsTypeCandidatePair, ID: "pair-relay", LocalCandidateID: "local-relay", RemoteCandidateID: "remote-host",
+			State: webrtc.StatsICECandidatePairStateSucceeded, Nominated: true, CurrentRoundTripTime: 0.025,
+		},
+		"iceTransport": webrtc.TransportStats{
+			Type: webrtc.StatsTypeTransport, ID: "iceTransport", BytesSent: 1200, BytesReceived: 3400,
+		},
+		"dc-1": webrtc.DataChannelStats{Type: webrtc.StatsTypeDataChannel, ID: "dc-1", MessagesSent: 3, MessagesReceived: 1},
+		"dc-2": webrtc.DataChannelStats{Type: webrtc.StatsTypeDataChannel, ID: "dc-2", MessagesSent: 2, MessagesReceived: 4},
+	}
+}
+
+func TestSelectedCandidatePair(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// change modifies the test stats.
+		change func(stats webrtc.StatsReport)
+		// want is the ID of the selected pair, empty if none is selected.
+		want string
+	}{
+		{name: "nominated", change: func(webrtc.StatsReport) {}, want: "pair-relay"},
+		{name: "none nominated", change: func(stats webrtc.StatsReport) { delete(stats, "pair-relay") }},
+		{name: "missing local candidate", change: func(stats webrtc.StatsReport) { delete(stats, "local-relay") }},
+		{name: "missing remote candidate", change: func(stats webrtc.StatsReport) { delete(stats, "remote-host") }},
+		{name: "nominated but failed", change: func(stats webrtc.StatsReport) {
+			pair := stats["pair-relay"].(webrtc.ICECandidatePairStats)
+			pair.State = webrtc.StatsICECandidatePairStateFailed
+			stats["pair-relay"] = pair
+		}},
+		{name: "no stats", change: func(stats webrtc.StatsReport) { clear(stats) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stats := testStats()
+			tc.change(stats)
+			pair, local, remote, ok := selectedCandidatePair(stats)
+			if tc.want == "" {
+				if ok {
+					t.Errorf("selected pair %s although none should be", pair.ID)
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("no selected candidate pair found")
+			}
+			if pair.ID != tc.want || local.ID != pair.LocalCandidateID || remote.ID != pair.RemoteCandidateID {
+				t.Errorf("unexpected pair %s with candidates %s and %s", pair.ID, local.ID, remote.ID)
+			}
+		})
+	}
+}
+
+func TestCandidateTransport(t *testing.T) {
+	for _, tc := range []struct {
+		candidateType webrtc.ICECandidateType
+		protocol      string
+		relayProtocol string
+		want          string
+	}{
+		{webrtc.ICECandidateTypeHost, "udp", "", "UDP"},
+		{webrtc.ICECandidateTypeHost, "tcp", "", "TCP"},
+		{webrtc.ICECandidateTypeSrflx, "udp", "", "UDP"},
+		{webrtc.ICECandidateTypeRelay, "udp", "udp", "TURN/UDP"},
+		{webrtc.ICECandidateTypeRelay, "udp", "tcp", "TURN/TCP"},
+		{webrtc.ICECandidateTypeRelay, "udp", "tls", "TURN/TLS"},
+		{webrtc.ICECandidateTypeRelay, "udp", "", "TURN"},
+	} {
+		local := webrtc.ICECandidateStats{CandidateType: tc.candidateType, Protocol: tc.protocol, RelayProtocol: tc.relayProtocol}
+		if got := candidateTransport(local); got != tc.want {
+			t.Errorf("transport of %s/%s candidate with relay protocol %q is %q, want %q", tc.candidateType, tc.protocol, tc.relayProtocol, got, tc.want)
+		}
+	}
+}
+
+func TestConnectionReport(t *testing.T) {
+	report := newConnectionReport("peer1", testStats())
+
+	want := CandidateReport{Type: "relay", Protocol: "udp", RelayProtocol: "tls", IP: "192.0.2.1", Port: 50000}
+	if report.Local == nil || *report.Local != want {
+		t.Errorf("local candidate %+v, want %+v", report.Local, want)
+	}
+	want = CandidateReport{Type: "host", Protocol: "udp", IP: "198.51.100.1", Port: 3478}
+	if report.Remote == nil || *report.Remote != want {
+		t.Errorf("remote candidate %+v, want %+v", report.Remote, want)
+	}
+	if report.Transport != "TURN/TLS" {
+		t.Errorf("transport %q, want TURN/TLS", report.Transport)
+	}
+	if report.RTTMillis != 25 {
+		t.Errorf("RTT %vms, want 25ms", report.RTTMillis)
+	}
+	if report.BytesSent != 1200 || report.BytesReceived != 3400 {
+		t.Errorf("bytes sent %d and received %d", report.BytesSent, report.BytesReceived)
+	}
+	if report.MessagesSent != 5 || report.MessagesReceived != 5 {
+		t.Errorf("messages sent %d and received %d", report.MessagesSent, report.MessagesReceived)
+	}
+
+	text := report.String()
+	for _, part := range []string{"relay/udp 192.0.2.1:50000 (TURN over tls)", "host/udp 198.51.100.1:3478 over TURN/TLS", "rtt 25.0ms"} {
+		if !strings.Contains(text, part) {
+			t.Errorf("report %q does not contain %q", text, part)
+		}
+	}
+
+	empty := newConnectionReport("peer2", webrtc.StatsReport{})
+	if empty.Local != nil || empty.Remote != nil || !strings.Contains(empty.String(), "no selected candidate pair") {
+		t.Errorf("unexpected report without a selected pair: %v", empty)
+	}
+}
+
+func TestStatsReporter(t *testing.T) {
+	var out bytes.Buffer
+	reporter := NewStatsReporter(&out, true)
+	reporter.Add("peer1", fakeStats(testStats()))
+	reporter.Add("peer2", fakeStats(webrtc.StatsReport{}))
+	if err := reporter.Report(); err != nil {
+		t.Fatalf("Report failed: %v", err)
+	}
+
+	decoder := json.NewDecoder(&out)
+	for _, peer := range []string{"peer1", "peer2"} {
+		var report ConnectionReport
+		if err := decoder.Decode(&report); err != nil {
+			t.Fatalf("error decoding report: %v", err)
+		}
+		if report.Peer != peer {
+			t.Errorf("got report of %q, want %q", report.Peer, peer)
+		}
+	}
+	if decoder.More() {
+		t.Error("unexpected additional reports")
+	}
+
+	out.Reset()
+	reporter = NewStatsReporter(&out, false)
+	reporter.Add("peer1", fakeStats(testStats()))
+	if err := reporter.Report(); err != nil {
+		t.Fatalf("Report failed: %v", err)
+	}
+	if !strings.HasPrefix(out.String(), "peer1: relay/udp") || strings.Count(out.String(), "\n") != 1 {
+		t.Errorf("unexpected text report %q", out.String())
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Transports of TURN URLs, as selected with the -ice-transport-policy flag.
+const (
+	turnTransportUDP = "udp"
+	turnTransportTCP = "tcp"
+	turnTransportTLS = "tls"
+)
+
+// turnURLTransport returns the transport used to reach the TURN server of
+// url: tls for turns: URLs, otherwise the transport parameter, which
+// defaults to udp. It returns an empty string for STUN URLs.
+func turnURLTransport(url string) string {
+	scheme, rest, _ := strings.Cut(url, ":")
+	switch strings.ToLower(scheme) {
+	case "turns":
+		return turnTransportTLS
+	case "turn":
+		_, query, _ := strings.Cut(rest, "?")
+		for _, param := range strings.Split(query, "&") {
+			if value, ok := strings.CutPrefix(param, "transport="); ok {
+				return strings.ToLower(value)
+			}
+		}
+		return turnTransportUDP
+	default:
+		return ""
+	}
+}
+
+// filterTurnTransport keeps only the TURN URLs using the given transport,
+// so that connecting shows whether TURN works over it. STUN URLs and ICE
+// servers left without URLs are dropped. An empty transport keeps all
+// servers.
+func filterTurnTransport(servers []IceServer, transport string) ([]IceServer, error) {
+	if transport == "" {
+		return servers, nil
+	}
+	var filtered []IceServer
+	for _, server := range servers {
+		var urls []string
+		for _, url := range server.URLs {
+			if turnURLTransport(url) == transport {
+				urls = append(urls, url)
+			}
+		}
+		if len(urls) > 0 {
+			server.URLs = urls
+			filtered = append(filtered, server)
+		}
+	}
+	if len(filtered) == 0 {
+		return nil, fmt.Errorf("the ICE servers contain no TURN URLs with transport %s", transport)
+	}
+	return filtered, nil
+}
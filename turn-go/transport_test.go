@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilterLocalTurnTransport(t *testing.T) {
+	local, err := startLocalTurn()
+	if err != nil {
+		t.Fatalf("error starting local TURN server: %v", err)
+	}
+	defer local.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	servers, err := newLocalTurnClient(local, local.APIToken).GenerateICEServers(ctx, time.Hour)
+	if err != nil {
+		t.Fatalf("error fetching credentials: %v", err)
+	}
+
+	if all, err := filterTurnTransport(servers, ""); err != nil || len(all) != len(servers) {
+		t.Errorf("filtering without a transport returned %v, %v", all, err)
+	}
+	// The local TURN server listens on UDP and TCP, the STUN URL is dropped
+	// with either transport.
+	for _, transport := range []string{turnTransportUDP, turnTransportTCP} {
+		filtered, err := filterTurnTransport(servers, transport)
+		if err != nil {
+			t.Fatalf("error filtering for %s: %v", transport, err)
+		}
+		if len(filtered) != 1 || len(filtered[0].URLs) != 1 || !strings.HasSuffix(filtered[0].URLs[0], "?transport="+transport) || filtered[0].Username == "" {
+			t.Errorf("filtering for %s returned %+v", transport, filtered)
+		}
+	}
+	// -local has no TLS listener, so -ice-transport-policy=turns fails
+	// before connecting.
+	if _, err := filterTurnTransport(servers, turnTransportTLS); err == nil {
+		t.Error("expected an error without any TURN URLs over TLS")
+	}
+}
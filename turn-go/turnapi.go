@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cloudflareAPIBaseURL is the base URL of the Cloudflare Calls and TURN API.
+const cloudflareAPIBaseURL = "https://rtc.live.cloudflare.com/v1"
+
+// turnCredentialsEndpoint is the endpoint generating TURN credentials, with
+// the TURN key ID as placeholder. It also labels the metrics of its calls.
+const turnCredentialsEndpoint = "/turn/keys/{keyId}/credentials/generate-ice-servers"
+
+// IceServer represents the structure of an iceServer entry in the JSON.
+type IceServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`   // Use omitempty to handle missing fields
+	Credential string   `json:"credential,omitempty"` // Use omitempty to handle missing fields
+}
+
+// Response represents the top-level JSON structure.
+type Response struct {
+	IceServers []IceServer `json:"iceServers"`
+}
+
+// RetryPolicy controls how the TurnClient retries failed API calls.
+// Generating credentials has no side effects, so calls are retried on
+// network errors and on temporary errors of the API.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts per API call, values
+	// below 2 disable retries.
+	MaxAttempts int
+	// InitialBackoff is the backoff before the first retry, it is doubled
+	// for every further retry up to MaxBackoff. A random jitter of up to
+	// half the backoff is subtracted. A longer Retry-After of the API is
+	// honored up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy of clients created by
+// NewTurnClient.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 250 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+}
+
+// backoff returns the jittered backoff before the given retry, starting
+// at 1.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < retry && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, p.MaxBackoff)
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff - rand.N(backoff/2+1)
+}
+
+// APIError is returned by the TurnClient when the API responds with an
+// unexpected status code.
+type APIError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+	// RequestID identifies the request in Cloudflare's logs.
+	RequestID string
+	// Body is the response body, redacted unless debugging.
+	Body string
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("API request %s %s failed with status %s", e.Method, e.URL, e.Status)
+	if e.RequestID != "" {
+		msg += fmt.Sprintf(" (request ID %s)", e.RequestID)
+	}
+	return fmt.Sprintf("%s: %s", msg, e.Body)
+}
+
+// Temporary reports whether the request may succeed when it is retried,
+// which is the case for rate limiting and server errors.
+func (e *APIError) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// TurnClient generates short-lived credentials for Cloudflare's TURN
+// service with a TURN key.
+type TurnClient struct {
+	BaseURL    string
+	KeyID      string
+	Token      string
+	HTTPClient *http.Client
+	// Retry is the policy for retrying failed API calls.
+	Retry RetryPolicy
+
+	// sleep waits between retries, it is replaced in tests.
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// NewTurnClient returns a TurnClient for the given TURN key which uses the
+// default API base URL.
+func NewTurnClient(keyID, token string) *TurnClient {
+	return &TurnClient{
+		BaseURL:    cloudflareAPIBaseURL,
+		KeyID:      keyID,
+		Token:      token,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+		Retry:      DefaultRetryPolicy,
+	}
+}
+
+// GenerateICEServers fetches TURN credentials valid for ttl from the
+// Cloudflare API. Every iceServers entry of the response is returned,
+// including STUN-only entries which come without a username and credential.
+func (c *TurnClient) GenerateICEServers(ctx context.Context, ttl time.Duration) ([]IceServer, error) {
+	endpoint := c.BaseURL + strings.Replace(turnCredentialsEndpoint, "{keyId}", c.KeyID, 1)
+
+	// Request body for the TURN credentials API.
+	requestBody := map[string]interface{}{
+		"ttl": int(ttl.Seconds()), // Time-to-live in seconds
+	}
+	requestBodyJSON, err := json.Marshal(requestBody)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling request body: %w", err)
+	}
+
+	sleep := c.sleep
+	if sleep == nil {
+		sleep = sleepContext
+	}
+	var response Response
+	for attempt := 1; ; attempt++ {
+		var wait time.Duration
+		wait, err = c.doRequest(ctx, endpoint, requestBodyJSON, &response)
+		if err == nil || attempt >= c.Retry.MaxAttempts || !shouldRetry(err) {
+			break
+		}
+		wait = min(max(wait, c.Retry.backoff(attempt)), c.Retry.MaxBackoff)
+		if sleep(ctx, wait) != nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error making TURN HTTP API call: %w", err)
+	}
+
+	if len(response.IceServers) == 0 {
+		return nil, errors.New("API response did not contain any ICE servers")
+	}
+
+	return response.IceServers, nil
+}
+
+// doRequest makes a single attempt of the API call. On failure it also
+// returns how long the API asked to wait before retrying.
+func (c *TurnClient) doRequest(ctx context.Context, endpoint string, requestBody []byte, response *Response) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(requestBody))
+	if err != nil {
+		return 0, fmt.Errorf("error creating HTTP request: %w", err)
+	}
+
+	// Set the authorization header with the API token.
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+	req.Header.Set("Content-Type", "application/json") // Add content type header
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error sending HTTP request: %w", err)
+	}
+	defer resp.Body.Close() // ensure body is closed
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("error reading response body: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		requestID := resp.Header.Get("Cf-Ray")
+		if requestID == "" {
+			requestID = resp.Header.Get("X-Request-Id")
+		}
+		return retryAfter(resp.Header, time.Now()), &APIError{
+			Method:     req.Method,
+			URL:        req.URL.String(),
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			RequestID:  requestID,
+			Body:       logSafe(string(body)),
+		}
+	}
+
+	if err := json.Unmarshal(body, response); err != nil {
+		return 0, fmt.Errorf("error unmarshalling JSON response: %w", err)
+	}
+	return 0, nil
+}
+
+// shouldRetry reports whether a call which failed with err may be retried.
+func shouldRetry(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Temporary()
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	// Network errors.
+	return true
+}
+
+// retryAfter parses the Retry-After header, which holds either a number of
+// seconds or an HTTP date. It returns 0 if the header is missing or invalid.
+func retryAfter(header http.Header, now time.Time) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0)
+	}
+	return 0
+}
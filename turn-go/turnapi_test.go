@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestTurnClient returns a TURN client for the handler which records the
+// waits between retries instead of sleeping.
+func newTestTurnClient(t *testing.T, handler http.HandlerFunc) (*TurnClient, *[]time.Duration) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	var waits []time.Duration
+	client := NewTurnClient("key", "token")
+	client.BaseURL = server.URL
+	client.HTTPClient = server.Client()
+	client.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return ctx.Err()
+	}
+	return client, &waits
+}
+
+func TestTurnClientRetry(t *testing.T) {
+	var attempts atomic.Int32
+	client, waits := newTestTurnClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch attempts.Add(1) {
+		case 1:
+			w.Header().Set("Retry-After", "2")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"iceServers":[{"urls":["turn:turn.example.com:3478"],"username":"user","credential":"secret"}]}`))
+		}
+	})
+	client.Retry.InitialBackoff = 100 * time.Millisecond
+
+	servers, err := client.GenerateICEServers(context.Background(), time.Hour)
+	if err != nil {
+		t.Fatalf("GenerateICEServers failed: %v", err)
+	}
+	if len(servers) != 1 || servers[0].Credential != "secret" {
+		t.Errorf("unexpected servers %+v", servers)
+	}
+	// The first wait honors Retry-After, the second one is the jittered
+	// backoff of the second retry.
+	if len(*waits) != 2 || (*waits)[0] != 2*time.Second || (*waits)[1] < 100*time.Millisecond || (*waits)[1] > 200*time.Millisecond {
+		t.Errorf("unexpected waits %v", *waits)
+	}
+}
+
+func TestTurnClientRetryAfterLimit(t *testing.T) {
+	var attempts atomic.Int32
+	client, waits := newTestTurnClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"iceServers":[{"urls":["turn:turn.example.com:3478"],"username":"user","credential":"secret"}]}`))
+	})
+
+	if _, err := client.GenerateICEServers(context.Background(), time.Hour); err != nil {
+		t.Fatalf("GenerateICEServers failed: %v", err)
+	}
+	// A Retry-After longer than MaxBackoff is capped.
+	if len(*waits) != 1 || (*waits)[0] != client.Retry.MaxBackoff {
+		t.Errorf("unexpected waits %v, want %v", *waits, client.Retry.MaxBackoff)
+	}
+}
+
+func TestTurnClientErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		status   int
+		body     string
+		attempts int32
+		// temporary is whether an APIError is expected and temporary.
+		temporary bool
+	}{
+		{name: "unauthorized", status: http.StatusUnauthorized, body: `{"credential":"leaked"}`, attempts: 1},
+		{name: "server error", status: http.StatusServiceUnavailable, attempts: 3, temporary: true},
+		{name: "invalid response", status: http.StatusCreated, body: "not json", attempts: 1},
+		{name: "no ICE servers", status: http.StatusCreated, body: `{"iceServers":[]}`, attempts: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			client, _ := newTestTurnClient(t, func(w http.ResponseWriter, r *http.Request) {
+				attempts.Add(1)
+				w.Header().Set("Cf-Ray", "ray-id")
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			})
+
+			_, err := client.GenerateICEServers(context.Background(), time.Hour)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if n := attempts.Load(); n != tc.attempts {
+				t.Errorf("made %d attempts, want %d", n, tc.attempts)
+			}
+			var apiErr *APIError
+			if tc.status == http.StatusCreated {
+				if errors.As(err, &apiErr) {
+					t.Errorf("unexpected APIError %v", err)
+				}
+				return
+			}
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("expected an APIError, got %v", err)
+			}
+			if apiErr.StatusCode != tc.status || apiErr.RequestID != "ray-id" || apiErr.Temporary() != tc.temporary {
+				t.Errorf("unexpected error %+v", apiErr)
+			}
+			if apiErr.Body != tc.body && apiErr.Body != `{"credential":"[REDACTED]"}` {
+				t.Errorf("credential not redacted in %q", apiErr.Body)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for value, want := range map[string]time.Duration{
+		"":                              0,
+		"3":                             3 * time.Second,
+		"-1":                            0,
+		"Mon, 01 Jan 2024 12:00:05 GMT": 5 * time.Second,
+		"Mon, 01 Jan 2024 11:00:00 GMT": 0,
+		"soon":                          0,
+	} {
+		header := http.Header{}
+		if value != "" {
+			header.Set("Retry-After", value)
+		}
+		if got := retryAfter(header, now); got != want {
+			t.Errorf("retryAfter(%q) = %v, want %v", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Clock abstracts the passing of time, so that the credential refresh can be
+// tested without waiting for real TTLs to expire.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// TurnCredentialFetcher requests new ICE servers with credentials which are
+// valid for the given TTL.
+type TurnCredentialFetcher func(ctx context.Context, ttl time.Duration) ([]IceServer, error)
+
+// TurnCredentialProvider caches TURN credentials, so that both peers share
+// them, and refreshes them in the background before they expire.
+//
+// Refreshed credentials only reach PeerConnections created afterwards.
+// Pion's ICE agent keeps the ICE servers a PeerConnection was created with,
+// also for ICE restarts, and a configuration set with SetConfiguration
+// isn't applied to it, so a connection can't outlive the TTL of the
+// credentials it was created with. Run therefore passes every refresh to
+// OnRenew, e.g. to let the ReconnectSupervisor of the offerer rebuild the
+// PeerConnections with the new credentials before the old ones expire.
+type TurnCredentialProvider struct {
+	// TTL which gets requested for new credentials.
+	TTL time.Duration
+	// RefreshFraction is the fraction of the TTL after which the
+	// credentials get refreshed, e.g. 0.8 refreshes after 80% of the TTL.
+	RefreshFraction float64
+	// RetryInterval is the delay before retrying a failed refresh.
+	RetryInterval time.Duration
+	// Clock is used for all time keeping.
+	Clock Clock
+	// OnRefresh is called after every attempt to fetch credentials, with
+	// the error if it failed.
+	OnRefresh func(err error)
+	// OnRenew is called after Run refreshed the credentials, with their
+	// expiry.
+	OnRenew func(expiry time.Time)
+
+	fetch TurnCredentialFetcher
+	// fetching serializes the fetches of ICEServers and Run, so that peers
+	// connecting at the same time share the credentials.
+	fetching sync.Mutex
+
+	mu        sync.Mutex
+	servers   []webrtc.ICEServer
+	expiry    time.Time
+	refreshAt time.Time
+}
+
+// NewTurnCredentialProvider returns a provider which uses fetch to request
+// credentials with the given TTL.
+func NewTurnCredentialProvider(fetch TurnCredentialFetcher, ttl time.Duration) *TurnCredentialProvider {
+	return &TurnCredentialProvider{
+		TTL:             ttl,
+		RefreshFraction: 0.8,
+		RetryInterval:   30 * time.Second,
+		Clock:           realClock{},
+		fetch:           fetch,
+	}
+}
+
+// ICEServers returns the cached ICE servers. New credentials get fetched if
+// there are none yet or the cached ones have expired.
+func (p *TurnCredentialProvider) ICEServers(ctx context.Context) ([]webrtc.ICEServer, error) {
+	p.fetching.Lock()
+	defer p.fetching.Unlock()
+	p.mu.Lock()
+	servers := p.servers
+	valid := servers != nil && p.Clock.Now().Before(p.expiry)
+	p.mu.Unlock()
+
+	if valid {
+		return servers, nil
+	}
+	if err := p.Refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.servers, nil
+}
+
+// Expiry returns the time at which the cached credentials expire. It is the
+// zero time if no credentials have been fetched yet.
+func (p *TurnCredentialProvider) Expiry() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.expiry
+}
+
+// Refresh fetches new credentials right away.
+func (p *TurnCredentialProvider) Refresh(ctx context.Context) error {
+	issued := p.Clock.Now()
+	servers, err := p.fetch(ctx, p.TTL)
+	if p.OnRefresh != nil {
+		p.OnRefresh(err)
+	}
+	if err != nil {
+		return fmt.Errorf("error refreshing TURN credentials: %w", err)
+	}
+	iceServers := toWebrtcICEServers(servers)
+
+	p.mu.Lock()
+	p.servers = iceServers
+	p.expiry = issued.Add(p.TTL)
+	p.refreshAt = issued.Add(time.Duration(float64(p.TTL) * p.RefreshFraction))
+	p.mu.Unlock()
+	return nil
+}
+
+// Run refreshes the credentials in the background until ctx is done.
+func (p *TurnCredentialProvider) Run(ctx context.Context) {
+	for {
+		p.mu.Lock()
+		wait := p.refreshAt.Sub(p.Clock.Now())
+		p.mu.Unlock()
+		if wait < 0 {
+			wait = 0
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.Clock.After(wait):
+		}
+
+		refreshed, err := p.refreshScheduled(ctx)
+		if err != nil {
+			log.Printf("%v, retrying in %v", err, p.RetryInterval)
+			p.mu.Lock()
+			p.refreshAt = p.Clock.Now().Add(p.RetryInterval)
+			p.mu.Unlock()
+			continue
+		}
+		if refreshed && p.OnRenew != nil {
+			p.OnRenew(p.Expiry())
+		}
+	}
+}
+
+// refreshScheduled refreshes the credentials for Run, unless ICEServers
+// refreshed them in the meantime, and reports whether it did.
+func (p *TurnCredentialProvider) refreshScheduled(ctx context.Context) (bool, error) {
+	p.fetching.Lock()
+	defer p.fetching.Unlock()
+	p.mu.Lock()
+	due := !p.Clock.Now().Before(p.refreshAt)
+	p.mu.Unlock()
+	if !due {
+		return false, nil
+	}
+	return true, p.Refresh(ctx)
+}
+
+// toWebrtcICEServers maps every entry from the API response into a Pion ICE
+// server, so that all URLs handed out by Cloudflare are used with their
+// respective credentials.
+func toWebrtcICEServers(servers []IceServer) []webrtc.ICEServer {
+	iceServers := make([]webrtc.ICEServer, 0, len(servers))
+	for _, server := range servers {
+		iceServer := webrtc.ICEServer{
+			URLs: server.URLs,
+		}
+		// STUN-only entries come without credentials.
+		if server.Username != "" || server.Credential != "" {
+			iceServer.Username = server.Username
+			iceServer.Credential = server.Credential
+			iceServer.CredentialType = webrtc.ICECredentialTypePassword
+		}
+		iceServers = append(iceServers, iceServer)
+	}
+	return iceServers
+}
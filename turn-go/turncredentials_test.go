@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+type fakeTimer struct {
+	d  time.Duration
+	ch chan time.Time
+}
+
+// fakeClock only advances when a test fires one of the pending timers.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers chan fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		timers: make(chan fakeTimer, 1),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.timers <- fakeTimer{d: d, ch: ch}
+	return ch
+}
+
+// next waits for the next pending timer.
+func (c *fakeClock) next(t *testing.T) fakeTimer {
+	t.Helper()
+	select {
+	case timer := <-c.timers:
+		return timer
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a timer")
+		return fakeTimer{}
+	}
+}
+
+// fire advances the clock past the given timer and fires it.
+func (c *fakeClock) fire(timer fakeTimer) time.Duration {
+	c.mu.Lock()
+	c.now = c.now.Add(timer.d)
+	now := c.now
+	c.mu.Unlock()
+	timer.ch <- now
+	return timer.d
+}
+
+func TestTurnCredentialProviderRefresh(t *testing.T) {
+	clock := newFakeClock()
+	fetches := make(chan time.Duration, 10)
+	var count int
+	fetch := func(ctx context.Context, ttl time.Duration) ([]IceServer, error) {
+		count++
+		fetches <- ttl
+		return []IceServer{
+			{URLs: []string{"stun:stun.cloudflare.com:3478"}},
+			{
+				URLs:       []string{"turn:turn.cloudflare.com:3478?transport=udp"},
+				Username:   fmt.Sprintf("user-%d", count),
+				Credential: "secret",
+			},
+		}, nil
+	}
+
+	ttl := 100 * time.Second
+	provider := NewTurnCredentialProvider(fetch, ttl)
+	provider.Clock = clock
+	provider.RefreshFraction = 0.5
+	renewals := make(chan time.Time, 10)
+	provider.OnRenew = func(expiry time.Time) { renewals <- expiry }
+
+	start := clock.Now()
+	servers, err := provider.ICEServers(context.Background())
+	if err != nil {
+		t.Fatalf("ICEServers failed: %v", err)
+	}
+	if len(servers) != 2 || servers[0].Username != "" || servers[1].Username != "user-1" {
+		t.Fatalf("unexpected ICE servers: %+v", servers)
+	}
+	if got := <-fetches; got != ttl {
+		t.Fatalf("requested TTL %v, want %v", got, ttl)
+	}
+	if got, want := provider.Expiry(), start.Add(ttl); !got.Equal(want) {
+		t.Fatalf("expiry %v, want %v", got, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go provider.Run(ctx)
+
+	if d := clock.fire(clock.next(t)); d != 50*time.Second {
+		t.Fatalf("refresh scheduled after %v, want 50s", d)
+	}
+	select {
+	case <-fetches:
+	case <-time.After(5 * time.Second):
+		t.Fatal("credentials were not refreshed")
+	}
+	select {
+	case expiry := <-renewals:
+		if want := start.Add(50*time.Second + ttl); !expiry.Equal(want) {
+			t.Errorf("renewed credentials expire at %v, want %v", expiry, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("refreshed credentials were not passed to OnRenew")
+	}
+
+	// The next timer only gets requested once the refresh has completed.
+	if d := clock.fire(clock.next(t)); d != 50*time.Second {
+		t.Fatalf("second refresh scheduled after %v, want 50s", d)
+	}
+	<-fetches
+	// Once the next refresh got scheduled the previous one is complete.
+	clock.next(t)
+	if got, want := provider.Expiry(), start.Add(200*time.Second); !got.Equal(want) {
+		t.Fatalf("expiry %v, want %v", got, want)
+	}
+	servers, err = provider.ICEServers(context.Background())
+	if err != nil || servers[1].Username != "user-3" {
+		t.Fatalf("ICEServers returned %+v, %v, want the refreshed credentials", servers, err)
+	}
+}
+
+func TestTurnCredentialProviderRetry(t *testing.T) {
+	clock := newFakeClock()
+	fetches := make(chan struct{}, 10)
+	fetch := func(ctx context.Context, ttl time.Duration) ([]IceServer, error) {
+		fetches <- struct{}{}
+		return nil, fmt.Errorf("unavailable")
+	}
+
+	provider := NewTurnCredentialProvider(fetch, time.Hour)
+	provider.Clock = clock
+	provider.RetryInterval = 7 * time.Second
+	provider.OnRenew = func(time.Time) { t.Error("OnRenew called without credentials") }
+
+	if _, err := provider.ICEServers(context.Background()); err == nil {
+		t.Fatal("expected an error from ICEServers")
+	}
+	<-fetches
+	if !provider.Expiry().IsZero() {
+		t.Fatalf("expiry set without credentials: %v", provider.Expiry())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go provider.Run(ctx)
+
+	// Without any credentials the first refresh happens right away.
+	if d := clock.fire(clock.next(t)); d != 0 {
+		t.Fatalf("first refresh scheduled after %v, want 0", d)
+	}
+	<-fetches
+	if d := clock.fire(clock.next(t)); d != 7*time.Second {
+		t.Fatalf("retry scheduled after %v, want 7s", d)
+	}
+}
+
+// gatherRelayCandidates gathers the candidates for an offer of pc and
+// returns how many of them are relay candidates. restart requests an ICE
+// restart, which gathers with the ICE agent of the existing PeerConnection.
+func gatherRelayCandidates(t *testing.T, ctx context.Context, pc *webrtc.PeerConnection, restart bool) int {
+	t.Helper()
+	offer, err := pc.CreateOffer(&webrtc.OfferOptions{ICERestart: restart})
+	if err != nil {
+		t.Fatalf("error creating offer: %v", err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatalf("error setting local description: %v", err)
+	}
+	select {
+	case <-gatherComplete:
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for ICE gathering")
+	}
+	description, err := pc.LocalDescription().Unmarshal()
+	if err != nil {
+		t.Fatalf("error parsing local description: %v", err)
+	}
+	relays := 0
+	for _, media := range description.MediaDescriptions {
+		for _, attribute := range media.Attributes {
+			if attribute.IsICECandidate() && strings.Contains(attribute.Value, " typ relay") {
+				relays++
+			}
+		}
+	}
+	return relays
+}
+
+func TestTurnCredentialProviderExpiry(t *testing.T) {
+	local, err := startLocalTurn()
+	if err != nil {
+		t.Fatalf("error starting local TURN server: %v", err)
+	}
+	defer local.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	provider := NewTurnCredentialProvider(func(ctx context.Context, ttl time.Duration) ([]IceServer, error) {
+		return newLocalTurnClient(local, local.APIToken).GenerateICEServers(ctx, ttl)
+	}, time.Second)
+
+	// A PeerConnection created with valid credentials gets a relay.
+	configuration, err := createNewWebrtcConfiguration(ctx, provider, webrtc.ICETransportPolicyRelay)
+	if err != nil {
+		t.Fatalf("error creating configuration: %v", err)
+	}
+	stale, err := webrtc.NewPeerConnection(configuration)
+	if err != nil {
+		t.Fatalf("error creating PeerConnection: %v", err)
+	}
+	defer stale.Close()
+	if _, err := stale.CreateDataChannel("data", nil); err != nil {
+		t.Fatalf("error creating data channel: %v", err)
+	}
+	if gatherRelayCandidates(t, ctx, stale, false) == 0 {
+		t.Fatal("no relay candidate with valid credentials")
+	}
+	// ICE can only be restarted once the offer got answered.
+	remote, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("error creating PeerConnection: %v", err)
+	}
+	defer remote.Close()
+	if err := remote.SetRemoteDescription(*stale.LocalDescription()); err != nil {
+		t.Fatalf("error setting remote description: %v", err)
+	}
+	answer, err := remote.CreateAnswer(nil)
+	if err != nil {
+		t.Fatalf("error creating answer: %v", err)
+	}
+	if err := remote.SetLocalDescription(answer); err != nil {
+		t.Fatalf("error setting local description: %v", err)
+	}
+	if err := stale.SetRemoteDescription(answer); err != nil {
+		t.Fatalf("error setting remote description: %v", err)
+	}
+
+	// The TURN server rejects the credentials once they expired, which an
+	// ICE restart still uses.
+	time.Sleep(time.Until(provider.Expiry().Add(1100 * time.Millisecond)))
+	if n := gatherRelayCandidates(t, ctx, stale, true); n != 0 {
+		t.Fatalf("ICE restart gathered %d relay candidates with expired credentials", n)
+	}
+
+	// The provider fetches new credentials for PeerConnections created
+	// afterwards.
+	configuration, err = createNewWebrtcConfiguration(ctx, provider, webrtc.ICETransportPolicyRelay)
+	if err != nil {
+		t.Fatalf("error creating configuration: %v", err)
+	}
+	fresh, err := webrtc.NewPeerConnection(configuration)
+	if err != nil {
+		t.Fatalf("error creating PeerConnection: %v", err)
+	}
+	defer fresh.Close()
+	if _, err := fresh.CreateDataChannel("data", nil); err != nil {
+		t.Fatalf("error creating data channel: %v", err)
+	}
+	if gatherRelayCandidates(t, ctx, fresh, false) == 0 {
+		t.Fatal("no relay candidate with refreshed credentials")
+	}
+}